@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+// 一种消息的组合
+type MsgSpec struct {
+	MsgID  uint32
+	Size   int
+	Weight int
+}
+
+// 解析msgID:消息长度[:权重]格式的消息组合
+func parseMix(s string) ([]MsgSpec, error) {
+	var mix []MsgSpec
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("bad item %q", item)
+		}
+		msgID, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad msgID %q", parts[0])
+		}
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("bad size %q", parts[1])
+		}
+		// 消息体前8字节为发送时间
+		if size < 8 {
+			size = 8
+		}
+		weight := 1
+		if len(parts) == 3 {
+			if weight, err = strconv.Atoi(parts[2]); err != nil || weight <= 0 {
+				return nil, fmt.Errorf("bad weight %q", parts[2])
+			}
+		}
+		mix = append(mix, MsgSpec{MsgID: uint32(msgID), Size: size, Weight: weight})
+	}
+	return mix, nil
+}
+
+type Bench struct {
+	Addr     string
+	Conns    int
+	Duration time.Duration
+	Rate     int
+	Mix      []MsgSpec
+	Timeout  time.Duration
+	Conf     *utils.GlobalObj
+
+	// 统计
+	sent       uint64
+	received   uint64
+	errors     uint64
+	reconnects uint64
+	latencies  []time.Duration
+	latLock    sync.Mutex
+}
+
+// 执行压测并返回报告
+func (b *Bench) Run() *Report {
+	start := time.Now()
+	deadline := start.Add(b.Duration)
+	var wg sync.WaitGroup
+	for i := 0; i < b.Conns; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			b.runConn(id, deadline)
+		}(i)
+	}
+	wg.Wait()
+	return b.report(time.Since(start))
+}
+
+// 单个连接的压测循环，连接出错时重新连接
+func (b *Bench) runConn(id int, deadline time.Time) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	var interval time.Duration
+	if b.Rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(b.Conns) / float64(b.Rate))
+	}
+	for first := true; time.Now().Before(deadline); first = false {
+		if !first {
+			atomic.AddUint64(&b.reconnects, 1)
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := b.session(rnd, interval, deadline); err != nil {
+			atomic.AddUint64(&b.errors, 1)
+		}
+	}
+}
+
+// 建立一个连接并持续发送消息，直到压测结束或者出错
+func (b *Bench) session(rnd *rand.Rand, interval time.Duration, deadline time.Time) error {
+	conn, dp, err := b.dial()
+	if err != nil {
+		return err
+	}
+
+	// 读goroutine在连接关闭之后退出，返回之前等待它结束，之后不再修改统计
+	replies := make(chan struct{}, 1)
+	readDone := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(readDone)
+		readErr = b.readLoop(conn, dp, replies)
+	}()
+	defer func() {
+		conn.Close()
+		<-readDone
+	}()
+
+	var fragID uint32
+	next := time.Now()
+	for time.Now().Before(deadline) {
+		spec := b.pick(rnd)
+		data := make([]byte, spec.Size)
+		binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+		fragID++
+		frames, err := dp.PackFragments(znet.NewMsgPackage(spec.MsgID, data), fragID)
+		if err != nil {
+			return err
+		}
+		for _, frame := range frames {
+			if _, err := conn.Write(frame); err != nil {
+				return err
+			}
+		}
+		atomic.AddUint64(&b.sent, 1)
+
+		if interval > 0 {
+			// 按固定间隔发送，落后时不补发
+			next = next.Add(interval)
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-readDone:
+					return readErr
+				}
+			} else {
+				next = time.Now()
+			}
+			continue
+		}
+		// 收到回复之后再发送下一个消息
+		select {
+		case <-replies:
+		case <-readDone:
+			return readErr
+		case <-time.After(b.Timeout):
+			return fmt.Errorf("reply timeout")
+		}
+	}
+	return nil
+}
+
+// 持续读取回复并记录时延
+func (b *Bench) readLoop(conn net.Conn, dp ziface.IDataPack, replies chan<- struct{}) error {
+	reassembler := znet.NewReassembler(0, time.Minute)
+	for {
+		msg, err := znet.ReadFullMsg(conn, dp, reassembler)
+		if err != nil {
+			return err
+		}
+		// 心跳、错误回复等其他消息不带发送时间，只统计压测消息的回复
+		data := msg.GetData()
+		if !b.isBenchMsg(msg.GetMsgId()) || len(data) < 8 {
+			continue
+		}
+		latency := time.Since(time.Unix(0, int64(binary.LittleEndian.Uint64(data))))
+		atomic.AddUint64(&b.received, 1)
+		b.latLock.Lock()
+		b.latencies = append(b.latencies, latency)
+		b.latLock.Unlock()
+		select {
+		case replies <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// msgID是否为压测发送的消息
+func (b *Bench) isBenchMsg(msgID uint32) bool {
+	for _, spec := range b.Mix {
+		if spec.MsgID == msgID {
+			return true
+		}
+	}
+	return false
+}
+
+// 建立连接并完成握手
+func (b *Bench) dial() (net.Conn, ziface.IDataPack, error) {
+	conn, err := net.DialTimeout("tcp", b.Addr, b.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(b.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	stream, info, err := znet.ClientHandshake(conn, b.Conf)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return stream, znet.NewDataPackWithProtocol(b.Conf, info), nil
+}
+
+// 按权重随机选择一种消息
+func (b *Bench) pick(rnd *rand.Rand) MsgSpec {
+	total := 0
+	for _, spec := range b.Mix {
+		total += spec.Weight
+	}
+	n := rnd.Intn(total)
+	for _, spec := range b.Mix {
+		if n < spec.Weight {
+			return spec
+		}
+		n -= spec.Weight
+	}
+	return b.Mix[len(b.Mix)-1]
+}
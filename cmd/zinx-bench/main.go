@@ -0,0 +1,71 @@
+package main
+
+/*
+	zinx-bench 压测工具
+	建立N个并发连接，按照指定的msgID和消息长度组合以目标速率发送消息，
+	服务端需要把消息原样返回(echo)，消息体前8字节为发送时间，用于计算时延。
+	rate为0时每个连接收到回复后再发送下一个消息。
+
+	示例:
+		zinx-bench -addr 127.0.0.1:8999 -c 100 -rate 5000 -d 30s -mix 10:64:3,11:4096:1 -format json
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8999", "服务端地址")
+	conns := flag.Int("c", 10, "并发连接数")
+	duration := flag.Duration("d", 10*time.Second, "压测时长")
+	rate := flag.Int("rate", 0, "所有连接合计的目标发送速率(消息/秒)，0表示收到回复后再发送下一个")
+	mix := flag.String("mix", "10:64", "消息组合，格式为msgID:消息长度[:权重]，多个组合用逗号分隔")
+	timeout := flag.Duration("timeout", 5*time.Second, "等待回复的超时时间，超时后重新连接")
+	format := flag.String("format", "text", "报告格式，text或json")
+	maxPackageSize := flag.Uint("maxpkg", uint(utils.GlobalObject.MaxPackageSize), "最大数据包长度，需要和服务端一致")
+	protocol := flag.Bool("protocol", false, "进行协议握手")
+	encrypt := flag.Bool("encrypt", false, "开启会话加密")
+	checksum := flag.Bool("checksum", false, "开启消息校验和")
+	compression := flag.String("compression", "", "消息压缩算法")
+	flag.Parse()
+
+	msgMix, err := parseMix(*mix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -mix:", err)
+		os.Exit(2)
+	}
+	conf := *utils.GlobalObject
+	conf.MaxPackageSize = uint32(*maxPackageSize)
+	conf.ProtocolHandshake = *protocol
+	conf.SessionEncryption = *encrypt
+	conf.FrameChecksum = *checksum
+	conf.Compression = *compression
+
+	b := &Bench{
+		Addr:     *addr,
+		Conns:    *conns,
+		Duration: *duration,
+		Rate:     *rate,
+		Mix:      msgMix,
+		Timeout:  *timeout,
+		Conf:     &conf,
+	}
+	report := b.Run()
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+	if report.Received == 0 {
+		os.Exit(1)
+	}
+}
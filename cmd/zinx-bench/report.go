@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 压测报告
+type Report struct {
+	Conns      int           `json:"conns"`
+	Elapsed    float64       `json:"elapsedSeconds"`
+	Sent       uint64        `json:"sent"`
+	Received   uint64        `json:"received"`
+	Errors     uint64        `json:"errors"`
+	Reconnects uint64        `json:"reconnects"`
+	SendRate   float64       `json:"sendRate"`   // 每秒发送的消息数
+	Throughput float64       `json:"throughput"` // 每秒收到回复的消息数
+	Latency    LatencyReport `json:"latencyMs"`
+}
+
+// 时延分布，单位为毫秒
+type LatencyReport struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (b *Bench) report(elapsed time.Duration) *Report {
+	r := &Report{
+		Conns:      b.Conns,
+		Elapsed:    elapsed.Seconds(),
+		Sent:       atomic.LoadUint64(&b.sent),
+		Received:   atomic.LoadUint64(&b.received),
+		Errors:     atomic.LoadUint64(&b.errors),
+		Reconnects: atomic.LoadUint64(&b.reconnects),
+	}
+	if elapsed > 0 {
+		r.SendRate = float64(r.Sent) / elapsed.Seconds()
+		r.Throughput = float64(r.Received) / elapsed.Seconds()
+	}
+
+	b.latLock.Lock()
+	latencies := append([]time.Duration(nil), b.latencies...)
+	b.latLock.Unlock()
+	if len(latencies) == 0 {
+		return r
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	r.Latency = LatencyReport{
+		Min:  ms(latencies[0]),
+		Mean: ms(sum / time.Duration(len(latencies))),
+		P50:  ms(percentile(latencies, 50)),
+		P90:  ms(percentile(latencies, 90)),
+		P99:  ms(percentile(latencies, 99)),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+	return r
+}
+
+// 获取已排序时延的第p百分位
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// 以文本格式输出报告
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "conns:       %d\n", r.Conns)
+	fmt.Fprintf(w, "elapsed:     %.2fs\n", r.Elapsed)
+	fmt.Fprintf(w, "sent:        %d (%.1f msg/s)\n", r.Sent, r.SendRate)
+	fmt.Fprintf(w, "received:    %d (%.1f msg/s)\n", r.Received, r.Throughput)
+	fmt.Fprintf(w, "errors:      %d\n", r.Errors)
+	fmt.Fprintf(w, "reconnects:  %d\n", r.Reconnects)
+	fmt.Fprintf(w, "latency(ms): min %.3f, mean %.3f, p50 %.3f, p90 %.3f, p99 %.3f, max %.3f\n",
+		r.Latency.Min, r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+const helpText = `commands:
+  send <msgID> [text]     发送文本消息
+  hex <msgID> <hex>       发送十六进制表示的消息
+  json <msgID> <file>     发送JSON文件的内容
+  ping                    发送心跳并显示往返时延
+  wait <duration>         等待一段时间，例如 wait 500ms
+  help                    显示帮助
+  quit                    退出`
+
+// 系统消息ID的名称
+var sysMsgNames = map[uint32]string{
+	utils.PING_MSG_ID:         "PING",
+	utils.PONG_MSG_ID:         "PONG",
+	utils.SESSION_KEY_MSG_ID:  "SESSION_KEY",
+	utils.ERROR_MSG_ID:        "ERROR",
+	utils.AUTH_OK_MSG_ID:      "AUTH_OK",
+	utils.RESUME_TOKEN_MSG_ID: "RESUME_TOKEN",
+	utils.RESUME_MSG_ID:       "RESUME",
+	utils.RESUME_OK_MSG_ID:    "RESUME_OK",
+	utils.RELIABLE_ACK_MSG_ID: "RELIABLE_ACK",
+}
+
+type CLI struct {
+	conn net.Conn
+	dp   ziface.IDataPack
+	out  io.Writer
+	// 保护输出和写入的锁
+	outLock   sync.Mutex
+	writeLock sync.Mutex
+	// 发送大消息时分配分片ID的计数
+	fragID uint32
+	// 最近一次ping的发送时间，unix纳秒
+	pingSent int64
+	// 连接关闭的通知
+	closed chan struct{}
+}
+
+func NewCLI(conn net.Conn, dp ziface.IDataPack, out io.Writer) *CLI {
+	return &CLI{conn: conn, dp: dp, out: out, closed: make(chan struct{})}
+}
+
+// 连接关闭时关闭的channel
+func (c *CLI) Closed() <-chan struct{} {
+	return c.closed
+}
+
+func (c *CLI) printf(format string, args ...interface{}) {
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+	fmt.Fprintf(c.out, format, args...)
+}
+
+// 读取命令并执行，interactive为true时显示提示符并在出错后继续
+func (c *CLI) Run(r io.Reader, interactive bool) error {
+	scanner := bufio.NewScanner(r)
+	for {
+		if interactive {
+			c.printf("zinx> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if err := c.Exec(line); err != nil {
+			if !interactive {
+				return fmt.Errorf("%q: %v", line, err)
+			}
+			c.printf("error: %v\n", err)
+		}
+	}
+}
+
+// 执行一条命令
+func (c *CLI) Exec(line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "help":
+		c.printf("%s\n", helpText)
+		return nil
+	case "ping":
+		ts := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+		atomic.StoreInt64(&c.pingSent, time.Now().UnixNano())
+		return c.send(utils.PING_MSG_ID, ts)
+	case "wait":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: wait <duration>")
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+		return nil
+	case "send", "hex", "json":
+	default:
+		return fmt.Errorf("unknown command %q, type help for usage", fields[0])
+	}
+
+	if len(fields) < 2 {
+		return fmt.Errorf("usage: %s <msgID> ...", fields[0])
+	}
+	msgID, err := strconv.ParseUint(fields[1], 0, 32)
+	if err != nil {
+		return fmt.Errorf("bad msgID %q", fields[1])
+	}
+	// 命令和msgID之后的原始文本
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[len(fields[0]):]), fields[1]))
+
+	var data []byte
+	switch fields[0] {
+	case "send":
+		data = []byte(rest)
+	case "hex":
+		if data, err = hex.DecodeString(strings.Join(strings.Fields(rest), "")); err != nil {
+			return err
+		}
+	case "json":
+		raw, err := os.ReadFile(rest)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return fmt.Errorf("invalid json: %v", err)
+		}
+		data = buf.Bytes()
+	}
+	return c.send(uint32(msgID), data)
+}
+
+// 发送一个消息
+func (c *CLI) send(msgID uint32, data []byte) error {
+	frames, err := c.dp.PackFragments(znet.NewMsgPackage(msgID, data), atomic.AddUint32(&c.fragID, 1))
+	if err != nil {
+		return err
+	}
+	c.printf("-> %s len=%d\n", msgName(msgID), len(data))
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	for _, frame := range frames {
+		if _, err := c.conn.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 持续读取并打印服务端的消息
+func (c *CLI) ReadLoop() {
+	defer close(c.closed)
+	reassembler := znet.NewReassembler(0, time.Minute)
+	for {
+		msg, err := znet.ReadFullMsg(c.conn, c.dp, reassembler)
+		if err != nil {
+			c.printf("\nconnection closed: %v\n", err)
+			return
+		}
+		c.printMsg(msg)
+		// 确认服务端的可靠消息
+		if seq := msg.GetSeq(); seq != 0 {
+			c.send(utils.RELIABLE_ACK_MSG_ID, znet.EncodeAck(seq))
+		}
+
+		switch msg.GetMsgId() {
+		case utils.PING_MSG_ID:
+			// 回复服务端的主动心跳，原样返回时间戳
+			c.send(utils.PONG_MSG_ID, msg.GetData())
+		case utils.PONG_MSG_ID:
+			if sent := atomic.SwapInt64(&c.pingSent, 0); sent > 0 {
+				c.printf("   rtt=%s\n", time.Since(time.Unix(0, sent)))
+			}
+		}
+	}
+}
+
+// 打印一个消息的ID、长度和内容
+func (c *CLI) printMsg(msg ziface.IMessage) {
+	data := msg.GetData()
+	header := fmt.Sprintf("<- %s len=%d", msgName(msg.GetMsgId()), len(data))
+	if seq := msg.GetSeq(); seq != 0 {
+		header += fmt.Sprintf(" seq=%d", seq)
+	}
+	if trace := msg.GetTrace(); trace.IsValid() {
+		header += " trace=" + hex.EncodeToString(trace.TraceID[:])
+	}
+	c.printf("\n%s\n%s", header, formatPayload(data))
+}
+
+// 消息ID的显示名称
+func msgName(msgID uint32) string {
+	if name, ok := sysMsgNames[msgID]; ok {
+		return fmt.Sprintf("msgID=%d(%s)", msgID, name)
+	}
+	return fmt.Sprintf("msgID=%d", msgID)
+}
+
+// 格式化消息内容，JSON缩进显示，可打印文本直接显示，其他显示十六进制
+func formatPayload(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	if json.Valid(data) && (data[0] == '{' || data[0] == '[') {
+		json.Indent(&buf, data, "   ", "  ")
+		return "   " + buf.String() + "\n"
+	}
+	if isPrintable(data) {
+		return fmt.Sprintf("   %q\n", data)
+	}
+	return hex.Dump(data)
+}
+
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+/*
+	zinx-cli 调试客户端
+	连接到zinx服务端，以交互方式或者脚本发送消息，并打印收到的每一个消息。
+
+	示例:
+		zinx-cli -host 127.0.0.1 -port 8999
+		zinx-cli -script login.txt
+		zinx-cli -listen
+*/
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/znet"
+)
+
+func main() {
+	host := flag.String("host", "127.0.0.1", "服务端地址")
+	port := flag.Int("port", 8999, "服务端端口")
+	script := flag.String("script", "", "脚本文件，每行一个命令，执行完成后退出")
+	listen := flag.Bool("listen", false, "只接收并打印消息，不读取命令")
+	maxPackageSize := flag.Uint("maxpkg", uint(utils.GlobalObject.MaxPackageSize), "最大数据包长度，需要和服务端一致")
+	protocol := flag.Bool("protocol", false, "进行协议握手")
+	encrypt := flag.Bool("encrypt", false, "开启会话加密")
+	checksum := flag.Bool("checksum", false, "开启消息校验和")
+	compression := flag.String("compression", "", "消息压缩算法")
+	codecs := flag.String("codecs", "", "协议握手时支持的消息编码，逗号分隔")
+	flag.Parse()
+
+	conf := *utils.GlobalObject
+	conf.MaxPackageSize = uint32(*maxPackageSize)
+	conf.ProtocolHandshake = *protocol
+	conf.SessionEncryption = *encrypt
+	conf.FrameChecksum = *checksum
+	conf.Compression = *compression
+	if *codecs != "" {
+		conf.Codecs = strings.Split(*codecs, ",")
+	}
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dial err:", err)
+		os.Exit(1)
+	}
+	stream, info, err := znet.ClientHandshake(conn, &conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "handshake err:", err)
+		os.Exit(1)
+	}
+	dp := znet.NewDataPackWithProtocol(&conf, info)
+	fmt.Printf("connected to %s, protocol %+v\n", addr, info)
+
+	cli := NewCLI(stream, dp, os.Stdout)
+	go cli.ReadLoop()
+
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open script err:", err)
+			os.Exit(1)
+		}
+		err = cli.Run(f, false)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	switch {
+	case *listen:
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		select {
+		case <-sig:
+		case <-cli.Closed():
+		}
+	case *script == "":
+		cli.Run(os.Stdin, true)
+	}
+	stream.Close()
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	配置热加载模块
+	通过轮询配置文件的修改时间发现变更，可以安全在运行时修改的配置项会被直接应用，
+	需要重启才能生效的配置项会被拒绝并给出报告。
+	被监听的配置对象在运行期间会被多个goroutine读取，热加载不修改它，
+	而是发布一个新的只读配置快照，通过Current获取，并通知订阅者把变更应用到运行中的组件上
+*/
+
+// 可以在运行时安全修改的配置项
+var hotReloadFields = map[string]bool{
+	"MaxConn":           true,
+	"MaxPackageSize":    true,
+	"HeartbeatInterval": true,
+	"HeartbeatTimeout":  true,
+}
+
+// 一个配置项的变更
+type ConfigFieldChange struct {
+	Field  string      // 配置项名称
+	Old    interface{} // 变更前的值
+	New    interface{} // 变更后的值
+	Reason string      // 被拒绝的原因，已应用的变更为空
+}
+
+// 一次配置热加载的结果报告
+type ConfigReport struct {
+	Applied  []ConfigFieldChange // 已经在运行时生效的变更
+	Rejected []ConfigFieldChange // 被拒绝的变更
+}
+
+func (r *ConfigReport) String() string {
+	var sb strings.Builder
+	for _, c := range r.Applied {
+		fmt.Fprintf(&sb, "[zinx] config %s applied: %v -> %v\n", c.Field, c.Old, c.New)
+	}
+	for _, c := range r.Rejected {
+		fmt.Fprintf(&sb, "[zinx] config %s rejected: %v -> %v, %s\n", c.Field, c.Old, c.New, c.Reason)
+	}
+	return sb.String()
+}
+
+type ConfigWatcher struct {
+	// 监听的配置文件路径
+	path string
+	// 轮询间隔
+	interval time.Duration
+	// 当前生效的配置快照，每次热加载时整体替换，发布之后不再修改
+	current atomic.Pointer[GlobalObj]
+	// 上一次从配置文件加载的配置，用于找出文件中发生变化的配置项
+	last *GlobalObj
+	// 配置文件最后一次的修改时间
+	modTime time.Time
+	// 配置变更的订阅者
+	subscribers []func(change ConfigFieldChange)
+	// 保护last、modTime和subscribers的锁
+	lock sync.Mutex
+	// 通知轮询goroutine退出的channel
+	exitChan chan struct{}
+}
+
+// 创建一个配置文件监听器，conf为启动时的配置，热加载不会修改conf
+func NewConfigWatcher(path string, conf *GlobalObj, interval time.Duration) *ConfigWatcher {
+	w := &ConfigWatcher{
+		path:     path,
+		interval: interval,
+	}
+	current := *conf
+	w.current.Store(&current)
+	// 记录当前配置文件的内容和修改时间，避免启动后第一次轮询就当作变更处理
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	if last, err := LoadConfig(path, conf); err == nil {
+		w.last = last
+	} else {
+		last := *conf
+		w.last = &last
+	}
+	return w
+}
+
+// 获取当前生效的配置快照，返回的配置是只读的，不能修改
+func (w *ConfigWatcher) Current() *GlobalObj {
+	return w.current.Load()
+}
+
+// 订阅配置变更，每一个被应用的配置项都会通知一次
+func (w *ConfigWatcher) Subscribe(fn func(change ConfigFieldChange)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// 开始轮询配置文件
+func (w *ConfigWatcher) Start() {
+	w.lock.Lock()
+	if w.exitChan != nil || w.interval <= 0 {
+		w.lock.Unlock()
+		return
+	}
+	w.exitChan = make(chan struct{})
+	exitChan := w.exitChan
+	w.lock.Unlock()
+
+	fmt.Printf("[zinx] Config watcher started, file: %s, interval: %s\n", w.path, w.interval)
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report, err := w.Check()
+				if err != nil {
+					fmt.Println("[zinx] config reload err:", err)
+					continue
+				}
+				if report != nil {
+					fmt.Print(report)
+				}
+			case <-exitChan:
+				return
+			}
+		}
+	}()
+}
+
+// 停止轮询配置文件
+func (w *ConfigWatcher) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.exitChan != nil {
+		close(w.exitChan)
+		w.exitChan = nil
+	}
+}
+
+// 立即检查一次配置文件，文件没有变化时返回nil
+func (w *ConfigWatcher) Check() (*ConfigReport, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	w.lock.Lock()
+	if !info.ModTime().After(w.modTime) {
+		w.lock.Unlock()
+		return nil, nil
+	}
+	w.modTime = info.ModTime()
+	next, err := LoadConfig(w.path, w.last)
+	if err != nil {
+		w.lock.Unlock()
+		return nil, err
+	}
+	report := w.apply(next)
+	subscribers := make([]func(change ConfigFieldChange), len(w.subscribers))
+	copy(subscribers, w.subscribers)
+	w.lock.Unlock()
+
+	// 在锁外通知订阅者，避免订阅者中再次访问watcher造成死锁
+	for _, change := range report.Applied {
+		for _, fn := range subscribers {
+			fn(change)
+		}
+	}
+	return report, nil
+}
+
+// 找出配置文件中发生变化的配置项，将可以热更新的配置项写入新的配置快照并发布，调用时需要持有lock
+// 只比较文件前后两次的内容，通过代码单独设置的配置项在文件没有修改时不会被覆盖
+func (w *ConfigWatcher) apply(next *GlobalObj) *ConfigReport {
+	report := &ConfigReport{}
+	updated := *w.current.Load()
+	cur := reflect.ValueOf(&updated).Elem()
+	last := reflect.ValueOf(w.last).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	w.last = next
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		// 跳过Server对象这类不能从文件加载的字段
+		if field.Type.Kind() == reflect.Interface {
+			continue
+		}
+		oldVal, newVal := cur.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(last.Field(i).Interface(), newVal) || reflect.DeepEqual(oldVal, newVal) {
+			continue
+		}
+		change := ConfigFieldChange{Field: field.Name, Old: oldVal, New: newVal}
+		if !hotReloadFields[field.Name] {
+			change.Reason = "need restart"
+			report.Rejected = append(report.Rejected, change)
+			continue
+		}
+		if reason := validateHotField(next, field.Name); reason != "" {
+			change.Reason = reason
+			report.Rejected = append(report.Rejected, change)
+			continue
+		}
+		cur.Field(i).Set(nv.Field(i))
+		report.Applied = append(report.Applied, change)
+	}
+	if len(report.Applied) > 0 {
+		w.current.Store(&updated)
+	}
+	return report
+}
+
+// 校验热更新配置项的取值，合法时返回空字符串
+func validateHotField(conf *GlobalObj, field string) string {
+	switch field {
+	case "MaxConn":
+		if conf.MaxConn <= 0 {
+			return "MaxConn must be positive"
+		}
+	case "HeartbeatInterval":
+		if conf.HeartbeatInterval <= 0 {
+			return "HeartbeatInterval must be positive"
+		}
+	case "HeartbeatTimeout":
+		if conf.HeartbeatTimeout <= 0 {
+			return "HeartbeatTimeout must be positive"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+	配置热加载的测试
+*/
+
+func TestConfigWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zinx.json")
+	if err := os.WriteFile(path, []byte(`{"MaxConn": 100, "TcpPort": 8999}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &GlobalObj{MaxConn: 100, TcpPort: 8999, HeartbeatInterval: 60}
+	w := NewConfigWatcher(path, conf, time.Second)
+
+	var applied []ConfigFieldChange
+	w.Subscribe(func(change ConfigFieldChange) {
+		applied = append(applied, change)
+	})
+
+	// 文件没有变化
+	if report, err := w.Check(); err != nil || report != nil {
+		t.Fatalf("unexpected report %v, err %v", report, err)
+	}
+
+	// 修改一个可以热更新的配置、一个需要重启的配置和一个非法的配置
+	data := []byte(`{"MaxConn": 200, "TcpPort": 9000, "HeartbeatInterval": 0}`)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	os.Chtimes(path, future, future)
+
+	report, err := w.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Applied) != 1 || report.Applied[0].Field != "MaxConn" {
+		t.Fatalf("applied = %v", report.Applied)
+	}
+	if len(report.Rejected) != 2 {
+		t.Fatalf("rejected = %v", report.Rejected)
+	}
+	if cur := w.Current(); cur.MaxConn != 200 || cur.TcpPort != 8999 || cur.HeartbeatInterval != 60 {
+		t.Fatalf("current = %+v", cur)
+	}
+	// 运行中被其他goroutine读取的配置对象不会被修改
+	if conf.MaxConn != 100 {
+		t.Fatalf("live conf modified, MaxConn = %d", conf.MaxConn)
+	}
+	if len(applied) != 1 || applied[0].New != 200 {
+		t.Fatalf("subscriber got %v", applied)
+	}
+}
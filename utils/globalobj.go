@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 
 	"github.com/Xaytick/zinx/ziface"
@@ -10,6 +11,7 @@ import (
 /*
 存储有关zinx的全局参数，供其他模块使用
 一些参数可以通过zinx.json由用户进行配置
+GlobalObject只作为默认配置来源，每个Server创建时会复制一份作为自己的配置
 */
 
 type GlobalObj struct {
@@ -27,8 +29,51 @@ type GlobalObj struct {
 	// 心跳相关
 	HeartbeatInterval int // 心跳检测间隔时间，单位为秒
 	HeartbeatTimeout  int // 心跳超时时间，单位为秒
+	// 主动心跳相关
+	HeartbeatActive    bool // 是否由服务端主动发送心跳并测量RTT
+	HeartbeatMaxMissed int  // 主动心跳允许连续丢失的次数，超过后断开连接
+	// 消息压缩相关
+	Compression       string // 消息压缩算法，内置deflate和gzip，为空表示不压缩
+	CompressThreshold uint32 // 消息体达到该长度时才进行压缩
+	MaxDecompressSize uint32 // 解压后的消息体最大长度，防止压缩炸弹
+	// 消息校验相关
+	FrameChecksum          bool   // 是否在消息头中携带CRC32C校验和，客户端需要使用相同的设置
+	ChecksumMismatchAction string // 消息体校验和不匹配时的处理方式，drop丢弃该消息，close关闭连接
+	// 大消息分片相关
+	MaxReassemblySize uint32 // 分片重组后的消息最大长度，为0时和MaxDecompressSize相同
+	ReassemblyTimeout int    // 一个消息的所有分片需要在该时间内到达，单位为秒
+	// 连接握手相关
+	ProtocolHandshake bool // 是否开启协议握手，连接建立时先校验魔数和协议版本并协商压缩、加密等特性
+	SessionEncryption bool // 是否开启会话加密，连接建立时进行ECDH密钥交换，之后使用AES-GCM加密
+	HandshakeTimeout  int  // 连接握手的超时时间，单位为秒
+	// 协议握手时可以选择的消息编码，按优先级排列，为空表示不协商编码
+	Codecs []string
+	// 认证相关
+	AuthTimeout int // 设置认证器后，连接需要在该时间内完成认证，单位为秒
+	// 协议违规相关
+	MaxProtocolViolations int // 连接的协议违规分数超过该值时关闭连接，0表示不限制
+	// 管理接口相关
+	AdminAddr  string // 管理HTTP接口的监听地址，例如127.0.0.1:9000，为空时不开启
+	AdminToken string // 访问管理接口需要的token，通过Authorization: Bearer <token>传递，为空时只能监听在本地回环地址
+	// 会话恢复相关
+	SessionGracePeriod int // 连接断开后会话保留的时间，在此期间可以使用token恢复会话，单位为秒，0表示不开启
+	SessionReplaySize  int // 每个会话保留的最近发送的消息数量，恢复会话时重放
+	// 出站消息优先级相关
+	SendQueueSize     int   // 每个优先级发送通道的缓冲消息数量
+	PriorityWeights   []int // 高、普通、低优先级通道的发送权重，所有通道都有消息时按权重轮流发送
+	StarvationTimeout int   // 消息排队超过该时间时优先发送，避免低优先级消息饿死，单位为毫秒，0表示不开启
+	// 可靠投递相关
+	ReliableMsgIDs     []uint32 // 开启可靠投递的消息ID，发送的消息需要对端确认
+	ReliableMaxPending int      // 每个连接最多保留的没有确认的可靠消息数量，0表示不限制
+	// 链路追踪相关
+	TraceFile string // 不为空时开启链路追踪，Span以JSON格式逐行写入该文件
+	// 配置热加载
+	ConfigReloadInterval int // 配置文件轮询间隔时间，单位为秒，0表示不开启热加载
 }
 
+// 默认的配置文件路径
+var ConfFilePath = "conf/zinx.json"
+
 // 定义一个全局的对外GlobalObj
 var GlobalObject *GlobalObj
 
@@ -47,17 +92,73 @@ func init() {
 		// 默认心跳配置
 		HeartbeatInterval: 60,  // 默认60秒检测一次
 		HeartbeatTimeout:  180, // 默认180秒超时
+		// 默认关闭主动心跳
+		HeartbeatActive:    false,
+		HeartbeatMaxMissed: 3,
+		// 默认不压缩
+		Compression:       "",
+		CompressThreshold: 1024,
+		MaxDecompressSize: 1 << 20,
+		// 默认不开启校验和
+		FrameChecksum:          false,
+		ChecksumMismatchAction: "close",
+		// 默认分片重组的上限和解压后的上限相同
+		MaxReassemblySize: 0,
+		ReassemblyTimeout: 30,
+		// 默认不开启协议握手和会话加密，兼容旧的客户端
+		ProtocolHandshake: false,
+		SessionEncryption: false,
+		HandshakeTimeout:  10,
+		// 默认30秒内完成认证
+		AuthTimeout: 30,
+		// 默认不因协议违规关闭连接
+		MaxProtocolViolations: 0,
+		// 默认不开启会话恢复
+		SessionGracePeriod: 0,
+		SessionReplaySize:  64,
+		// 默认的出站消息优先级配置
+		SendQueueSize:     64,
+		PriorityWeights:   []int{8, 4, 1},
+		StarvationTimeout: 500,
+		// 默认每个连接最多1024条没有确认的可靠消息
+		ReliableMaxPending: 1024,
 	}
 
 	// 应该通过zinx.json来加载自定义的参数
 	GlobalObject.Reload()
 }
 
-// 加载用户自定义的配置文件
+// 分片重组后的消息最大长度，没有单独配置时和解压后的最大长度相同，
+// 两者都为0时返回0，由重组器使用默认的上限
+func (g *GlobalObj) ReassemblyLimit() uint32 {
+	if g.MaxReassemblySize > 0 {
+		return g.MaxReassemblySize
+	}
+	return g.MaxDecompressSize
+}
+
+// 加载用户自定义的配置文件，配置文件不存在时保持默认值
 func (g *GlobalObj) Reload() {
-	data, err := os.ReadFile("conf/zinx.json")
+	data, err := os.ReadFile(ConfFilePath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("[zinx] config file", ConfFilePath, "not found, use default config")
+			return
+		}
 		panic(err)
 	}
-	json.Unmarshal(data, &GlobalObject)
+	json.Unmarshal(data, g)
+}
+
+// 以base为基础读取配置文件，返回一个新的配置对象，base本身不会被修改
+func LoadConfig(path string, base *GlobalObj) (*GlobalObj, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := *base
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("parse config file %s err: %v", path, err)
+	}
+	return &conf, nil
 }
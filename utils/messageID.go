@@ -3,6 +3,27 @@ package utils
 // 系统预定义的消息ID常量
 const (
 	// 心跳相关
-	PING_MSG_ID uint32 = 1  // 心跳检测消息ID
-	PONG_MSG_ID uint32 = 2  // 心跳响应消息ID
-) 
\ No newline at end of file
+	PING_MSG_ID uint32 = 1 // 心跳检测消息ID
+	PONG_MSG_ID uint32 = 2 // 心跳响应消息ID
+)
+
+// 系统保留的消息ID，从高位开始分配，避免和业务消息ID冲突
+const (
+	// 加密会话相关
+	SESSION_KEY_MSG_ID uint32 = 0xFFFFFF00 // 加密会话握手，交换ECDH公钥
+	// 系统错误回复
+	ERROR_MSG_ID uint32 = 0xFFFFFF01 // 请求被框架拒绝时回复的错误消息
+	// 认证相关
+	AUTH_OK_MSG_ID uint32 = 0xFFFFFF02 // 认证成功的回复
+	// 会话恢复相关
+	RESUME_TOKEN_MSG_ID uint32 = 0xFFFFFF03 // 连接建立时下发的会话恢复token
+	RESUME_MSG_ID       uint32 = 0xFFFFFF04 // 客户端重连后请求恢复会话
+	RESUME_OK_MSG_ID    uint32 = 0xFFFFFF05 // 会话恢复成功的回复
+	// 可靠投递相关
+	RELIABLE_ACK_MSG_ID uint32 = 0xFFFFFF06 // 确认收到可靠消息，消息体为一个或多个uint64序号
+	// 网关相关
+	GATEWAY_FORWARD_MSG_ID uint32 = 0xFFFFFF07 // 网关和后端之间转发的消息，消息体携带客户端的连接ID
+	GATEWAY_CLOSE_MSG_ID   uint32 = 0xFFFFFF08 // 网关通知后端客户端连接已经断开
+	// 集群相关
+	CLUSTER_FORWARD_MSG_ID uint32 = 0xFFFFFF09 // 节点之间转发发给用户的消息，消息体携带用户ID
+)
@@ -0,0 +1,293 @@
+package zcluster
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+	"github.com/Xaytick/zinx/ztest"
+)
+
+/*
+	集群用户路由的测试
+*/
+
+func TestDirectory(t *testing.T) {
+	fileDir, err := NewFileDirectory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "directory.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewDirectoryServer(listener, nil)
+	defer server.Close()
+
+	directories := map[string]ziface.IUserDirectory{
+		"memory": NewMemoryDirectory(),
+		"file":   fileDir,
+		"socket": NewSocketDirectory("unix", listener.Addr().String()),
+	}
+	for name, directory := range directories {
+		t.Run(name, func(t *testing.T) {
+			lookup := func(want string) {
+				t.Helper()
+				node, err := directory.Lookup(1)
+				if err != nil || node != want {
+					t.Fatalf("lookup = %q, %v, want %q", node, err, want)
+				}
+			}
+			lookup("")
+			if err := directory.Register(1, "node-a"); err != nil {
+				t.Fatal(err)
+			}
+			lookup("node-a")
+
+			// 用户登记到新的节点之后，旧节点的取消登记不生效
+			if err := directory.Register(1, "node-b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := directory.Unregister(1, "node-a"); err != nil {
+				t.Fatal(err)
+			}
+			lookup("node-b")
+			if err := directory.Unregister(1, "node-b"); err != nil {
+				t.Fatal(err)
+			}
+			lookup("")
+		})
+	}
+}
+
+// 消息内容的第一个字节为用户ID
+type loginRouter struct {
+	znet.BaseRouter
+}
+
+func (r *loginRouter) Handle(request ziface.IRequest) {
+	request.GetConnection().SetAuthenticated(&ziface.AuthInfo{UserID: uint(request.GetData()[0])})
+	request.GetConnection().SendMsg(request.GetMsgID(), nil)
+}
+
+func startNode(t *testing.T, directory ziface.IUserDirectory) (*ztest.Server, *Node) {
+	front := ztest.NewServer()
+	front.AddRouter(10, &loginRouter{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode(front.Server, directory)
+	node.Start(listener)
+	return front, node
+}
+
+func login(t *testing.T, front *ztest.Server, userID byte) *ztest.Client {
+	client, err := front.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send(10, []byte{userID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Expect(10, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestSendToUser(t *testing.T) {
+	directory := NewMemoryDirectory()
+	frontA, nodeA := startNode(t, directory)
+	defer frontA.Close()
+	defer nodeA.Stop()
+	frontB, nodeB := startNode(t, directory)
+	defer frontB.Close()
+	defer nodeB.Stop()
+
+	clientA := login(t, frontA, 1)
+	defer clientA.Close()
+	clientB := login(t, frontB, 2)
+	if node, _ := directory.Lookup(2); node != nodeB.Addr {
+		t.Fatalf("user 2 registered on %q, want %q", node, nodeB.Addr)
+	}
+
+	// 本节点的用户直接发送，其他节点的用户经节点之间的连接转发
+	for _, tc := range []struct {
+		userID uint
+		client *ztest.Client
+	}{{1, clientA}, {2, clientB}} {
+		if err := nodeA.SendToUser(tc.userID, 100, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := tc.client.Expect(100, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.GetData()) != "hello" {
+			t.Fatalf("user %d received %q", tc.userID, msg.GetData())
+		}
+	}
+
+	// 用户断开之后取消登记
+	clientB.Close()
+	deadline := time.Now().Add(time.Second)
+	for node, _ := directory.Lookup(2); node != ""; node, _ = directory.Lookup(2) {
+		if time.Now().After(deadline) {
+			t.Fatal("user 2 still registered after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := nodeA.SendToUser(2, 100, []byte("hello")); err == nil {
+		t.Fatal("send to offline user should fail")
+	}
+
+	// 节点停止时取消本节点所有用户的登记
+	nodeA.Stop()
+	if node, _ := directory.Lookup(1); node != "" {
+		t.Fatalf("user 1 still registered on %q after node stopped", node)
+	}
+}
+
+// 超过有效期没有重新登记的用户查询不到
+func TestDirectoryExpiry(t *testing.T) {
+	fileDir, err := NewFileDirectory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryDir := NewMemoryDirectory()
+	fileDir.TTL, memoryDir.TTL = 100*time.Millisecond, 100*time.Millisecond
+
+	for name, directory := range map[string]ziface.IUserDirectory{"memory": memoryDir, "file": fileDir} {
+		t.Run(name, func(t *testing.T) {
+			if err := directory.Register(1, "node-a"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(60 * time.Millisecond)
+			// 重新登记延长有效期
+			directory.Register(1, "node-a")
+			time.Sleep(60 * time.Millisecond)
+			if node, _ := directory.Lookup(1); node != "node-a" {
+				t.Fatalf("refreshed lookup = %q", node)
+			}
+			time.Sleep(150 * time.Millisecond)
+			if node, _ := directory.Lookup(1); node != "" {
+				t.Fatalf("expired lookup = %q", node)
+			}
+		})
+	}
+}
+
+// 节点定期重新登记本节点的用户，不覆盖业务设置的Hook函数
+func TestNodeRefreshAndHooks(t *testing.T) {
+	directory := NewMemoryDirectory()
+	directory.TTL = 100 * time.Millisecond
+	front := ztest.NewServer()
+	defer front.Close()
+	front.AddRouter(10, &loginRouter{})
+	bound := make(chan uint, 2)
+	front.GetConnManager().SetOnUserBind(func(userID uint) { bound <- userID })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode(front.Server, directory)
+	node.RefreshInterval = 20 * time.Millisecond
+	node.Start(listener)
+	defer node.Stop()
+
+	client := login(t, front, 1)
+	defer client.Close()
+	if userID := <-bound; userID != 1 {
+		t.Fatalf("hook received UserID = %d", userID)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if addr, _ := directory.Lookup(1); addr != node.Addr {
+		t.Fatalf("user 1 registered on %q after refresh, want %q", addr, node.Addr)
+	}
+
+	// 节点停止之后业务的Hook函数仍然生效
+	node.Stop()
+	client2 := login(t, front, 2)
+	defer client2.Close()
+	if userID := <-bound; userID != 2 {
+		t.Fatalf("hook received UserID = %d after node stopped", userID)
+	}
+}
+
+// 旧连接的解除绑定晚于用户重新登录时，用户保留在本节点，目录中的登记被覆盖之后由refreshLoop恢复
+func TestUnregisterAfterRelogin(t *testing.T) {
+	directory := NewMemoryDirectory()
+	front := ztest.NewServer()
+	defer front.Close()
+	front.AddRouter(10, &loginRouter{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode(front.Server, directory)
+	node.RefreshInterval = 20 * time.Millisecond
+	node.Start(listener)
+	defer node.Stop()
+
+	client := login(t, front, 1)
+	defer client.Close()
+	node.unregister(1)
+	node.usersLock.Lock()
+	kept := node.users[1]
+	node.usersLock.Unlock()
+	if !kept {
+		t.Fatal("user removed from node while still bound")
+	}
+
+	directory.Unregister(1, node.Addr)
+	for i := 0; i < 50; i++ {
+		if addr, _ := directory.Lookup(1); addr == node.Addr {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("user not registered again by refresh")
+}
+
+// 对端节点不读取数据时，写入超时返回错误，不会一直阻塞发送者
+func TestPeerWriteTimeout(t *testing.T) {
+	directory := NewMemoryDirectory()
+	front := ztest.NewServer()
+	defer front.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode(front.Server, directory)
+	node.WriteTimeout = 50 * time.Millisecond
+	var peers []net.Conn
+	node.Dialer = func(addr string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		peers = append(peers, server)
+		return client, nil
+	}
+	node.Start(listener)
+	defer node.Stop()
+	defer func() {
+		for _, conn := range peers {
+			conn.Close()
+		}
+	}()
+
+	directory.Register(1, "stalled")
+	done := make(chan error, 1)
+	go func() { done <- node.SendToUser(1, 100, []byte("hello")) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("send to stalled node should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send to stalled node blocked")
+	}
+}
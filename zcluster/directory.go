@@ -0,0 +1,158 @@
+package zcluster
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	用户目录的简单实现
+	MemoryDirectory用于同一个进程内的多个节点，FileDirectory通过共享的目录在同一台机器的多个进程之间使用。
+	它们主要用于测试和单机部署，生产环境可以基于Redis、etcd等实现ziface.IUserDirectory。
+	登记在TTL之后过期，节点定期重新登记延长有效期，崩溃的节点上的用户不会一直留在目录中
+*/
+
+// 用户目录登记的默认有效期
+const DefaultLeaseTTL = 30 * time.Second
+
+// 内存中的用户目录
+type MemoryDirectory struct {
+	// 登记的有效期，为0时不过期
+	TTL   time.Duration
+	users map[uint]memoryEntry
+	lock  sync.RWMutex
+}
+
+// 一个用户的登记
+type memoryEntry struct {
+	node      string
+	updatedAt time.Time
+}
+
+// 创建内存中的用户目录
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{TTL: DefaultLeaseTTL, users: make(map[uint]memoryEntry)}
+}
+
+func (d *MemoryDirectory) Register(userID uint, node string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.users[userID] = memoryEntry{node: node, updatedAt: time.Now()}
+	return nil
+}
+
+func (d *MemoryDirectory) Unregister(userID uint, node string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.users[userID].node == node {
+		delete(d.users, userID)
+	}
+	return nil
+}
+
+func (d *MemoryDirectory) Lookup(userID uint) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	entry, ok := d.users[userID]
+	if ok && expired(entry.updatedAt, d.TTL) {
+		delete(d.users, userID)
+		return "", nil
+	}
+	return entry.node, nil
+}
+
+// 登记是否已经超过有效期
+func expired(updatedAt time.Time, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(updatedAt) > ttl
+}
+
+// 基于文件的用户目录，每个用户一个文件，文件名为用户ID，内容为所在的节点，
+// 文件的修改时间作为登记时间
+type FileDirectory struct {
+	Root string
+	// 登记的有效期，为0时不过期
+	TTL time.Duration
+}
+
+// 创建基于文件的用户目录，root不存在时自动创建
+func NewFileDirectory(root string) (*FileDirectory, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create directory root")
+	}
+	return &FileDirectory{Root: root, TTL: DefaultLeaseTTL}, nil
+}
+
+func (d *FileDirectory) path(userID uint) string {
+	return filepath.Join(d.Root, strconv.FormatUint(uint64(userID), 10))
+}
+
+// 先写入临时文件再重命名，其他进程不会读到写了一半的内容
+func (d *FileDirectory) Register(userID uint, node string) error {
+	tmp, err := os.CreateTemp(d.Root, ".register-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(node); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.path(userID)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// 读取和删除之间没有加锁，其他进程同时登记该用户时可能删除新的登记，只适合测试和单机部署
+func (d *FileDirectory) Unregister(userID uint, node string) error {
+	current, err := d.Lookup(userID)
+	if err != nil || current != node {
+		return err
+	}
+	if err := os.Remove(d.path(userID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 过期的登记文件不删除，由节点重新登记时覆盖
+func (d *FileDirectory) Lookup(userID uint) (string, error) {
+	f, err := os.Open(d.path(userID))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if expired(info.ModTime(), d.TTL) {
+		return "", nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+var (
+	_ ziface.IUserDirectory = (*MemoryDirectory)(nil)
+	_ ziface.IUserDirectory = (*FileDirectory)(nil)
+)
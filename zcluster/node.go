@@ -0,0 +1,385 @@
+package zcluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	集群节点
+	每个节点在服务客户端的Server之外，再启动一个内部的zinx Server接收其他节点转发的消息。
+	连接绑定userID时节点把用户登记到共享的用户目录，解除绑定时取消登记。
+	登记会在用户目录的有效期之后过期，节点定期为本节点的用户重新登记，崩溃的节点上的用户在过期后自动下线。
+	SendToUser先查找本节点的连接，不在本节点时通过用户目录找到所在的节点，经节点之间的连接转发。
+	内部Server的地址只应该允许集群内的节点访问
+*/
+
+// 转发消息头的长度: 用户ID uint64(8字节) + 消息ID uint32(4字节)
+const forwardHeadLen = 12
+
+type Node struct {
+	// 节点在用户目录中的标识，也是其他节点连接本节点使用的地址，为空时使用内部监听器的地址
+	Addr string
+	// 服务客户端的Server
+	server *znet.Server
+	// 接收其他节点转发消息的Server
+	internal *znet.Server
+	// 共享的用户目录
+	directory ziface.IUserDirectory
+	// 连接其他节点，默认使用TCP
+	Dialer func(addr string, timeout time.Duration) (net.Conn, error)
+	// 连接其他节点的超时时间
+	DialTimeout time.Duration
+	// 向其他节点写入一个消息的超时时间，超时时断开连接，避免卡住的节点阻塞所有发送
+	WriteTimeout time.Duration
+	// 为本节点的用户重新登记的间隔，需要小于用户目录的登记有效期
+	RefreshInterval time.Duration
+	// 移除用户绑定监听的函数
+	removeListener func()
+	// 节点停止时关闭，结束重新登记
+	done chan struct{}
+	wg   sync.WaitGroup
+	// 到其他节点的连接，节点地址 -> 连接
+	peers     map[string]*peer
+	peersLock sync.Mutex
+	// 本节点登记到用户目录的用户
+	users     map[uint]bool
+	usersLock sync.Mutex
+}
+
+// 为server创建集群节点，opts为节点之间连接的配置，所有节点需要使用相同的配置
+func NewNode(server *znet.Server, directory ziface.IUserDirectory, opts ...znet.Option) *Node {
+	n := &Node{
+		server:          server,
+		internal:        znet.NewServer(server.Name+"-cluster", opts...),
+		directory:       directory,
+		DialTimeout:     3 * time.Second,
+		WriteTimeout:    3 * time.Second,
+		RefreshInterval: DefaultLeaseTTL / 3,
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+		peers: make(map[string]*peer),
+		users: make(map[uint]bool),
+	}
+	n.internal.AddRouter(utils.CLUSTER_FORWARD_MSG_ID, &forwardRouter{node: n})
+	return n
+}
+
+// 在listener上接收其他节点的连接，并开始登记本节点的用户
+func (n *Node) Start(listener net.Listener) {
+	if n.Addr == "" {
+		n.Addr = listener.Addr().String()
+	}
+	n.internal.StartListener(listener)
+
+	connMgr := n.server.GetConnManager()
+	// 使用监听函数，不覆盖业务通过SetOnUserBind设置的Hook函数
+	n.removeListener = connMgr.AddUserListener(n.register, n.unregister)
+	// 登记启动之前已经绑定的用户
+	for _, conn := range connMgr.All() {
+		if value, err := conn.GetProperty("userID"); err == nil {
+			if userID, ok := value.(uint); ok && connMgr.GetConnByUserID(userID) == conn {
+				n.register(userID)
+			}
+		}
+	}
+	n.done = make(chan struct{})
+	n.wg.Add(1)
+	go n.refreshLoop()
+	fmt.Printf("[zinx] cluster node %s started\n", n.Addr)
+}
+
+// 取消本节点所有用户的登记，断开节点之间的连接
+func (n *Node) Stop() {
+	if n.removeListener == nil {
+		return
+	}
+	n.removeListener()
+	n.removeListener = nil
+	close(n.done)
+	n.wg.Wait()
+
+	n.usersLock.Lock()
+	users := n.users
+	n.users = make(map[uint]bool)
+	n.usersLock.Unlock()
+	for userID := range users {
+		if err := n.directory.Unregister(userID, n.Addr); err != nil {
+			fmt.Printf("[zinx] cluster unregister UserID = %d err: %v\n", userID, err)
+		}
+	}
+
+	n.peersLock.Lock()
+	for addr, p := range n.peers {
+		p.close()
+		delete(n.peers, addr)
+	}
+	n.peersLock.Unlock()
+	n.internal.Stop()
+}
+
+// 定期为本节点的所有用户重新登记，延长登记的有效期
+func (n *Node) refreshLoop() {
+	defer n.wg.Done()
+	if n.RefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(n.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+		n.usersLock.Lock()
+		users := make([]uint, 0, len(n.users))
+		for userID := range n.users {
+			users = append(users, userID)
+		}
+		n.usersLock.Unlock()
+		for _, userID := range users {
+			if err := n.directory.Register(userID, n.Addr); err != nil {
+				fmt.Printf("[zinx] cluster refresh UserID = %d err: %v\n", userID, err)
+			}
+		}
+	}
+}
+
+// 用户绑定到本节点的连接
+func (n *Node) register(userID uint) {
+	n.usersLock.Lock()
+	n.users[userID] = true
+	n.usersLock.Unlock()
+	if err := n.directory.Register(userID, n.Addr); err != nil {
+		fmt.Printf("[zinx] cluster register UserID = %d err: %v\n", userID, err)
+	}
+}
+
+// 用户和本节点的连接解除绑定
+// 持有usersLock检查用户是否已经在本节点重新登录并删除，重新登录的register在之后执行时用户保留在users中，
+// 即使目录中的登记被这里的Unregister覆盖，refreshLoop也会重新登记
+func (n *Node) unregister(userID uint) {
+	n.usersLock.Lock()
+	if n.server.GetConnManager().GetConnByUserID(userID) != nil {
+		n.usersLock.Unlock()
+		return
+	}
+	delete(n.users, userID)
+	n.usersLock.Unlock()
+	if err := n.directory.Unregister(userID, n.Addr); err != nil {
+		fmt.Printf("[zinx] cluster unregister UserID = %d err: %v\n", userID, err)
+	}
+}
+
+// 向用户发送消息，用户在其他节点时转发给该节点
+// 转发成功只表示消息交给了用户所在的节点，该节点上用户已经断开时消息会被丢弃
+func (n *Node) SendToUser(userID uint, msgID uint32, data []byte) error {
+	if conn := n.server.GetConnManager().GetConnByUserID(userID); conn != nil {
+		return conn.SendMsg(msgID, data)
+	}
+	node, err := n.directory.Lookup(userID)
+	if err != nil {
+		return errors.Wrap(err, "lookup user")
+	}
+	if node == "" || node == n.Addr {
+		return fmt.Errorf("user %d is not online", userID)
+	}
+	return n.getPeer(node).send(znet.NewMsgPackage(utils.CLUSTER_FORWARD_MSG_ID, encodeForward(userID, msgID, data)))
+}
+
+// 获取到其他节点的连接
+func (n *Node) getPeer(addr string) *peer {
+	n.peersLock.Lock()
+	defer n.peersLock.Unlock()
+	p, ok := n.peers[addr]
+	if !ok {
+		p = &peer{addr: addr, node: n}
+		n.peers[addr] = p
+	}
+	return p
+}
+
+func encodeForward(userID uint, msgID uint32, data []byte) []byte {
+	buf := make([]byte, forwardHeadLen, forwardHeadLen+len(data))
+	binary.LittleEndian.PutUint64(buf[0:], uint64(userID))
+	binary.LittleEndian.PutUint32(buf[8:], msgID)
+	return append(buf, data...)
+}
+
+func decodeForward(data []byte) (uint, uint32, []byte, error) {
+	if len(data) < forwardHeadLen {
+		return 0, 0, nil, errors.New("cluster forward too short")
+	}
+	return uint(binary.LittleEndian.Uint64(data[0:])), binary.LittleEndian.Uint32(data[8:]), data[forwardHeadLen:], nil
+}
+
+// 处理其他节点转发来的消息
+type forwardRouter struct {
+	znet.BaseRouter
+	node *Node
+}
+
+func (r *forwardRouter) Handle(request ziface.IRequest) {
+	userID, msgID, data, err := decodeForward(request.GetData())
+	if err != nil {
+		request.GetConnection().AddProtocolViolation(1)
+		return
+	}
+	conn := r.node.server.GetConnManager().GetConnByUserID(userID)
+	if conn == nil {
+		fmt.Printf("[zinx] cluster drop msgID = %d, UserID = %d is not on this node\n", msgID, userID)
+		return
+	}
+	conn.SendMsg(msgID, data)
+}
+
+// 到其他节点的连接，第一次发送时建立，断开后下一次发送时重新建立
+type peer struct {
+	addr string
+	node *Node
+	// 当前的连接，没有连接时为nil
+	conn net.Conn
+	// 当前连接的封包拆包工具，按照协议握手协商的结果创建
+	dp ziface.IDataPack
+	// 节点已经停止，不再建立连接
+	closed bool
+	// 保护conn、dp、closed和写入的锁，建立连接时不持有
+	lock sync.Mutex
+	// 保证同一时间只有一个发送者建立连接
+	dialLock sync.Mutex
+	// 发送大消息时分配分片ID的计数
+	fragID uint32
+}
+
+// 向节点发送一个消息，连接已经断开时重新连接后再发送一次
+func (p *peer) send(msg ziface.IMessage) error {
+	fragID := atomic.AddUint32(&p.fragID, 1)
+	for retry := 0; ; retry++ {
+		conn, dp, err := p.getConn()
+		if err != nil {
+			return errors.Wrapf(err, "connect node %s", p.addr)
+		}
+		// 重新连接之后协商的封包设置可能变化，每次按当前连接封包
+		frames, err := dp.PackFragments(msg, fragID)
+		if err != nil {
+			return err
+		}
+		if err = p.write(conn, frames); err == nil || retry > 0 {
+			return err
+		}
+	}
+}
+
+// 获取当前的连接，没有连接时建立连接
+func (p *peer) getConn() (net.Conn, ziface.IDataPack, error) {
+	p.lock.Lock()
+	conn, dp, closed := p.conn, p.dp, p.closed
+	p.lock.Unlock()
+	if closed {
+		return nil, nil, errors.New("node stopped")
+	}
+	if conn != nil {
+		return conn, dp, nil
+	}
+
+	p.dialLock.Lock()
+	defer p.dialLock.Unlock()
+	// 等待期间其他发送者已经建立了连接
+	p.lock.Lock()
+	conn, dp = p.conn, p.dp
+	p.lock.Unlock()
+	if conn != nil {
+		return conn, dp, nil
+	}
+	return p.connect()
+}
+
+// 写入所有帧，失败或者超时时关闭连接
+func (p *peer) write(conn net.Conn, frames [][]byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// 连接已经断开
+	if p.conn != conn {
+		return errors.New("connection closed")
+	}
+	if p.node.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(p.node.WriteTimeout))
+	}
+	for _, frame := range frames {
+		if _, err := conn.Write(frame); err != nil {
+			conn.Close()
+			p.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// 建立连接并完成握手，调用时需要持有dialLock
+func (p *peer) connect() (net.Conn, ziface.IDataPack, error) {
+	raw, err := p.node.Dialer(p.addr, p.node.DialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw.SetDeadline(time.Now().Add(p.node.DialTimeout))
+	conn, info, err := znet.ClientHandshake(raw, p.node.internal.Config)
+	if err != nil {
+		raw.Close()
+		return nil, nil, errors.Wrap(err, "handshake")
+	}
+	raw.SetDeadline(time.Time{})
+	dp := znet.NewDataPackWithProtocol(p.node.internal.Config, info)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// 连接期间节点已经停止
+	if p.closed {
+		conn.Close()
+		return nil, nil, errors.New("node stopped")
+	}
+	p.conn, p.dp = conn, dp
+	go p.readLoop(conn, dp)
+	return conn, dp, nil
+}
+
+// 回复对端的心跳，连接断开时清理
+func (p *peer) readLoop(conn net.Conn, dp ziface.IDataPack) {
+	for {
+		msg, err := znet.ReadMsg(conn, dp)
+		if err != nil {
+			break
+		}
+		if msg.GetMsgId() == utils.PING_MSG_ID {
+			p.send(znet.NewMsgPackage(utils.PONG_MSG_ID, msg.GetData()))
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	conn.Close()
+}
+
+// 关闭当前的连接，之后不再建立连接
+func (p *peer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,179 @@
+package zcluster
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	通过Unix socket共享的用户目录
+	DirectoryServer把一个用户目录通过监听器提供给其他进程，SocketDirectory连接它进行查询和登记。
+	使用按行的文本协议，SocketDirectory的每个请求使用一个连接:
+		REG <userID> <node>    登记用户
+		UNREG <userID> <node>  取消登记
+		GET <userID>           查询用户
+	成功时回复 "OK" 或者 "OK <node>"，失败时回复 "ERR <原因>"
+*/
+
+// 通过监听器提供用户目录的服务
+type DirectoryServer struct {
+	directory ziface.IUserDirectory
+	listener  net.Listener
+	wg        sync.WaitGroup
+}
+
+// 在listener上提供directory的服务，directory为nil时使用内存中的用户目录
+func NewDirectoryServer(listener net.Listener, directory ziface.IUserDirectory) *DirectoryServer {
+	if directory == nil {
+		directory = NewMemoryDirectory()
+	}
+	s := &DirectoryServer{directory: directory, listener: listener}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s
+}
+
+// 获取服务的地址
+func (s *DirectoryServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// 停止服务
+func (s *DirectoryServer) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *DirectoryServer) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// 处理一个连接上的请求
+func (s *DirectoryServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		reply, err := s.handle(strings.Fields(line))
+		if err != nil {
+			reply = "ERR " + err.Error()
+		}
+		if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (s *DirectoryServer) handle(fields []string) (string, error) {
+	if len(fields) < 2 {
+		return "", errors.New("malformed request")
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed userID")
+	}
+	switch {
+	case fields[0] == "REG" && len(fields) == 3:
+		return "OK", s.directory.Register(uint(userID), fields[2])
+	case fields[0] == "UNREG" && len(fields) == 3:
+		return "OK", s.directory.Unregister(uint(userID), fields[2])
+	case fields[0] == "GET" && len(fields) == 2:
+		node, err := s.directory.Lookup(uint(userID))
+		if node == "" {
+			return "OK", err
+		}
+		return "OK " + node, err
+	}
+	return "", fmt.Errorf("unknown request %s", fields[0])
+}
+
+// 连接DirectoryServer的用户目录，登记的有效期由DirectoryServer使用的用户目录决定
+type SocketDirectory struct {
+	Network string
+	Addr    string
+	// 每个请求的超时时间
+	Timeout time.Duration
+}
+
+// 创建连接DirectoryServer的用户目录，network通常为"unix"
+func NewSocketDirectory(network, addr string) *SocketDirectory {
+	return &SocketDirectory{Network: network, Addr: addr, Timeout: 3 * time.Second}
+}
+
+// 发送一个请求并读取回复
+func (d *SocketDirectory) call(request string) (string, error) {
+	conn, err := net.DialTimeout(d.Network, d.Addr, d.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	if _, err := conn.Write([]byte(request + "\n")); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if reason, ok := strings.CutPrefix(line, "ERR "); ok {
+		return "", errors.New(reason)
+	}
+	if line != "OK" && !strings.HasPrefix(line, "OK ") {
+		return "", fmt.Errorf("malformed directory reply %q", line)
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(line, "OK"), " "), nil
+}
+
+// 节点标识不能包含空白字符
+func checkNode(node string) error {
+	if node == "" || strings.ContainsAny(node, " \t\r\n") {
+		return fmt.Errorf("invalid node %q", node)
+	}
+	return nil
+}
+
+func (d *SocketDirectory) Register(userID uint, node string) error {
+	if err := checkNode(node); err != nil {
+		return err
+	}
+	_, err := d.call(fmt.Sprintf("REG %d %s", userID, node))
+	return err
+}
+
+func (d *SocketDirectory) Unregister(userID uint, node string) error {
+	if err := checkNode(node); err != nil {
+		return err
+	}
+	_, err := d.call(fmt.Sprintf("UNREG %d %s", userID, node))
+	return err
+}
+
+func (d *SocketDirectory) Lookup(userID uint) (string, error) {
+	return d.call(fmt.Sprintf("GET %d", userID))
+}
+
+var _ ziface.IUserDirectory = (*SocketDirectory)(nil)
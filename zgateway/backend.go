@@ -0,0 +1,420 @@
+package zgateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	后端对网关转发的支持
+	后端在业务Server之外启动一个内部的zinx Server接收网关的连接，转发消息只在这个内部Server上处理，
+	客户端直接连接业务Server时发送的转发消息不会被处理，无法冒充其他用户。
+	内部Server的监听地址只应该允许网关访问。
+	后端为网关上的每个客户端连接创建一个虚拟连接，转发来的消息使用虚拟连接交给业务Server的路由处理，
+	路由通过虚拟连接发送的消息经网关连接转发回客户端，所以后端的路由不需要任何修改
+*/
+
+type Backend struct {
+	// 业务Server，转发来的消息交给它的MsgHandler处理
+	server *znet.Server
+	// 接收网关连接的Server
+	internal *znet.Server
+	// 网关连接ID -> 客户端连接ID -> 虚拟连接
+	conns map[uint32]map[uint32]*VirtualConn
+	// 保护conns的锁
+	lock sync.Mutex
+}
+
+// 为业务server创建网关转发的后端，opts为网关连接的配置，需要和网关的UpstreamPool使用相同的配置
+func NewBackend(server *znet.Server, opts ...znet.Option) *Backend {
+	b := &Backend{
+		server:   server,
+		internal: znet.NewServer(server.Name+"-gateway", opts...),
+		conns:    make(map[uint32]map[uint32]*VirtualConn),
+	}
+	b.internal.AddRouter(utils.GATEWAY_FORWARD_MSG_ID, &backendForwardRouter{backend: b})
+	b.internal.AddRouter(utils.GATEWAY_CLOSE_MSG_ID, &backendCloseRouter{backend: b})
+	return b
+}
+
+// 在listener上接收网关的连接
+func (b *Backend) Start(listener net.Listener) {
+	b.internal.StartListener(listener)
+}
+
+// 断开所有网关连接，释放所有虚拟连接
+func (b *Backend) Stop() {
+	b.internal.Stop()
+}
+
+// 获取网关上的客户端对应的虚拟连接，不存在时创建
+func (b *Backend) getConn(link ziface.IConnection, connID uint32) *VirtualConn {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	conns, ok := b.conns[link.GetConnID()]
+	if !ok {
+		conns = make(map[uint32]*VirtualConn)
+		b.conns[link.GetConnID()] = conns
+		// 网关连接断开时释放它的所有虚拟连接
+		go func() {
+			<-link.Context().Done()
+			b.lock.Lock()
+			conns := b.conns[link.GetConnID()]
+			delete(b.conns, link.GetConnID())
+			b.lock.Unlock()
+			for _, conn := range conns {
+				conn.stop()
+			}
+		}()
+	}
+	conn, ok := conns[connID]
+	if !ok {
+		conn = newVirtualConn(link, connID)
+		conns[connID] = conn
+	}
+	return conn
+}
+
+// 客户端在网关上断开
+func (b *Backend) closeConn(link ziface.IConnection, connID uint32) {
+	b.lock.Lock()
+	conn, ok := b.conns[link.GetConnID()][connID]
+	if ok {
+		delete(b.conns[link.GetConnID()], connID)
+	}
+	b.lock.Unlock()
+	if ok {
+		conn.stop()
+	}
+}
+
+// 当前的虚拟连接数量
+func (b *Backend) ConnCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	count := 0
+	for _, conns := range b.conns {
+		count += len(conns)
+	}
+	return count
+}
+
+// 处理网关转发来的消息
+type backendForwardRouter struct {
+	znet.BaseRouter
+	backend *Backend
+}
+
+func (r *backendForwardRouter) Handle(request ziface.IRequest) {
+	env, err := DecodeEnvelope(request.GetData())
+	if err != nil {
+		fmt.Println("[zinx] backend decode envelope err:", err)
+		request.GetConnection().AddProtocolViolation(1)
+		return
+	}
+	conn := r.backend.getConn(request.GetConnection(), env.ConnID)
+	// 客户端在网关上完成了认证
+	if env.UserID != 0 && !conn.IsAuthenticated() {
+		conn.SetAuthenticated(&ziface.AuthInfo{UserID: env.UserID, Roles: env.Roles})
+	}
+	conn.UpdateActivity()
+
+	req := znet.NewRequest(conn, znet.NewMsgPackage(env.MsgID, env.Data))
+	if trace := request.GetTrace(); trace.IsValid() {
+		req.SetContext(znet.ContextWithTrace(conn.Context(), trace))
+	}
+	// 已经在worker中，直接处理，保持同一个网关连接上消息的处理方式
+	r.backend.server.MsgHandler.DoMsgHandler(req)
+}
+
+// 处理网关发来的客户端断开通知
+type backendCloseRouter struct {
+	znet.BaseRouter
+	backend *Backend
+}
+
+func (r *backendCloseRouter) Handle(request ziface.IRequest) {
+	connID, err := decodeClose(request.GetData())
+	if err != nil {
+		request.GetConnection().AddProtocolViolation(1)
+		return
+	}
+	r.backend.closeConn(request.GetConnection(), connID)
+}
+
+// 网关上的一个客户端在后端的虚拟连接
+type VirtualConn struct {
+	// 客户端在网关上的连接ID
+	ConnID uint32
+	// 转发消息的网关连接
+	link ziface.IConnection
+	// 连接属性
+	property map[string]interface{}
+	// 认证信息，没有认证时为nil
+	authInfo *ziface.AuthInfo
+	// 最后活动时间
+	lastActivityTime time.Time
+	// 协议违规分数
+	violations int
+	// 虚拟连接上的定时器，连接停止时全部取消
+	timers map[*virtualTimer]struct{}
+	// 保护以上字段的锁
+	lock sync.Mutex
+	// 连接的上下文，客户端断开或者网关连接断开时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newVirtualConn(link ziface.IConnection, connID uint32) *VirtualConn {
+	c := &VirtualConn{
+		ConnID:           connID,
+		link:             link,
+		property:         make(map[string]interface{}),
+		lastActivityTime: time.Now(),
+		timers:           make(map[*virtualTimer]struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(link.Context())
+	return c
+}
+
+// 获取转发消息的网关连接
+func (c *VirtualConn) GetLink() ziface.IConnection {
+	return c.link
+}
+
+// 客户端断开时释放虚拟连接
+func (c *VirtualConn) stop() {
+	c.cancel()
+	c.lock.Lock()
+	timers := c.timers
+	c.timers = nil
+	c.lock.Unlock()
+	for timer := range timers {
+		timer.ITimer.Stop()
+	}
+}
+
+func (c *VirtualConn) Start() {}
+
+// 虚拟连接不能直接关闭网关上的客户端连接，只释放后端的状态
+func (c *VirtualConn) Stop() {
+	c.stop()
+}
+
+// 会话由网关上的客户端连接持有，和Stop相同
+func (c *VirtualConn) StopAndDiscardSession() {
+	c.stop()
+}
+
+func (c *VirtualConn) GetTCPConnection() *net.TCPConn {
+	return nil
+}
+
+func (c *VirtualConn) GetConnID() uint32 {
+	return c.ConnID
+}
+
+func (c *VirtualConn) RemoteAddr() net.Addr {
+	return virtualAddr{link: c.link.RemoteAddr(), connID: c.ConnID}
+}
+
+func (c *VirtualConn) Send(data []byte) error {
+	return errors.New("raw send is not supported on gateway virtual connection")
+}
+
+// 将发给客户端的消息封装后通过网关连接发送
+func (c *VirtualConn) envelope(msgId uint32, data []byte) ([]byte, error) {
+	if c.ctx.Err() != nil {
+		return nil, fmt.Errorf("virtual connection %d stopped", c.ConnID)
+	}
+	return EncodeEnvelope(&Envelope{ConnID: c.ConnID, MsgID: msgId, Data: data})
+}
+
+func (c *VirtualConn) SendMsg(msgId uint32, data []byte) error {
+	env, err := c.envelope(msgId, data)
+	if err != nil {
+		return err
+	}
+	return c.link.SendMsg(utils.GATEWAY_FORWARD_MSG_ID, env)
+}
+
+func (c *VirtualConn) SendMsgContext(ctx context.Context, msgId uint32, data []byte) error {
+	env, err := c.envelope(msgId, data)
+	if err != nil {
+		return err
+	}
+	return c.link.SendMsgContext(ctx, utils.GATEWAY_FORWARD_MSG_ID, env)
+}
+
+func (c *VirtualConn) SendMsgWithPriority(priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	env, err := c.envelope(msgId, data)
+	if err != nil {
+		return err
+	}
+	return c.link.SendMsgWithPriority(priority, utils.GATEWAY_FORWARD_MSG_ID, env)
+}
+
+func (c *VirtualConn) TrySendMsg(priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	env, err := c.envelope(msgId, data)
+	if err != nil {
+		return err
+	}
+	return c.link.TrySendMsg(priority, utils.GATEWAY_FORWARD_MSG_ID, env)
+}
+
+func (c *VirtualConn) TrySendMsgContext(ctx context.Context, priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	env, err := c.envelope(msgId, data)
+	if err != nil {
+		return err
+	}
+	return c.link.TrySendMsgContext(ctx, priority, utils.GATEWAY_FORWARD_MSG_ID, env)
+}
+
+func (c *VirtualConn) SetProperty(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.property[key] = value
+}
+
+func (c *VirtualConn) GetProperty(key string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if value, ok := c.property[key]; ok {
+		return value, nil
+	}
+	return nil, errors.New("no property found")
+}
+
+func (c *VirtualConn) RemoveProperty(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.property, key)
+}
+
+func (c *VirtualConn) GetProperties() map[string]interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	properties := make(map[string]interface{}, len(c.property))
+	for key, value := range c.property {
+		properties[key] = value
+	}
+	return properties
+}
+
+func (c *VirtualConn) UpdateActivity() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastActivityTime = time.Now()
+}
+
+func (c *VirtualConn) GetLastActivityTime() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastActivityTime
+}
+
+// 心跳由网关和客户端之间完成，返回网关连接的RTT统计
+func (c *VirtualConn) GetRTTStats() ziface.RTTStats {
+	return c.link.GetRTTStats()
+}
+
+// 虚拟连接上的定时器，触发或者取消之后从虚拟连接的定时器集合中移除
+type virtualTimer struct {
+	ziface.ITimer
+	conn *VirtualConn
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.conn.untrackTimer(t)
+	return t.ITimer.Stop()
+}
+
+func (c *VirtualConn) AfterFunc(d time.Duration, f func()) ziface.ITimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := &virtualTimer{conn: c}
+	timer.ITimer = c.link.AfterFunc(d, func() {
+		c.untrackTimer(timer)
+		f()
+	})
+	c.trackTimer(timer)
+	return timer
+}
+
+func (c *VirtualConn) Every(d time.Duration, f func()) ziface.ITimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := &virtualTimer{ITimer: c.link.Every(d, f), conn: c}
+	c.trackTimer(timer)
+	return timer
+}
+
+// 记录定时器，连接已经停止时直接取消，调用时需要持有lock
+func (c *VirtualConn) trackTimer(timer *virtualTimer) {
+	if c.timers == nil {
+		timer.ITimer.Stop()
+		return
+	}
+	c.timers[timer] = struct{}{}
+}
+
+// 移除已经触发或者取消的定时器
+func (c *VirtualConn) untrackTimer(timer *virtualTimer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.timers, timer)
+}
+
+func (c *VirtualConn) IsAuthenticated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.authInfo != nil
+}
+
+func (c *VirtualConn) SetAuthenticated(info *ziface.AuthInfo) {
+	c.SetProperty("userID", info.UserID)
+	c.SetProperty(znet.RolesProperty, info.Roles)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.authInfo = info
+}
+
+func (c *VirtualConn) GetProtocolInfo() ziface.ProtocolInfo {
+	return c.link.GetProtocolInfo()
+}
+
+func (c *VirtualConn) AddProtocolViolation(points int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.violations += points
+	return c.violations
+}
+
+func (c *VirtualConn) Context() context.Context {
+	return c.ctx
+}
+
+// 虚拟连接的地址，由网关连接的地址和客户端连接ID组成
+type virtualAddr struct {
+	link   net.Addr
+	connID uint32
+}
+
+func (a virtualAddr) Network() string {
+	return "zinx-gateway"
+}
+
+func (a virtualAddr) String() string {
+	return fmt.Sprintf("%s#%d", a.link.String(), a.connID)
+}
+
+var _ ziface.IConnection = (*VirtualConn)(nil)
@@ -0,0 +1,78 @@
+package zgateway
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	网关和后端之间的转发格式
+	一个网关到后端的连接上复用多个客户端连接的消息，GATEWAY_FORWARD_MSG_ID的消息体为:
+		客户端连接ID uint32(4字节) + 消息ID uint32(4字节) + 用户ID uint64(8字节) +
+		角色长度 uint16(2字节) + 角色(逗号分隔) + 消息内容
+	用户ID为0表示客户端在网关上还没有完成认证，后端回复时用户ID固定为0、不带角色。
+	GATEWAY_CLOSE_MSG_ID的消息体为客户端连接ID uint32(4字节)
+*/
+
+// 转发消息头的长度
+const envelopeHeadLen = 18
+
+// 一个转发的消息
+type Envelope struct {
+	ConnID uint32   // 客户端在网关上的连接ID
+	MsgID  uint32   // 客户端消息的ID
+	UserID uint     // 客户端在网关上认证的用户ID，0表示没有认证
+	Roles  []string // 客户端在网关上认证的角色，角色名不能包含逗号
+	Data   []byte   // 客户端消息的内容
+}
+
+// 编码转发消息
+func EncodeEnvelope(env *Envelope) ([]byte, error) {
+	roles := strings.Join(env.Roles, ",")
+	if len(roles) > 0xFFFF {
+		return nil, errors.New("gateway envelope roles too long")
+	}
+	buf := make([]byte, envelopeHeadLen, envelopeHeadLen+len(roles)+len(env.Data))
+	binary.LittleEndian.PutUint32(buf[0:], env.ConnID)
+	binary.LittleEndian.PutUint32(buf[4:], env.MsgID)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(env.UserID))
+	binary.LittleEndian.PutUint16(buf[16:], uint16(len(roles)))
+	buf = append(buf, roles...)
+	return append(buf, env.Data...), nil
+}
+
+// 解码转发消息
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	if len(data) < envelopeHeadLen {
+		return nil, errors.New("gateway envelope too short")
+	}
+	rolesLen := int(binary.LittleEndian.Uint16(data[16:]))
+	if len(data) < envelopeHeadLen+rolesLen {
+		return nil, errors.New("gateway envelope roles truncated")
+	}
+	env := &Envelope{
+		ConnID: binary.LittleEndian.Uint32(data[0:]),
+		MsgID:  binary.LittleEndian.Uint32(data[4:]),
+		UserID: uint(binary.LittleEndian.Uint64(data[8:])),
+		Data:   data[envelopeHeadLen+rolesLen:],
+	}
+	if rolesLen > 0 {
+		env.Roles = strings.Split(string(data[envelopeHeadLen:envelopeHeadLen+rolesLen]), ",")
+	}
+	return env, nil
+}
+
+// 编码连接断开的通知
+func encodeClose(connID uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, connID)
+}
+
+// 解码连接断开的通知
+func decodeClose(data []byte) (uint32, error) {
+	if len(data) != 4 {
+		return 0, errors.New("malformed gateway close")
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
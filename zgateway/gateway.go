@@ -0,0 +1,174 @@
+package zgateway
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+/*
+	网关
+	网关本身是一个普通的zinx Server，持有客户端的连接。
+	通过Route把一段msgID转发到一个后端服务池，消息带上客户端的连接ID和用户ID发送给后端，
+	后端的回复按连接ID通过ConnManager找到客户端连接后发送。
+	后端需要通过NewBackend在单独的监听地址上接收网关的连接，该地址只应该允许网关访问
+*/
+
+type Gateway struct {
+	server *znet.Server
+	pools  []*UpstreamPool
+	// 每个客户端连接转发过的后端，客户端断开时通知这些后端
+	served map[uint32]map[*Upstream]bool
+	// 保护served的锁
+	lock sync.Mutex
+}
+
+// 在server上创建网关
+func NewGateway(server *znet.Server) *Gateway {
+	return &Gateway{
+		server: server,
+		served: make(map[uint32]map[*Upstream]bool),
+	}
+}
+
+// 将[start, end]范围内的msgID转发到后端服务池，需要在Start之前调用，区间无效或者已经注册时返回错误
+func (g *Gateway) Route(start, end uint32, pool *UpstreamPool) error {
+	if err := g.server.MsgHandler.AddRangeRouter(start, end, &forwardRouter{gateway: g, pool: pool}); err != nil {
+		return err
+	}
+	pool.handler = g.handleUpstreamMsg
+	g.pools = append(g.pools, pool)
+	return nil
+}
+
+// 开始连接所有后端
+func (g *Gateway) Start() {
+	for _, pool := range g.pools {
+		pool.Start()
+	}
+}
+
+// 断开所有后端的连接
+func (g *Gateway) Stop() {
+	for _, pool := range g.pools {
+		pool.Stop()
+	}
+}
+
+// 获取所有后端服务池的状态
+func (g *Gateway) Status() map[string][]UpstreamStatus {
+	status := make(map[string][]UpstreamStatus, len(g.pools))
+	for _, pool := range g.pools {
+		status[pool.Name] = pool.Status()
+	}
+	return status
+}
+
+// 将客户端的消息转发到后端，后端不可用时切换到其他后端
+func (g *Gateway) forward(request ziface.IRequest, pool *UpstreamPool) error {
+	conn := request.GetConnection()
+	env := &Envelope{ConnID: conn.GetConnID(), MsgID: request.GetMsgID(), Data: request.GetData()}
+	// 客户端在网关上的认证信息随消息转发，后端按照它进行认证和权限检查
+	if conn.IsAuthenticated() {
+		if userID, err := conn.GetProperty("userID"); err == nil {
+			env.UserID, _ = userID.(uint)
+		}
+		if roles, err := conn.GetProperty(znet.RolesProperty); err == nil {
+			env.Roles, _ = roles.([]string)
+		}
+	}
+	data, err := EncodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	msg := znet.NewMsgPackage(utils.GATEWAY_FORWARD_MSG_ID, data)
+	// 链路追踪上下文随转发消息传递给后端
+	msg.SetTrace(request.GetTrace())
+
+	// 依次尝试所有可用的后端，直到转发成功
+	var failed []*Upstream
+	for {
+		u := pool.Pick(env.ConnID, failed...)
+		if u == nil {
+			return fmt.Errorf("no healthy upstream in pool %s", pool.Name)
+		}
+		if err := u.send(msg); err != nil {
+			fmt.Printf("[zinx] gateway forward to %s err: %v, failover\n", u.Addr, err)
+			failed = append(failed, u)
+			continue
+		}
+		u.forwarded.Add(1)
+		g.track(conn, u)
+		return nil
+	}
+}
+
+// 记录客户端连接使用过的后端，客户端断开时通知后端释放对应的连接
+func (g *Gateway) track(conn ziface.IConnection, u *Upstream) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	upstreams, ok := g.served[conn.GetConnID()]
+	if !ok {
+		upstreams = make(map[*Upstream]bool)
+		g.served[conn.GetConnID()] = upstreams
+		go g.watch(conn)
+	}
+	upstreams[u] = true
+}
+
+// 等待客户端连接断开
+func (g *Gateway) watch(conn ziface.IConnection) {
+	<-conn.Context().Done()
+	g.lock.Lock()
+	upstreams := g.served[conn.GetConnID()]
+	delete(g.served, conn.GetConnID())
+	g.lock.Unlock()
+	for u := range upstreams {
+		u.send(znet.NewMsgPackage(utils.GATEWAY_CLOSE_MSG_ID, encodeClose(conn.GetConnID())))
+	}
+}
+
+// 处理后端发来的消息，将回复发送给对应的客户端
+// 在后端连接的读goroutine中执行，非阻塞地放入客户端的发送队列，慢的客户端不会阻塞同一个后端上的其他客户端
+func (g *Gateway) handleUpstreamMsg(u *Upstream, msg ziface.IMessage) {
+	if msg.GetMsgId() != utils.GATEWAY_FORWARD_MSG_ID {
+		fmt.Printf("[zinx] gateway drop msgID = %d from upstream %s\n", msg.GetMsgId(), u.Addr)
+		return
+	}
+	env, err := DecodeEnvelope(msg.GetData())
+	if err != nil {
+		fmt.Printf("[zinx] gateway upstream %s err: %v\n", u.Addr, err)
+		return
+	}
+	conn, err := g.server.GetConnManager().Get(env.ConnID)
+	if err != nil {
+		// 客户端已经断开
+		return
+	}
+	ctx := conn.Context()
+	if trace := msg.GetTrace(); trace.IsValid() {
+		ctx = znet.ContextWithTrace(ctx, trace)
+	}
+	if err := conn.TrySendMsgContext(ctx, ziface.PriorityNormal, env.MsgID, env.Data); err != nil {
+		fmt.Printf("[zinx] gateway drop reply msgID = %d to ConnID = %d: %v\n", env.MsgID, env.ConnID, err)
+		return
+	}
+	u.replies.Add(1)
+}
+
+// 把一段msgID转发到后端服务池的路由
+type forwardRouter struct {
+	znet.BaseRouter
+	gateway *Gateway
+	pool    *UpstreamPool
+}
+
+func (r *forwardRouter) Handle(request ziface.IRequest) {
+	if err := r.gateway.forward(request, r.pool); err != nil {
+		fmt.Println("[zinx] gateway forward err:", err)
+		znet.SendErrorReply(request.GetConnection(), znet.ErrCodeUnavailable, request.GetMsgID(), err.Error())
+	}
+}
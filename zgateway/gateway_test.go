@@ -0,0 +1,242 @@
+package zgateway
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+	"github.com/Xaytick/zinx/ztest"
+)
+
+/*
+	网关转发的测试
+*/
+
+// 回复后端名称和消息内容，用来区分处理消息的后端
+type nameRouter struct {
+	znet.BaseRouter
+	name string
+}
+
+func (r *nameRouter) Handle(request ziface.IRequest) {
+	data := append([]byte(r.name+":"), request.GetData()...)
+	request.GetConnection().SendMsg(request.GetMsgID(), data)
+}
+
+// 模拟的后端节点，业务Server开启认证，网关连接使用单独的监听器
+type testBackend struct {
+	server  *ztest.Server
+	backend *Backend
+	addr    string
+}
+
+func startBackend(t *testing.T, name string) *testBackend {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := ztest.NewServer()
+	s.SetAuthenticator(loginAuth, 10)
+	permissions := znet.NewPermissionTable()
+	permissions.Require(100, "player")
+	permissions.Require(101, "admin")
+	s.SetAuthorizer(permissions)
+	s.AddRouter(100, &nameRouter{name: name})
+	s.AddRouter(101, &nameRouter{name: name})
+	backend := NewBackend(s.Server)
+	backend.Start(listener)
+	return &testBackend{server: s, backend: backend, addr: listener.Addr().String()}
+}
+
+func (b *testBackend) stop() {
+	b.backend.Stop()
+	b.server.Close()
+}
+
+// 登录消息的第一个字节为用户ID，用户拥有player角色
+var loginAuth = znet.AuthFunc(func(request ziface.IRequest) (*ziface.AuthInfo, error) {
+	return &ziface.AuthInfo{UserID: uint(request.GetData()[0]), Roles: []string{"player"}}, nil
+})
+
+func expectErrorCode(t *testing.T, client *ztest.Client, code int) {
+	t.Helper()
+	msg, err := client.Expect(utils.ERROR_MSG_ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errReply znet.ErrorReply
+	if err := json.Unmarshal(msg.GetData(), &errReply); err != nil || errReply.Code != code {
+		t.Fatalf("error reply = %s, err = %v, want code %d", msg.GetData(), err, code)
+	}
+}
+
+func waitHealthy(t *testing.T, pool *UpstreamPool, count int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		healthy := 0
+		for _, status := range pool.Status() {
+			if status.Healthy {
+				healthy++
+			}
+		}
+		if healthy == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pool %s: %d upstreams not healthy", pool.Name, count)
+}
+
+func TestGateway(t *testing.T) {
+	backends := map[string]*testBackend{"a": startBackend(t, "a"), "b": startBackend(t, "b")}
+	defer func() {
+		for _, backend := range backends {
+			backend.stop()
+		}
+	}()
+
+	front := ztest.NewServer()
+	defer front.Close()
+	front.SetAuthenticator(loginAuth, 10)
+	pool := NewUpstreamPool("game", []string{backends["a"].addr, backends["b"].addr}, nil)
+	pool.HealthInterval = 50 * time.Millisecond
+	pool.MaxBackoff = 100 * time.Millisecond
+	gateway := NewGateway(front.Server)
+	if err := gateway.Route(100, 199, pool); err != nil {
+		t.Fatal(err)
+	}
+	gateway.Start()
+	defer gateway.Stop()
+	waitHealthy(t, pool, 2)
+
+	client, err := front.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Send(10, []byte{7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Expect(utils.AUTH_OK_MSG_ID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func() string {
+		if err := client.Send(100, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := client.Expect(100, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(msg.GetData())
+	}
+
+	// 同一个客户端的消息固定转发到一个后端
+	reply := request()
+	if reply != "a:hello" && reply != "b:hello" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if again := request(); again != reply {
+		t.Fatalf("reply from %q, want sticky %q", again, reply)
+	}
+
+	// 后端按照网关转发的角色检查权限
+	if err := client.Send(101, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectErrorCode(t, client, znet.ErrCodeForbidden)
+
+	// 处理消息的后端停止之后切换到另一个后端
+	served := reply[:1]
+	backends[served].stop()
+	delete(backends, served)
+	waitHealthy(t, pool, 1)
+	if failover := request(); failover == reply || !strings.HasSuffix(failover, ":hello") {
+		t.Fatalf("reply %q after %s stopped", failover, served)
+	}
+
+	// 没有可用的后端时回复错误
+	for name, backend := range backends {
+		backend.stop()
+		delete(backends, name)
+	}
+	waitHealthy(t, pool, 0)
+	if err := client.Send(100, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	expectErrorCode(t, client, znet.ErrCodeUnavailable)
+}
+
+// 直接连接业务Server的客户端不能通过转发消息冒充其他用户
+func TestBackendRejectsForgedForward(t *testing.T) {
+	backend := startBackend(t, "a")
+	defer backend.stop()
+
+	client, err := backend.server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	forged, _ := EncodeEnvelope(&Envelope{ConnID: 1, MsgID: 100, UserID: 42, Roles: []string{"player"}, Data: []byte("hello")})
+	if err := client.Send(utils.GATEWAY_FORWARD_MSG_ID, forged); err != nil {
+		t.Fatal(err)
+	}
+	expectErrorCode(t, client, znet.ErrCodeUnauthenticated)
+	if backend.backend.ConnCount() != 0 {
+		t.Fatal("forged forward created a virtual connection")
+	}
+}
+
+// 转发失败时依次尝试所有可用的后端，写入超时的后端被标记为不可用
+func TestForwardFailover(t *testing.T) {
+	pool := NewUpstreamPool("game", []string{"a", "b", "c", "d"}, nil)
+	pool.WriteTimeout = 50 * time.Millisecond
+	var order []*Upstream
+	for _, u := range pool.upstreams {
+		u.healthy.Store(true)
+	}
+	for u := pool.Pick(1); u != nil; u = pool.Pick(1, order...) {
+		order = append(order, u)
+	}
+	// 第一个选中的后端不读取消息，中间的后端没有连接，只有最后一个后端可以转发
+	stalled, stalledPeer := net.Pipe()
+	defer stalledPeer.Close()
+	order[0].conn = stalled
+	working, peer := net.Pipe()
+	defer working.Close()
+	go func() {
+		defer peer.Close()
+		buf := make([]byte, 1024)
+		for {
+			if _, err := peer.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	order[3].conn = working
+
+	s := ztest.NewServer()
+	defer s.Close()
+	g := NewGateway(s.Server)
+	conn := ztest.NewMockConnection(1)
+	defer conn.Stop()
+	start := time.Now()
+	if err := g.forward(ztest.NewMockRequest(conn, 100, []byte("hello")), pool); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("forward took %s", elapsed)
+	}
+	if order[3].forwarded.Load() != 1 {
+		t.Fatal("message not forwarded to the only working upstream")
+	}
+	if order[0].Healthy() {
+		t.Fatal("stalled upstream still healthy after write timeout")
+	}
+}
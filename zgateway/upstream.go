@@ -0,0 +1,311 @@
+package zgateway
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	后端服务池
+	网关和池中的每个后端保持一个长连接，所有客户端的消息复用这个连接转发。
+	连接断开或者健康检查的心跳超时时，后端被标记为不可用，并按退避时间重新连接。
+	同一个客户端连接的消息按照连接ID哈希固定发送到一个可用的后端，该后端不可用时切换到其他后端
+*/
+
+// 后端的状态
+type UpstreamStatus struct {
+	Addr      string `json:"addr"`
+	Healthy   bool   `json:"healthy"`
+	Forwarded uint64 `json:"forwarded"` // 转发给后端的消息数量
+	Replies   uint64 `json:"replies"`   // 后端回复给客户端的消息数量
+	LastError string `json:"lastError,omitempty"`
+}
+
+type Upstream struct {
+	Addr string
+	pool *UpstreamPool
+	// 是否可以转发消息
+	healthy atomic.Bool
+	// 当前的连接，没有连接时为nil
+	conn net.Conn
+	// 最近一次连接或者读取失败的原因
+	lastErr string
+	// 保护conn、dp、lastErr和写入的锁
+	lock sync.Mutex
+	// 和后端当前连接使用的封包拆包工具，连接时按照协议握手协商的结果重新创建
+	dp ziface.IDataPack
+	// 发送大消息时分配分片ID的计数
+	fragID uint32
+	// 最近一次收到PONG的时间
+	lastPong atomic.Int64
+	// 转发和回复的消息数量
+	forwarded atomic.Uint64
+	replies   atomic.Uint64
+}
+
+type UpstreamPool struct {
+	Name      string
+	upstreams []*Upstream
+	// 连接后端使用的配置，需要和后端的封包、协议握手和会话加密设置一致
+	conf *utils.GlobalObj
+	// 建立连接的超时时间
+	DialTimeout time.Duration
+	// 向后端写入一个消息的超时时间，超时时断开连接，避免慢的后端阻塞所有转发
+	WriteTimeout time.Duration
+	// 健康检查发送心跳的间隔
+	HealthInterval time.Duration
+	// 超过该时间没有收到心跳回复时断开连接
+	HealthTimeout time.Duration
+	// 重新连接的最大退避时间
+	MaxBackoff time.Duration
+	// 建立到后端的连接，默认使用TCP
+	Dialer func(addr string, timeout time.Duration) (net.Conn, error)
+	// 处理后端发来的转发消息，由网关设置
+	handler func(u *Upstream, msg ziface.IMessage)
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// 创建后端服务池，conf为nil时使用utils.GlobalObject
+func NewUpstreamPool(name string, addrs []string, conf *utils.GlobalObj) *UpstreamPool {
+	if conf == nil {
+		conf = utils.GlobalObject
+	}
+	p := &UpstreamPool{
+		Name:           name,
+		conf:           conf,
+		DialTimeout:    3 * time.Second,
+		WriteTimeout:   3 * time.Second,
+		HealthInterval: 5 * time.Second,
+		HealthTimeout:  15 * time.Second,
+		MaxBackoff:     10 * time.Second,
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	}
+	for _, addr := range addrs {
+		p.upstreams = append(p.upstreams, &Upstream{Addr: addr, pool: p, dp: znet.NewDataPackWithConfig(conf)})
+	}
+	return p
+}
+
+// 开始连接池中的所有后端
+func (p *UpstreamPool) Start() {
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for _, u := range p.upstreams {
+		p.wg.Add(1)
+		go u.run()
+	}
+}
+
+// 断开池中所有后端的连接
+func (p *UpstreamPool) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	for _, u := range p.upstreams {
+		u.close()
+	}
+	p.wg.Wait()
+}
+
+// 按照key选择一个可用的后端，exclude为已经转发失败的后端，没有可用的后端时返回nil
+// 使用最高随机权重哈希，后端上下线时只有该后端上的客户端会切换
+func (p *UpstreamPool) Pick(key uint32, exclude ...*Upstream) *Upstream {
+	var best *Upstream
+	var bestScore uint64
+	for _, u := range p.upstreams {
+		if !u.healthy.Load() || slices.Contains(exclude, u) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(u.Addr))
+		h.Write(binary.LittleEndian.AppendUint32(nil, key))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+// 获取池中所有后端的状态
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		u.lock.Lock()
+		lastErr := u.lastErr
+		u.lock.Unlock()
+		status = append(status, UpstreamStatus{
+			Addr:      u.Addr,
+			Healthy:   u.healthy.Load(),
+			Forwarded: u.forwarded.Load(),
+			Replies:   u.replies.Load(),
+			LastError: lastErr,
+		})
+	}
+	return status
+}
+
+// 后端是否可以转发消息
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+// 保持和后端的连接，断开之后按退避时间重新连接，直到服务池停止
+func (u *Upstream) run() {
+	defer u.pool.wg.Done()
+	backoff := 500 * time.Millisecond
+	for {
+		conn, dp, err := u.connect()
+		if err == nil {
+			backoff = 500 * time.Millisecond
+			fmt.Printf("[zinx] gateway pool %s connected to %s\n", u.pool.Name, u.Addr)
+			err = u.serve(conn, dp)
+		}
+		u.healthy.Store(false)
+		u.close()
+		if u.pool.ctx.Err() != nil {
+			return
+		}
+		u.lock.Lock()
+		u.lastErr = err.Error()
+		u.lock.Unlock()
+		fmt.Printf("[zinx] gateway pool %s upstream %s unavailable: %v, retry in %s\n", u.pool.Name, u.Addr, err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-u.pool.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > u.pool.MaxBackoff {
+			backoff = u.pool.MaxBackoff
+		}
+	}
+}
+
+// 建立连接并完成握手
+func (u *Upstream) connect() (net.Conn, ziface.IDataPack, error) {
+	raw, err := u.pool.Dialer(u.Addr, u.pool.DialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw.SetDeadline(time.Now().Add(u.pool.DialTimeout))
+	conn, info, err := znet.ClientHandshake(raw, u.pool.conf)
+	if err != nil {
+		raw.Close()
+		return nil, nil, errors.Wrap(err, "handshake")
+	}
+	dp := znet.NewDataPackWithProtocol(u.pool.conf, info)
+	raw.SetDeadline(time.Time{})
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	// 连接期间服务池已经停止
+	if u.pool.ctx.Err() != nil {
+		conn.Close()
+		return nil, nil, u.pool.ctx.Err()
+	}
+	u.conn = conn
+	u.dp = dp
+	u.lastErr = ""
+	u.lastPong.Store(time.Now().UnixNano())
+	u.healthy.Store(true)
+	return conn, dp, nil
+}
+
+// 读取后端发来的消息，同时进行健康检查，连接断开时返回
+func (u *Upstream) serve(conn net.Conn, dp ziface.IDataPack) error {
+	done := make(chan struct{})
+	defer close(done)
+	go u.healthCheck(conn, done)
+
+	reassembler := znet.NewReassembler(u.pool.conf.ReassemblyLimit(), time.Duration(u.pool.conf.ReassemblyTimeout)*time.Second)
+	for {
+		msg, err := znet.ReadFullMsg(conn, dp, reassembler)
+		if err != nil {
+			return err
+		}
+		switch msg.GetMsgId() {
+		case utils.PING_MSG_ID:
+			// 后端开启了主动心跳
+			u.send(znet.NewMsgPackage(utils.PONG_MSG_ID, msg.GetData()))
+		case utils.PONG_MSG_ID:
+			u.lastPong.Store(time.Now().UnixNano())
+		default:
+			if u.pool.handler != nil {
+				u.pool.handler(u, msg)
+			}
+		}
+	}
+}
+
+// 定期发送心跳，超时没有收到回复时断开连接
+func (u *Upstream) healthCheck(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(u.pool.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, u.lastPong.Load())) > u.pool.HealthTimeout {
+				fmt.Printf("[zinx] gateway pool %s upstream %s health check timeout\n", u.pool.Name, u.Addr)
+				u.healthy.Store(false)
+				conn.Close()
+				return
+			}
+			u.send(znet.NewMsgPackage(utils.PING_MSG_ID, nil))
+		case <-done:
+			return
+		}
+	}
+}
+
+// 向后端发送一个消息
+func (u *Upstream) send(msg ziface.IMessage) error {
+	fragID := atomic.AddUint32(&u.fragID, 1)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == nil {
+		return errors.New("upstream not connected")
+	}
+	frames, err := u.dp.PackFragments(msg, fragID)
+	if err != nil {
+		return err
+	}
+	if u.pool.WriteTimeout > 0 {
+		u.conn.SetWriteDeadline(time.Now().Add(u.pool.WriteTimeout))
+	}
+	for _, frame := range frames {
+		if _, err := u.conn.Write(frame); err != nil {
+			// 写失败或者超时时关闭连接，由run重新连接
+			u.healthy.Store(false)
+			u.conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// 关闭当前的连接
+func (u *Upstream) close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
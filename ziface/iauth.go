@@ -0,0 +1,21 @@
+package ziface
+
+/*
+	连接认证的抽象层
+*/
+
+// 认证成功后得到的连接身份信息
+type AuthInfo struct {
+	UserID uint     // 连接绑定的用户ID
+	Roles  []string // 连接拥有的角色，用于消息权限校验
+}
+
+type IAuthenticator interface {
+	// 校验登录请求中携带的凭证，成功时返回身份信息
+	Authenticate(request IRequest) (*AuthInfo, error)
+}
+
+type IAuthorizer interface {
+	// 判断拥有roles角色的连接是否可以调用msgID
+	Allowed(msgID uint32, roles []string) bool
+}
@@ -0,0 +1,16 @@
+package ziface
+
+/*
+	集群用户目录的抽象层
+	记录每个在线用户所在的节点，节点使用集群内部连接的地址作为标识
+*/
+
+type IUserDirectory interface {
+	// 登记用户连接在node节点上，覆盖之前的登记，
+	// 登记可以有有效期，节点需要定期重新登记，崩溃的节点上的用户在过期后查询不到
+	Register(userID uint, node string) error
+	// 取消用户在node节点上的登记，用户已经登记到其他节点时不做修改
+	Unregister(userID uint, node string) error
+	// 查询用户所在的节点，用户不在线时返回空字符串
+	Lookup(userID uint) (string, error)
+}
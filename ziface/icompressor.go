@@ -0,0 +1,14 @@
+package ziface
+
+/*
+	消息压缩算法的抽象层
+*/
+
+type ICompressor interface {
+	// 压缩算法的名称
+	Name() string
+	// 压缩数据
+	Compress(data []byte) ([]byte, error)
+	// 解压数据，解压后的长度超过maxSize时返回错误
+	Decompress(data []byte, maxSize uint32) ([]byte, error)
+}
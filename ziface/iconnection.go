@@ -1,6 +1,7 @@
 package ziface
 
 import (
+	"context"
 	"net"
 	"time"
 )
@@ -10,10 +11,13 @@ type IConnection interface {
 	// 启动连接，让当前连接开始工作
 	Start()
 
-	//停止连接，结束当前连接状态
+	//停止连接，结束当前连接状态，开启会话恢复时保留会话等待客户端重连
 	Stop()
 
-	//获取当前连接绑定的socket conn
+	//停止连接并丢弃会话，客户端不能再恢复，用于踢下线和协议违规
+	StopAndDiscardSession()
+
+	//获取当前连接绑定的socket conn，不是TCP连接时为nil
 	GetTCPConnection() *net.TCPConn
 
 	//获取当前连接模块的连接ID
@@ -28,6 +32,18 @@ type IConnection interface {
 	//发送消息，将我们对客户端定义的消息进行发送
 	SendMsg(msgId uint32, data []byte) error
 
+	//发送消息，并携带ctx中的链路追踪上下文，在路由中使用request.Context()
+	SendMsgContext(ctx context.Context, msgId uint32, data []byte) error
+
+	//按优先级发送消息，高优先级的消息先于排队中的低优先级消息发送
+	SendMsgWithPriority(priority MsgPriority, msgId uint32, data []byte) error
+
+	//非阻塞地按优先级发送消息，发送队列已满时返回错误，不等待
+	TrySendMsg(priority MsgPriority, msgId uint32, data []byte) error
+
+	//非阻塞地按优先级发送消息，并携带ctx中的链路追踪上下文
+	TrySendMsgContext(ctx context.Context, priority MsgPriority, msgId uint32, data []byte) error
+
 	//设置连接属性
 	SetProperty(key string, value interface{})
 
@@ -37,11 +53,68 @@ type IConnection interface {
 	//移除连接属性
 	RemoveProperty(key string)
 
+	//获取所有连接属性的副本
+	GetProperties() map[string]interface{}
+
 	//更新心跳活动时间
 	UpdateActivity()
 
 	//获取最后活动时间
 	GetLastActivityTime() time.Time
+
+	//获取服务端主动心跳测量的RTT统计
+	GetRTTStats() RTTStats
+
+	//在d时间之后执行一次f，连接停止时自动取消
+	AfterFunc(d time.Duration, f func()) ITimer
+
+	//每隔d时间执行一次f，连接停止时自动取消
+	Every(d time.Duration, f func()) ITimer
+
+	//连接是否已经完成认证
+	IsAuthenticated() bool
+
+	//标记连接完成认证，并绑定userID
+	SetAuthenticated(info *AuthInfo)
+
+	//获取连接握手时协商的协议信息
+	GetProtocolInfo() ProtocolInfo
+
+	//增加协议违规分数，返回当前总分，超过上限时关闭连接
+	AddProtocolViolation(points int) int
+
+	//获取连接的上下文，连接停止时被取消
+	Context() context.Context
+}
+
+// 连接握手时协商的协议信息
+type ProtocolInfo struct {
+	Version     uint16 // 协商的协议版本，没有进行协议握手时为0
+	Compression string // 使用的压缩算法，为空表示不压缩
+	Encryption  bool   // 是否开启会话加密
+	Checksum    bool   // 是否开启消息校验和
+	Codec       string // 协商的消息编码，例如json或protobuf，由业务解析消息内容时使用，为空表示没有协商
+	Trace       bool   // 对端是否能够解析链路追踪扩展头
+}
+
+// 出站消息的优先级，每个优先级对应连接上的一个发送通道
+type MsgPriority uint8
+
+const (
+	PriorityHigh   MsgPriority = iota // 高优先级，例如心跳、战斗和踢人消息
+	PriorityNormal                    // 普通优先级，SendMsg使用的默认优先级
+	PriorityLow                       // 低优先级，例如聊天和批量同步消息
+	PriorityCount  = 3                // 优先级的数量
+)
+
+// 服务端主动心跳测量的往返时延统计
+type RTTStats struct {
+	Last    time.Duration // 最近一次的RTT
+	Min     time.Duration // 最小RTT
+	Max     time.Duration // 最大RTT
+	Avg     time.Duration // 平均RTT
+	Samples uint64        // 有效的RTT样本数
+	Missed  int           // 当前连续未收到回复的心跳次数
 }
 
 type HandleFunc func(*net.TCPConn, []byte, int) error
@@ -1,7 +1,7 @@
 package ziface
 
 /*
-	连接管理模块的抽象层
+连接管理模块的抽象层
 */
 type IConnManager interface {
 	//添加连接
@@ -22,4 +22,14 @@ type IConnManager interface {
 	SetConnByUserID(connID uint32, userID uint)
 	// 根据UserID清除连接
 	ClearConnByUserID(userID uint)
-}
\ No newline at end of file
+	// 设置UserID绑定到连接时的Hook函数
+	SetOnUserBind(func(userID uint))
+	// 设置UserID和连接解除绑定时的Hook函数
+	SetOnUserUnbind(func(userID uint))
+	// 添加一组UserID绑定和解除绑定的监听函数，和SetOnUserBind设置的Hook函数互不影响，返回移除监听的函数
+	AddUserListener(onBind, onUnbind func(userID uint)) (remove func())
+	// 设置允许的最大连接数
+	SetMaxConn(maxConn int)
+	// 获取允许的最大连接数
+	GetMaxConn() int
+}
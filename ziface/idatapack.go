@@ -10,7 +10,14 @@ type IDataPack interface {
 	GetHeadLen() uint32
 	// 封包方法
 	Pack(msg IMessage) ([]byte, error)
+	// 封包，消息体超过最大包长度时拆分为多个分片，fragID用于标识同一个消息的分片
+	PackFragments(msg IMessage, fragID uint32) ([][]byte, error)
 	// 拆包方法
-	Unpack([]byte) (IMessage, error)	
-
-}
\ No newline at end of file
+	Unpack([]byte) (IMessage, error)
+	// 读取完消息体之后还原消息体，例如解压缩
+	UnpackData(msg IMessage) error
+	// 设置允许的最大数据包长度
+	SetMaxPackageSize(size uint32)
+	// 获取允许的最大数据包长度
+	GetMaxPackageSize() uint32
+}
@@ -0,0 +1,32 @@
+package ziface
+
+/*
+	可靠投递相关的定义
+*/
+
+// 可靠消息的投递状态
+type DeliveryStatus int
+
+const (
+	// 对端已经确认收到
+	DeliveryAcked DeliveryStatus = iota
+	// 客户端恢复会话后重新发送
+	DeliveryRetransmitted
+	// 连接断开并且无法恢复，消息没有送达
+	DeliveryFailed
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case DeliveryAcked:
+		return "acked"
+	case DeliveryRetransmitted:
+		return "retransmitted"
+	case DeliveryFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// 可靠消息投递状态变化时的回调，seq为消息在连接上的序号
+type DeliveryCallback func(conn IConnection, msgID uint32, seq uint64, status DeliveryStatus)
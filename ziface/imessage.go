@@ -18,4 +18,19 @@ type IMessage interface {
 	SetMsgLen(uint32)
 	// 设置消息的内容
 	SetData([]byte)
-}
\ No newline at end of file
+
+	// 获取消息的标志位
+	GetFlags() uint8
+	// 设置消息的标志位
+	SetFlags(uint8)
+
+	// 获取消息携带的链路追踪上下文
+	GetTrace() TraceContext
+	// 设置消息携带的链路追踪上下文
+	SetTrace(TraceContext)
+
+	// 获取可靠消息的序号，0表示不是可靠消息
+	GetSeq() uint64
+	// 设置可靠消息的序号
+	SetSeq(uint64)
+}
@@ -1,5 +1,7 @@
 package ziface
 
+import "time"
+
 /*
 	消息管理抽象层
 */
@@ -8,12 +10,48 @@ type IMsgHandler interface {
 	// 调度/执行对应的Router消息处理方法
 	DoMsgHandler(request IRequest)
 
-	// 为消息添加具体的处理逻辑
-	AddRouter(msgId uint32, router IRouter)
+	// 为消息添加具体的处理逻辑，msgID已经注册时返回错误
+	AddRouter(msgId uint32, router IRouter) error
+
+	// 删除消息的处理逻辑，msgID没有注册时返回错误
+	RemoveRouter(msgId uint32) error
+
+	// 替换消息的处理逻辑，msgID没有注册时直接添加，返回被替换的路由
+	ReplaceRouter(msgId uint32, router IRouter) IRouter
+
+	// 为[start, end]区间内的消息添加处理逻辑，区间无效或者已经注册时返回错误
+	AddRangeRouter(start, end uint32, router IRouter) error
+
+	// 为满足msgID&mask == value的消息添加处理逻辑，规则已经注册时返回错误
+	AddMaskRouter(mask, value uint32, router IRouter) error
+
+	// 设置消息的处理超时时间，超时后请求的上下文被取消，timeout不大于0时取消限制
+	SetHandlerTimeout(msgId uint32, timeout time.Duration)
+
+	// 设置默认路由，处理没有其他路由匹配的消息
+	SetDefaultRouter(router IRouter)
+
+	// 设置未知消息的Hook函数，没有任何路由匹配时调用
+	SetOnUnknownMsg(hookFunc func(request IRequest))
 
 	// 启动一个Worker工作池
 	StartWorkerPool()
 
 	// 将消息交给TaskQueue，由Worker进行处理
 	SendMsgToTaskQueue(request IRequest)
-}
\ No newline at end of file
+
+	// 获取Worker池的大小，为0时表示没有开启工作池
+	GetWorkerPoolSize() uint32
+
+	// 设置认证器，认证之前只有登录消息和白名单中的消息会被处理
+	SetAuthenticator(auth IAuthenticator, loginMsgID uint32, whitelist ...uint32)
+
+	// 获取认证器，没有设置时返回nil
+	GetAuthenticator() IAuthenticator
+
+	// 设置消息权限校验，为nil时关闭校验
+	SetAuthorizer(authorizer IAuthorizer)
+
+	// 设置Span导出器，为nil时关闭链路追踪
+	SetSpanExporter(exporter ISpanExporter)
+}
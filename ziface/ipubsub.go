@@ -0,0 +1,36 @@
+package ziface
+
+import "time"
+
+/*
+	服务器内的主题发布订阅
+	主题由"."分隔的多段组成，例如market.btc.usdt，
+	订阅时可以使用通配符："*"匹配一段，"#"只能作为最后一段，匹配之后的任意多段(包括零段)
+*/
+
+type IPubSub interface {
+	// 连接订阅一个主题或者通配符模式
+	Subscribe(conn IConnection, pattern string) error
+	// 连接取消订阅一个主题或者通配符模式
+	Unsubscribe(conn IConnection, pattern string)
+	// 取消连接的所有订阅，连接停止时自动调用
+	UnsubscribeAll(conn IConnection)
+	// 获取连接的所有订阅
+	GetSubscriptions(conn IConnection) []string
+	// 向主题发布消息，通过每个订阅连接的发送队列投递，返回投递成功的连接数量
+	Publish(topic string, msgID uint32, data []byte) int
+	// 按优先级向主题发布消息
+	PublishWithPriority(topic string, priority MsgPriority, msgID uint32, data []byte) int
+	// 获取所有发布过消息的主题的统计
+	GetTopicStats() []TopicStats
+}
+
+// 一个主题的统计
+type TopicStats struct {
+	Topic       string    // 主题名称
+	Subscribers int       // 最近一次发布时匹配的订阅连接数量
+	Published   uint64    // 发布的消息数量
+	Delivered   uint64    // 投递成功的消息数量
+	Failed      uint64    // 投递失败的消息数量
+	LastPublish time.Time // 最近一次发布的时间
+}
@@ -1,5 +1,7 @@
 package ziface
 
+import "context"
+
 /*
 	将请求的一个连接和数据封装到一个Request中，
 */
@@ -11,4 +13,10 @@ type IRequest interface {
 	GetData() []byte
 	// 得到请求的消息的ID
 	GetMsgID() uint32
-}
\ No newline at end of file
+	// 得到请求的上下文，连接停止或者处理超时时被取消
+	Context() context.Context
+	// 替换请求的上下文，中间件可以通过context.WithValue附加数据
+	SetContext(ctx context.Context)
+	// 得到请求的链路追踪上下文，开启追踪时为当前处理的Span
+	GetTrace() TraceContext
+}
@@ -1,5 +1,7 @@
 package ziface
 
+import "time"
+
 type IServer interface {
 	// 启动服务器
 	Start()
@@ -8,7 +10,13 @@ type IServer interface {
 	// 运行服务器
 	Serve()
 	// 路由功能：给当前服务注册一个路由业务方法，供客户端链接处理使用
-	AddRouter(msgID uint32, router IRouter)
+	AddRouter(msgID uint32, router IRouter) error
+	// 删除一个路由，运行期间也可以调用
+	RemoveRouter(msgID uint32) error
+	// 替换一个路由，msgID没有注册时直接添加，返回被替换的路由
+	ReplaceRouter(msgID uint32, router IRouter) IRouter
+	// 设置默认路由，处理没有其他路由匹配的消息
+	SetDefaultRouter(router IRouter)
 	// 获取连接管理器
 	GetConnManager() IConnManager
 	// 设置该Server的连接创建时Hook函数
@@ -21,4 +29,26 @@ type IServer interface {
 	CallOnConnStop(conn IConnection)
 	// 设置心跳检测开关
 	SetHeartbeat(enabled bool)
+	// 设置心跳检测间隔和超时时间
+	SetHeartbeatConfig(interval, timeout time.Duration)
+	// 获取心跳检测间隔和超时时间
+	GetHeartbeatConfig() (interval, timeout time.Duration)
+	// 设置服务端主动心跳，maxMissed为允许连续丢失的心跳次数
+	SetActiveHeartbeat(enabled bool, maxMissed int)
+	// 获取服务端主动心跳的配置
+	GetActiveHeartbeat() (enabled bool, maxMissed int)
+	// 获取封包拆包工具
+	GetPacket() IDataPack
+	// 获取Server共用的时间轮
+	GetTimeWheel() ITimeWheel
+	// 设置认证器，认证之前只有登录消息和白名单中的消息会被处理
+	SetAuthenticator(auth IAuthenticator, loginMsgID uint32, whitelist ...uint32)
+	// 设置消息权限校验，为nil时关闭校验
+	SetAuthorizer(authorizer IAuthorizer)
+	// 将msgID设置为可靠投递，发送的消息需要对端确认
+	SetReliable(msgIDs ...uint32)
+	// 设置可靠消息投递状态变化时的回调
+	SetOnDelivery(callback DeliveryCallback)
+	// 获取主题发布订阅管理器
+	GetPubSub() IPubSub
 }
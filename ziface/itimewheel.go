@@ -0,0 +1,23 @@
+package ziface
+
+import "time"
+
+/*
+	时间轮定时器的抽象层
+*/
+
+type ITimer interface {
+	// 取消定时器，定时器已经触发或者已经取消时返回false
+	Stop() bool
+}
+
+type ITimeWheel interface {
+	// 启动时间轮
+	Start()
+	// 停止时间轮
+	Stop()
+	// 在d时间之后执行一次f
+	AfterFunc(d time.Duration, f func()) ITimer
+	// 每隔d时间执行一次f
+	Every(d time.Duration, f func()) ITimer
+}
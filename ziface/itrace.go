@@ -0,0 +1,45 @@
+package ziface
+
+import "time"
+
+/*
+	链路追踪抽象层
+*/
+
+// 链路追踪上下文，随消息在扩展头中传递
+type TraceContext struct {
+	TraceID [16]byte // 整条链路的ID
+	SpanID  [8]byte  // 发送方当前Span的ID
+	Flags   uint8    // 追踪标志位
+}
+
+// 追踪标志位：该链路需要被采样导出
+const TraceFlagSampled uint8 = 1 << 0
+
+// 是否携带了有效的追踪上下文
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{}
+}
+
+// 该链路是否需要被采样导出
+func (tc TraceContext) IsSampled() bool {
+	return tc.Flags&TraceFlagSampled != 0
+}
+
+// 一次消息处理对应的Span
+type Span struct {
+	TraceID      [16]byte      // 链路ID
+	SpanID       [8]byte       // 当前Span的ID
+	ParentSpanID [8]byte       // 上游Span的ID，链路起点时为空
+	Name         string        // Span名称
+	MsgID        uint32        // 处理的消息ID
+	ConnID       uint32        // 消息所属的连接ID
+	Start        time.Time     // 开始处理的时间
+	Duration     time.Duration // 处理耗时
+	Error        string        // 处理失败时的原因
+}
+
+// Span导出器，Export在处理消息的goroutine中调用，需要是并发安全的
+type ISpanExporter interface {
+	Export(span *Span)
+}
@@ -0,0 +1,275 @@
+package znet
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	管理HTTP接口
+	基于ConnManager和MsgHandler提供运行时的查看和操作，所有接口返回JSON：
+		GET    /conns              列出所有连接
+		GET    /conns/{connID}     查看一个连接
+		DELETE /conns/{connID}     踢掉一个连接
+		DELETE /users/{userID}     踢掉一个用户的连接
+		POST   /broadcast          向所有连接广播消息，请求体为{"msgId": 1, "data": "文本"}或{"msgId": 1, "hex": "00ff"}
+		GET    /workers            查看worker任务队列的长度
+		GET    /routers            查看已注册的路由
+		GET    /metrics            查看运行指标
+		GET    /topics             查看发布订阅主题的统计
+	设置了AdminToken时，请求需要携带Authorization: Bearer <token>，没有设置时只能监听在本地回环地址
+*/
+
+type AdminServer struct {
+	server *Server
+	token  string
+	// 监听的HTTP服务
+	httpServer *http.Server
+}
+
+// 创建管理接口，token为空时不做认证，Start只允许监听在本地回环地址
+func NewAdminServer(server *Server, token string) *AdminServer {
+	return &AdminServer{server: server, token: token}
+}
+
+// 获取管理接口的http.Handler
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", a.listConns)
+	mux.HandleFunc("GET /conns/{connID}", a.showConn)
+	mux.HandleFunc("DELETE /conns/{connID}", a.kickConn)
+	mux.HandleFunc("DELETE /users/{userID}", a.kickUser)
+	mux.HandleFunc("POST /broadcast", a.broadcast)
+	mux.HandleFunc("GET /workers", a.workers)
+	mux.HandleFunc("GET /routers", a.routers)
+	mux.HandleFunc("GET /metrics", a.metrics)
+	mux.HandleFunc("GET /topics", a.topics)
+	return a.auth(mux)
+}
+
+// 开始监听管理接口，没有设置token时拒绝监听非本地回环地址
+func (a *AdminServer) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); a.token == "" && (!ok || !tcpAddr.IP.IsLoopback()) {
+		listener.Close()
+		return fmt.Errorf("admin api without token can only listen on a loopback address, got %s", listener.Addr())
+	}
+	fmt.Println("[zinx] admin api listening at", listener.Addr())
+	a.httpServer = &http.Server{Handler: a.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go a.httpServer.Serve(listener)
+	return nil
+}
+
+// 停止管理接口
+func (a *AdminServer) Stop() {
+	if a.httpServer != nil {
+		a.httpServer.Close()
+	}
+}
+
+// token认证
+func (a *AdminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 连接的描述
+type AdminConnInfo struct {
+	ConnID        uint32                 `json:"connId"`
+	RemoteAddr    string                 `json:"remoteAddr"`
+	UserID        uint                   `json:"userId,omitempty"`
+	Authenticated bool                   `json:"authenticated"`
+	LastActivity  time.Time              `json:"lastActivity"`
+	Protocol      ziface.ProtocolInfo    `json:"protocol"`
+	RTT           ziface.RTTStats        `json:"rtt"`
+	Properties    map[string]interface{} `json:"properties,omitempty"`
+}
+
+func newAdminConnInfo(conn ziface.IConnection, withProperties bool) *AdminConnInfo {
+	info := &AdminConnInfo{
+		ConnID:        conn.GetConnID(),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		Authenticated: conn.IsAuthenticated(),
+		LastActivity:  conn.GetLastActivityTime(),
+		Protocol:      conn.GetProtocolInfo(),
+		RTT:           conn.GetRTTStats(),
+	}
+	properties := conn.GetProperties()
+	if userID, ok := properties["userID"].(uint); ok {
+		info.UserID = userID
+	}
+	if withProperties {
+		// 不能序列化为JSON的属性值使用文本表示
+		info.Properties = make(map[string]interface{}, len(properties))
+		for key, value := range properties {
+			if _, err := json.Marshal(value); err != nil {
+				value = fmt.Sprintf("%v", value)
+			}
+			info.Properties[key] = value
+		}
+	}
+	return info
+}
+
+func (a *AdminServer) listConns(w http.ResponseWriter, r *http.Request) {
+	conns := a.server.GetConnManager().All()
+	infos := make([]*AdminConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, newAdminConnInfo(conn, true))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnID < infos[j].ConnID })
+	writeAdminJSON(w, http.StatusOK, infos)
+}
+
+// 根据路径参数获取连接
+func (a *AdminServer) getConn(w http.ResponseWriter, r *http.Request) (ziface.IConnection, bool) {
+	connID, err := strconv.ParseUint(r.PathValue("connID"), 10, 32)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid connID")
+		return nil, false
+	}
+	conn, err := a.server.GetConnManager().Get(uint32(connID))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	return conn, true
+}
+
+func (a *AdminServer) showConn(w http.ResponseWriter, r *http.Request) {
+	if conn, ok := a.getConn(w, r); ok {
+		writeAdminJSON(w, http.StatusOK, newAdminConnInfo(conn, true))
+	}
+}
+
+func (a *AdminServer) kickConn(w http.ResponseWriter, r *http.Request) {
+	conn, ok := a.getConn(w, r)
+	if !ok {
+		return
+	}
+	fmt.Println("[zinx] admin kick ConnID = ", conn.GetConnID())
+	// 被踢下线的客户端不能通过恢复会话重新上线
+	conn.StopAndDiscardSession()
+	writeAdminJSON(w, http.StatusOK, map[string]uint32{"connId": conn.GetConnID()})
+}
+
+func (a *AdminServer) kickUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(r.PathValue("userID"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid userID")
+		return
+	}
+	conn := a.server.GetConnManager().GetConnByUserID(uint(userID))
+	if conn == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("userID = %d is not online", userID))
+		return
+	}
+	fmt.Println("[zinx] admin kick UserID = ", userID, " ConnID = ", conn.GetConnID())
+	conn.StopAndDiscardSession()
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"userId": userID, "connId": conn.GetConnID()})
+}
+
+// 广播请求
+type adminBroadcast struct {
+	MsgID uint32 `json:"msgId"`
+	Data  string `json:"data"`
+	Hex   string `json:"hex"`
+}
+
+func (a *AdminServer) broadcast(w http.ResponseWriter, r *http.Request) {
+	var req adminBroadcast
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	data := []byte(req.Data)
+	if req.Hex != "" {
+		var err error
+		if data, err = hex.DecodeString(req.Hex); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid hex: "+err.Error())
+			return
+		}
+	}
+	// 非阻塞发送，发送队列已满的慢连接计入失败，不阻塞整个请求
+	sent, failed := 0, 0
+	for _, conn := range a.server.GetConnManager().All() {
+		if err := conn.TrySendMsg(ziface.PriorityNormal, req.MsgID, data); err != nil {
+			failed++
+		} else {
+			sent++
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]int{"sent": sent, "failed": failed})
+}
+
+// worker任务队列的描述
+type adminWorkerInfo struct {
+	WorkerID int `json:"workerId"`
+	QueueLen int `json:"queueLen"`
+	QueueCap int `json:"queueCap"`
+}
+
+func (a *AdminServer) workers(w http.ResponseWriter, r *http.Request) {
+	mh, ok := a.server.MsgHandler.(*MsgHandler)
+	if !ok {
+		writeAdminError(w, http.StatusNotImplemented, "unsupported msg handler")
+		return
+	}
+	infos := make([]adminWorkerInfo, 0, len(mh.TaskQueue))
+	for i, queueLen := range mh.GetTaskQueueLens() {
+		infos = append(infos, adminWorkerInfo{WorkerID: i, QueueLen: queueLen, QueueCap: int(mh.MaxTaskLen)})
+	}
+	writeAdminJSON(w, http.StatusOK, infos)
+}
+
+func (a *AdminServer) routers(w http.ResponseWriter, r *http.Request) {
+	mh, ok := a.server.MsgHandler.(*MsgHandler)
+	if !ok {
+		writeAdminError(w, http.StatusNotImplemented, "unsupported msg handler")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, mh.GetRoutes())
+}
+
+func (a *AdminServer) metrics(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"conns":   a.server.GetConnManager().Size(),
+		"maxConn": a.server.GetConnManager().GetMaxConn(),
+		"metrics": a.server.Metrics.Snapshot(),
+	})
+}
+
+func (a *AdminServer) topics(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, a.server.PubSub.GetTopicStats())
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,86 @@
+package znet
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+	管理接口的测试
+*/
+
+func TestAdminServer(t *testing.T) {
+	s := NewServer("admin-test", WithPriorityLanes(1, nil, 0))
+	s.AddRouter(10, &BaseRouter{})
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(s, server, 7, s.MsgHandler)
+	conn.SetProperty("userID", uint(42))
+	s.GetConnManager().SetConnByUserID(7, 42)
+
+	h := NewAdminServer(s, "secret").Handler()
+	do := func(method, path, body string, v interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if v != nil {
+			json.Unmarshal(w.Body.Bytes(), v)
+		}
+		return w.Code
+	}
+
+	// 没有token的请求被拒绝
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/conns", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthorized request got %d", w.Code)
+	}
+
+	var conns []AdminConnInfo
+	if code := do("GET", "/conns", "", &conns); code != http.StatusOK || len(conns) != 1 || conns[0].UserID != 42 {
+		t.Fatalf("list conns got %d %+v", code, conns)
+	}
+	if code := do("GET", "/conns/8", "", nil); code != http.StatusNotFound {
+		t.Fatalf("show missing conn got %d", code)
+	}
+	var routes []RouteInfo
+	if do("GET", "/routers", "", &routes); len(routes) == 0 {
+		t.Fatal("no routers listed")
+	}
+	// 连接没有启动，发送队列满了之后广播不阻塞，计入失败
+	var result map[string]int
+	for i := 0; i < 3; i++ {
+		if code := do("POST", "/broadcast", `{"msgId": 30, "data": "hi"}`, &result); code != http.StatusOK {
+			t.Fatalf("broadcast got %d", code)
+		}
+	}
+	if result["sent"] != 0 || result["failed"] != 1 {
+		t.Fatalf("broadcast to full queue got %v", result)
+	}
+	if code := do("DELETE", "/users/42", "", nil); code != http.StatusOK || s.GetConnManager().Size() != 0 {
+		t.Fatalf("kick user got %d, conns = %d", code, s.GetConnManager().Size())
+	}
+}
+
+// 没有token的管理接口只能监听在本地回环地址
+func TestAdminServerRequiresTokenOffLoopback(t *testing.T) {
+	s := NewServer("admin-test")
+	if err := NewAdminServer(s, "").Start("0.0.0.0:0"); err == nil {
+		t.Fatal("admin api without token should not listen on all addresses")
+	}
+	local := NewAdminServer(s, "")
+	if err := local.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	local.Stop()
+	remote := NewAdminServer(s, "secret")
+	if err := remote.Start("0.0.0.0:0"); err != nil {
+		t.Fatal(err)
+	}
+	remote.Stop()
+}
@@ -0,0 +1,184 @@
+package znet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	连接认证
+	设置Authenticator之后，连接在认证之前只有白名单中的消息(登录、心跳)会交给路由处理，
+	登录消息由Authenticator校验，成功后通过ConnManager绑定userID，
+	连接需要在AuthTimeout内完成认证，否则会被关闭
+*/
+
+// 函数形式的Authenticator
+type AuthFunc func(request ziface.IRequest) (*ziface.AuthInfo, error)
+
+func (f AuthFunc) Authenticate(request ziface.IRequest) (*ziface.AuthInfo, error) {
+	return f(request)
+}
+
+// 使用HMAC签名token进行认证，登录消息的内容即为token
+// token格式: userID.角色.过期时间(unix秒).base64url(HMAC-SHA256(userID.角色.过期时间))
+// 角色为base64url编码的JSON字符串数组，没有角色时为空
+type HMACTokenAuthenticator struct {
+	Secret []byte
+}
+
+// 签发一个HMAC签名token，roles随token签名，认证之后用于权限检查
+func NewHMACToken(secret []byte, userID uint, roles []string, ttl time.Duration) string {
+	var encodedRoles string
+	if len(roles) > 0 {
+		data, _ := json.Marshal(roles)
+		encodedRoles = base64.RawURLEncoding.EncodeToString(data)
+	}
+	payload := fmt.Sprintf("%d.%s.%d", userID, encodedRoles, time.Now().Add(ttl).Unix())
+	return payload + "." + signHMACToken(secret, payload)
+}
+
+func signHMACToken(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *HMACTokenAuthenticator) Authenticate(request ziface.IRequest) (*ziface.AuthInfo, error) {
+	parts := strings.Split(string(request.GetData()), ".")
+	if len(parts) != 4 {
+		return nil, errors.New("malformed token")
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(signHMACToken(a.Secret, payload)), []byte(parts[3])) {
+		return nil, errors.New("invalid token signature")
+	}
+	expire, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed token expire time")
+	}
+	if time.Now().Unix() > expire {
+		return nil, errors.New("token expired")
+	}
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed token userID")
+	}
+	var roles []string
+	if parts[1] != "" {
+		data, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || json.Unmarshal(data, &roles) != nil {
+			return nil, errors.New("malformed token roles")
+		}
+	}
+	return &ziface.AuthInfo{UserID: uint(userID), Roles: roles}, nil
+}
+
+// 认证配置，设置之后不再修改
+type authConfig struct {
+	authenticator ziface.IAuthenticator
+	// 登录消息的ID
+	loginMsgID uint32
+	// 认证之前允许处理的消息ID
+	whitelist map[uint32]bool
+}
+
+// 设置认证器，loginMsgID为登录消息的ID，whitelist为认证之前允许处理的其他消息ID，auth为nil时关闭认证
+// 登录消息、心跳消息以及会话恢复和可靠投递确认的系统消息默认在白名单中，可以在Server运行时调用
+func (mh *MsgHandler) SetAuthenticator(auth ziface.IAuthenticator, loginMsgID uint32, whitelist ...uint32) {
+	if auth == nil {
+		mh.auth.Store(nil)
+		return
+	}
+	conf := &authConfig{authenticator: auth, loginMsgID: loginMsgID}
+	conf.whitelist = map[uint32]bool{
+		loginMsgID:        true,
+		utils.PING_MSG_ID: true,
+		utils.PONG_MSG_ID: true,
+		// 恢复会话后恢复原来的认证状态
+		utils.RESUME_MSG_ID:       true,
+		utils.RELIABLE_ACK_MSG_ID: true,
+	}
+	for _, msgID := range whitelist {
+		conf.whitelist[msgID] = true
+	}
+	mh.auth.Store(conf)
+}
+
+// 获取认证器，没有设置时返回nil
+func (mh *MsgHandler) GetAuthenticator() ziface.IAuthenticator {
+	if conf := mh.auth.Load(); conf != nil {
+		return conf.authenticator
+	}
+	return nil
+}
+
+// 认证检查，返回请求是否可以继续交给路由处理
+func (mh *MsgHandler) checkAuth(request ziface.IRequest) bool {
+	conn := request.GetConnection()
+	conf := mh.auth.Load()
+	if conf == nil || conn.IsAuthenticated() {
+		return true
+	}
+
+	msgID := request.GetMsgID()
+	if msgID == conf.loginMsgID {
+		info, err := conf.authenticator.Authenticate(request)
+		if err != nil {
+			fmt.Println("ConnID = ", conn.GetConnID(), " authenticate failed: ", err)
+			SendErrorReply(conn, ErrCodeAuthFailed, msgID, err.Error())
+			return false
+		}
+		conn.SetAuthenticated(info)
+		data, _ := json.Marshal(map[string]uint{"userId": info.UserID})
+		conn.SendMsg(utils.AUTH_OK_MSG_ID, data)
+		// 登录消息如果注册了业务路由，继续交给业务处理
+		_, ok := mh.GetRouter(msgID)
+		return ok
+	}
+
+	if conf.whitelist[msgID] {
+		return true
+	}
+	fmt.Println("ConnID = ", conn.GetConnID(), " is not authenticated, drop msgID = ", msgID)
+	SendErrorReply(conn, ErrCodeUnauthenticated, msgID, "unauthenticated")
+	return false
+}
+
+// 连接是否已经完成认证
+func (c *Connection) IsAuthenticated() bool {
+	return atomic.LoadInt32(&c.authenticated) == 1
+}
+
+// 标记连接完成认证，并通过ConnManager绑定userID，角色保存在连接属性中
+func (c *Connection) SetAuthenticated(info *ziface.AuthInfo) {
+	c.SetProperty("userID", info.UserID)
+	c.SetProperty(RolesProperty, info.Roles)
+	c.TCPServer.GetConnManager().SetConnByUserID(c.ConnID, info.UserID)
+	atomic.StoreInt32(&c.authenticated, 1)
+	fmt.Printf("ConnID = %d authenticated, UserID = %d\n", c.ConnID, info.UserID)
+}
+
+// 开启认证时，连接需要在期限内完成认证，否则关闭连接
+func (c *Connection) startAuthDeadline() {
+	if c.MsgHandler.GetAuthenticator() == nil || c.conf.AuthTimeout <= 0 {
+		return
+	}
+	c.AfterFunc(time.Duration(c.conf.AuthTimeout)*time.Second, func() {
+		if !c.IsAuthenticated() {
+			fmt.Printf("认证超时，关闭连接 ConnID=%d, IP=%s\n", c.ConnID, c.RemoteAddr().String())
+			c.StopAndDiscardSession()
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package znet
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	消息压缩
+	内置标准库的deflate和gzip算法，其他算法可以实现ICompressor后通过RegisterCompressor注册
+*/
+
+var (
+	compressors    = make(map[string]ziface.ICompressor)
+	compressorLock sync.RWMutex
+)
+
+func init() {
+	RegisterCompressor(&DeflateCompressor{})
+	RegisterCompressor(&GzipCompressor{})
+}
+
+// 注册一个压缩算法，同名的算法会被覆盖
+func RegisterCompressor(c ziface.ICompressor) {
+	compressorLock.Lock()
+	defer compressorLock.Unlock()
+	compressors[c.Name()] = c
+}
+
+// 根据名称获取压缩算法
+func GetCompressor(name string) (ziface.ICompressor, error) {
+	compressorLock.RLock()
+	defer compressorLock.RUnlock()
+	if c, ok := compressors[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("compressor %s is not registered", name)
+}
+
+// 从r中读取解压后的数据，超过maxSize时返回错误，用于防止压缩炸弹
+func readLimited(r io.Reader, maxSize uint32) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(data)) > maxSize {
+		return nil, fmt.Errorf("decompressed msg data exceeds %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// deflate压缩算法
+type DeflateCompressor struct{}
+
+func (dc *DeflateCompressor) Name() string {
+	return "deflate"
+}
+
+func (dc *DeflateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (dc *DeflateCompressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// gzip压缩算法
+type GzipCompressor struct{}
+
+func (gc *GzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gc *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gc *GzipCompressor) Decompress(data []byte, maxSize uint32) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
@@ -1,29 +1,56 @@
 package znet
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Xaytick/zinx/utils"
 	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// 连接已经停止，消息没有进入发送队列
+	ErrConnClosed = errors.New("connection closed")
+	// 非阻塞发送时发送队列已满
+	ErrSendQueueFull = errors.New("send queue full")
 )
 
 type Connection struct {
 	// 当前连接隶属于的Server
 	TCPServer ziface.IServer
-	// 当前连接的socket TCP套接字
+	// 当前连接的socket TCP套接字，不是TCP连接时为nil
 	Conn *net.TCPConn
+	// 当前连接底层的连接，例如TCP套接字或者测试使用的内存管道
+	rawConn net.Conn
+	// 实际收发数据使用的连接，开启会话加密后为加密连接
+	stream net.Conn
+	// 当前连接使用的配置，来自所属的Server
+	conf *utils.GlobalObj
+	// 当前连接的封包拆包工具，协议握手之后按照协商的结果创建
+	packet ziface.IDataPack
+	// 所属Server的运行指标
+	metrics *Metrics
 	// 当前连接的ID 也可以称作为SessionID，ID全局唯一
 	ConnID uint32
-	// 当前连接的关闭状态
-	isClosed bool
+	// 当前连接的关闭状态，Stop可能被读goroutine、时间轮和其他连接的路由并发调用，只有第一次调用生效
+	isClosed atomic.Bool
 	// 告知当前连接已经退出/停止的channel
 	ExitChan chan bool
-	// 无缓冲管道，用于读、写两个goroutine之间的消息通信
-	msgChan chan []byte
+	// 各个优先级的发送通道，写goroutine按权重从中取出消息发送
+	sendLanes [ziface.PriorityCount]chan laneFrame
+	// 保证检查通道空间和放入消息之间没有其他发送者放入消息，持有期间不会阻塞
+	laneLocks [ziface.PriorityCount]sync.Mutex
+	// 写goroutine从通道中取出消息之后发出的通知，唤醒等待空间的发送者
+	laneFreed [ziface.PriorityCount]chan struct{}
+	// 写goroutine退出并且交回了没有发送的会话消息之后关闭
+	writerDone chan struct{}
 	// 消息管理MsgId和对应处理方法的消息管理模块
 	MsgHandler ziface.IMsgHandler
 	// 连接属性集合
@@ -32,21 +59,80 @@ type Connection struct {
 	propertyLock sync.RWMutex
 	// 最后一次活动时间
 	lastActivityTime time.Time
+	// 服务端主动心跳测量的RTT统计
+	rttStats ziface.RTTStats
+	// 保护rttStats的锁
+	rttLock sync.Mutex
+	// 连接上通过时间轮调度的定时器，连接停止时全部取消
+	timers map[*connTimer]struct{}
+	// 保护timers的锁
+	timerLock sync.Mutex
+	// 是否已经完成认证，1表示已认证
+	authenticated int32
+	// 发送大消息时分配分片ID的计数
+	fragID uint32
+	// 接收分片消息的重组器，只在读goroutine中使用
+	reassembler *Reassembler
+	// 连接握手时协商的协议信息
+	protocol ziface.ProtocolInfo
+	// 协议违规分数
+	violations int32
+	// 所属Server的会话管理器，没有开启会话恢复时为nil
+	sessions *SessionManager
+	// 连接当前绑定的会话，由sessions的锁保护
+	session *session
+	// 所属Server的发布订阅管理器，连接停止时取消所有订阅
+	pubsub *PubSub
+	// 所属Server的可靠投递管理器
+	reliableMgr *ReliableManager
+	// 可靠投递状态，恢复会话时替换为会话中保留的状态
+	reliable atomic.Pointer[reliableState]
+	// 对端是否能够解析链路追踪扩展头，协议握手协商了FeatureTrace或者收到过携带追踪上下文的消息时为true
+	peerTrace atomic.Bool
+	// 连接的上下文，连接停止时取消
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewConnection(server ziface.IServer, conn *net.TCPConn, connID uint32, msgHandler ziface.IMsgHandler) *Connection {
+// 创建一个连接，conn通常是*net.TCPConn，也可以是任意的net.Conn
+func NewConnection(server ziface.IServer, conn net.Conn, connID uint32, msgHandler ziface.IMsgHandler) *Connection {
+
+	// 使用所属Server的配置和运行指标，没有时使用全局配置
+	conf, metrics := utils.GlobalObject, &Metrics{}
+	var sessions *SessionManager
+	var reliableMgr *ReliableManager
+	var pubsub *PubSub
+	if s, ok := server.(*Server); ok {
+		conf, metrics, sessions, reliableMgr, pubsub = s.Config, s.Metrics, s.Sessions, s.Reliable, s.PubSub
+	}
 
 	c := &Connection{
 		TCPServer:        server,
-		Conn:             conn,
+		rawConn:          conn,
+		stream:           conn,
+		conf:             conf,
+		packet:           server.GetPacket(),
+		metrics:          metrics,
+		sessions:         sessions,
+		reliableMgr:      reliableMgr,
+		pubsub:           pubsub,
 		ConnID:           connID,
 		MsgHandler:       msgHandler,
-		isClosed:         false,
 		ExitChan:         make(chan bool, 1),
-		msgChan:          make(chan []byte),
+		writerDone:       make(chan struct{}),
 		property:         make(map[string]interface{}),
 		lastActivityTime: time.Now(), // 初始化时记录当前时间
+		timers:           make(map[*connTimer]struct{}),
+		reassembler:      NewReassembler(conf.ReassemblyLimit(), time.Duration(conf.ReassemblyTimeout)*time.Second),
+	}
+	for i := range c.sendLanes {
+		// 发送通道至少需要一个缓冲，发送者只在通道有空间时放入消息
+		c.sendLanes[i] = make(chan laneFrame, max(conf.SendQueueSize, 1))
+		c.laneFreed[i] = make(chan struct{}, 1)
 	}
+	c.Conn, _ = conn.(*net.TCPConn)
+	c.reliable.Store(&reliableState{})
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	// 将新创建的Conn添加到链接管理中
 	c.Register()
 	return c
@@ -68,19 +154,55 @@ func (c *Connection) UnRegister() {
 func (c *Connection) StartWriter() {
 	fmt.Println("Writer Goroutine is running")
 	defer fmt.Println(c.RemoteAddr().String(), "conn writer exit!")
-	// 不断的阻塞等待channel的消息，进行写给客户端
+	// 按优先级和权重从发送通道中取出消息，进行写给客户端
+	scheduler := newLaneScheduler(&c.sendLanes, c.conf.PriorityWeights,
+		time.Duration(c.conf.StarvationTimeout)*time.Millisecond)
+	scheduler.freed = &c.laneFreed
+	var unsent []laneFrame
+	defer func() {
+		c.drainLanes(append(unsent, scheduler.takeHeads()...))
+	}()
 	for {
-		select {
-		case data := <-c.msgChan:
-			// 有数据要写给客户端
-			if _, err := c.Conn.Write(data); err != nil {
-				fmt.Println("Send data error", err)
-				return
-			}
-		case <-c.ExitChan:
+		frame, ok := scheduler.next(c.ExitChan)
+		if !ok {
 			// 代表Reader已经退出，此时Writer也要退出
 			return
 		}
+		// 有数据要写给客户端
+		if _, err := c.stream.Write(frame.data); err != nil {
+			fmt.Println("Send data error", err)
+			unsent = append(unsent, frame)
+			// 关闭socket，由Reader退出并停止连接
+			c.rawConn.Close()
+			return
+		}
+		// 会话消息按照实际写入连接的顺序编号，和客户端收到消息的顺序一致
+		if frame.entry != nil {
+			c.sessions.written(frame.entry)
+		}
+	}
+}
+
+// 连接停止后取出发送通道中剩余的帧，没有写入的会话消息交回会话，恢复会话后重放
+func (c *Connection) drainLanes(frames []laneFrame) {
+	defer close(c.writerDone)
+	<-c.ctx.Done()
+	for i := range c.sendLanes {
+		// 连接停止之后发送者不会再放入消息
+		c.laneLocks[i].Lock()
+		for len(c.sendLanes[i]) > 0 {
+			frames = append(frames, <-c.sendLanes[i])
+		}
+		c.laneLocks[i].Unlock()
+	}
+	var entries []*sessionEntry
+	for _, frame := range frames {
+		if frame.entry != nil {
+			entries = append(entries, frame.entry)
+		}
+	}
+	if len(entries) > 0 {
+		c.sessions.unsent(entries)
 	}
 }
 
@@ -91,17 +213,19 @@ func (c *Connection) StartReader() {
 	defer c.Stop()
 
 	for {
-		// 创建一个拆包解包的对象
-		dp := NewDataPack()
+		// 获取Server共用的拆包解包对象
+		dp := c.packet
 		// 读取客户端的Msg head, 8个字节的二进制流
 		headData := make([]byte, dp.GetHeadLen())
-		if _, err := io.ReadFull(c.GetTCPConnection(), headData); err != nil {
+		if _, err := io.ReadFull(c.stream, headData); err != nil {
 			fmt.Println("read msg head error ", err)
 			break
 		}
 		// 拆包，放在一个msg中
 		msg, err := dp.Unpack(headData)
 		if err != nil {
+			// 消息头损坏时无法确定消息边界，只能关闭连接
+			c.onChecksumMismatch(err, false)
 			fmt.Println("server unpack err ", err)
 			break
 		}
@@ -109,23 +233,56 @@ func (c *Connection) StartReader() {
 		var data []byte
 		if msg.GetMsgLen() > 0 {
 			data = make([]byte, msg.GetMsgLen())
-			if _, err := io.ReadFull(c.GetTCPConnection(), data); err != nil {
+			if _, err := io.ReadFull(c.stream, data); err != nil {
 				fmt.Println("read msg data error ", err)
 				break
 			}
 		}
 		msg.SetData(data)
+		// 校验并还原消息体，例如解压缩
+		if err := dp.UnpackData(msg); err != nil {
+			if c.onChecksumMismatch(err, true) {
+				continue
+			}
+			fmt.Println("server unpack data err ", err)
+			break
+		}
+		// 分片交给重组器，消息还没有重组完成时继续读取下一个分片
+		if msg.GetFlags()&MsgFlagFragment != 0 {
+			if msg, err = c.reassembler.Add(msg); err != nil {
+				fmt.Println("server reassemble msg err ", err)
+				break
+			}
+			if msg == nil {
+				c.UpdateActivity()
+				continue
+			}
+			if err := dp.UnpackData(msg); err != nil {
+				fmt.Println("server unpack data err ", err)
+				break
+			}
+		}
 
 		// 更新最后活动时间
 		c.UpdateActivity()
+		// 可靠消息回复确认，重复收到的不再处理
+		if seq := msg.GetSeq(); seq != 0 && !c.receiveReliable(seq) {
+			continue
+		}
 
 		// 得到当前连接的Request
 		req := Request{
 			conn: c,
 			msg:  msg,
+			ctx:  c.ctx,
+		}
+		// 上游携带的链路追踪上下文放入请求的上下文，发送消息时继续传递
+		if trace := msg.GetTrace(); trace.IsValid() {
+			req.ctx = ContextWithTrace(c.ctx, trace)
+			c.peerTrace.Store(true)
 		}
 		// 从路由中找到注册绑定的Conn对应的MsgHandler调用
-		if utils.GlobalObject.WorkerPoolSize > 0 {
+		if c.MsgHandler.GetWorkerPoolSize() > 0 {
 			// 已经启动工作池机制，将消息交给Worker处理
 			c.MsgHandler.SendMsgToTaskQueue(&req)
 		} else {
@@ -135,30 +292,110 @@ func (c *Connection) StartReader() {
 	}
 }
 
-// 心跳检测
-func (c *Connection) startHeartbeat() {
-	// 心跳检测间隔
-	interval := time.Duration(utils.GlobalObject.HeartbeatInterval) * time.Second
-	// 心跳超时时间
-	timeout := time.Duration(utils.GlobalObject.HeartbeatTimeout) * time.Second
+// 处理校验和不匹配，返回是否只丢弃当前消息并继续读取
+// 只有消息体损坏时canDrop为true，此时消息边界仍然是可信的
+func (c *Connection) onChecksumMismatch(err error, canDrop bool) bool {
+	if !errors.Is(err, ErrChecksumMismatch) {
+		return false
+	}
+	c.metrics.incChecksumMismatches()
+	if canDrop && c.conf.ChecksumMismatchAction == "drop" {
+		c.metrics.incDroppedMsgs()
+		fmt.Println("ConnID = ", c.ConnID, " drop msg: ", err)
+		return true
+	}
+	return false
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// 启动心跳检测，检测任务由Server共用的时间轮调度
+func (c *Connection) startHeartbeat() {
+	interval, _ := c.TCPServer.GetHeartbeatConfig()
+	c.AfterFunc(interval, c.checkHeartbeat)
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			// 检查最后活动时间，如果超时则关闭连接
-			if time.Since(c.lastActivityTime) > timeout {
-				fmt.Printf("心跳超时，关闭连接 ConnID=%d, IP=%s, 最后活动: %s\n",
-					c.ConnID, c.RemoteAddr().String(), c.lastActivityTime.Format("2006-01-02 15:04:05"))
-				c.Stop()
-				return
-			}
-		case <-c.ExitChan:
-			// 连接已关闭，退出心跳检测
+// 心跳检测，每次检测完成后按照最新的检测间隔重新调度，配置热加载后在下一次检测时生效
+func (c *Connection) checkHeartbeat() {
+	interval, timeout := c.TCPServer.GetHeartbeatConfig()
+	// 检查最后活动时间，如果超时则关闭连接
+	lastActivityTime := c.GetLastActivityTime()
+	if time.Since(lastActivityTime) > timeout {
+		fmt.Printf("心跳超时，关闭连接 ConnID=%d, IP=%s, 最后活动: %s\n",
+			c.ConnID, c.RemoteAddr().String(), lastActivityTime.Format("2006-01-02 15:04:05"))
+		c.Stop()
+		return
+	}
+	// 服务端主动心跳，连续丢失的次数超过限制则关闭连接
+	if enabled, maxMissed := c.TCPServer.GetActiveHeartbeat(); enabled {
+		if missed := c.GetRTTStats().Missed; missed > maxMissed {
+			fmt.Printf("心跳连续丢失%d次，关闭连接 ConnID=%d, IP=%s\n",
+				missed, c.ConnID, c.RemoteAddr().String())
+			c.Stop()
 			return
 		}
+		if err := c.sendPing(); err != nil {
+			fmt.Println("发送心跳失败:", err)
+		}
+	}
+	c.AfterFunc(interval, c.checkHeartbeat)
+}
+
+// 连接上的定时器，触发或者取消之后从连接的定时器集合中移除
+type connTimer struct {
+	ziface.ITimer
+	conn *Connection
+}
+
+func (t *connTimer) Stop() bool {
+	t.conn.untrackTimer(t)
+	return t.ITimer.Stop()
+}
+
+// 在d时间之后执行一次f，连接停止时自动取消
+func (c *Connection) AfterFunc(d time.Duration, f func()) ziface.ITimer {
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+	timer := &connTimer{conn: c}
+	timer.ITimer = c.TCPServer.GetTimeWheel().AfterFunc(d, func() {
+		c.untrackTimer(timer)
+		f()
+	})
+	c.trackTimer(timer)
+	return timer
+}
+
+// 每隔d时间执行一次f，连接停止时自动取消
+func (c *Connection) Every(d time.Duration, f func()) ziface.ITimer {
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+	timer := &connTimer{ITimer: c.TCPServer.GetTimeWheel().Every(d, f), conn: c}
+	c.trackTimer(timer)
+	return timer
+}
+
+// 记录连接上的定时器，连接已经停止时直接取消，调用时需要持有timerLock
+func (c *Connection) trackTimer(timer *connTimer) {
+	if c.timers == nil {
+		timer.ITimer.Stop()
+		return
+	}
+	c.timers[timer] = struct{}{}
+}
+
+// 移除已经触发或者取消的定时器
+func (c *Connection) untrackTimer(timer *connTimer) {
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+	delete(c.timers, timer)
+}
+
+// 取消连接上所有的定时器
+func (c *Connection) stopTimers() {
+	c.timerLock.Lock()
+	timers := c.timers
+	c.timers = nil
+	c.timerLock.Unlock()
+	for timer := range timers {
+		timer.ITimer.Stop()
 	}
 }
 
@@ -178,54 +415,216 @@ func (c *Connection) GetLastActivityTime() time.Time {
 
 // 提供一个SendMsg方法，将我们要发送给客户端的数据，先进行封包，再发送
 func (c *Connection) SendMsg(msgId uint32, data []byte) error {
-	if c.isClosed {
-		return nil
+	return c.sendMsg(NewMsgPackage(msgId, data), ziface.PriorityNormal, true)
+}
+
+// 按优先级发送消息，高优先级的消息先于排队中的低优先级消息发送
+func (c *Connection) SendMsgWithPriority(priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	if priority >= ziface.PriorityCount {
+		return fmt.Errorf("invalid msg priority %d", priority)
 	}
-	// 将data进行封包
-	dp := NewDataPack()
-	binaryMsg, err := dp.Pack(NewMsgPackage(msgId, data))
+	return c.sendMsg(NewMsgPackage(msgId, data), priority, true)
+}
+
+// 非阻塞地按优先级发送消息，发送队列没有足够空间时返回ErrSendQueueFull，不等待
+// 用于向大量连接扇出消息，一个慢的连接不会阻塞调用者
+func (c *Connection) TrySendMsg(priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	return c.TrySendMsgContext(context.Background(), priority, msgId, data)
+}
+
+// 非阻塞地按优先级发送消息，并携带ctx中的链路追踪上下文
+func (c *Connection) TrySendMsgContext(ctx context.Context, priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	if priority >= ziface.PriorityCount {
+		return fmt.Errorf("invalid msg priority %d", priority)
+	}
+	msg := NewMsgPackage(msgId, data)
+	if trace, ok := TraceFromContext(ctx); ok {
+		msg.SetTrace(trace)
+	}
+	return c.sendMsg(msg, priority, false)
+}
+
+// 发送消息，并携带ctx中的链路追踪上下文
+func (c *Connection) SendMsgContext(ctx context.Context, msgId uint32, data []byte) error {
+	msg := NewMsgPackage(msgId, data)
+	if trace, ok := TraceFromContext(ctx); ok {
+		msg.SetTrace(trace)
+	}
+	return c.sendMsg(msg, ziface.PriorityNormal, true)
+}
+
+// 发送业务消息，block为false时发送队列已满直接返回ErrSendQueueFull
+func (c *Connection) sendMsg(msg ziface.IMessage, priority ziface.MsgPriority, block bool) error {
+	// 不能解析链路追踪扩展头的对端不携带追踪上下文
+	if msg.GetTrace().IsValid() && !c.peerTrace.Load() {
+		msg.SetTrace(ziface.TraceContext{})
+	}
+	if err := c.prepareReliable(msg, priority); err != nil {
+		return err
+	}
+	// 开启会话恢复时，消息写入连接之后记录到会话中，没有进入发送队列的消息不会在恢复会话时重放
+	var entry *sessionEntry
+	if c.sessions != nil {
+		entry = c.sessions.track(c, msg, priority)
+	}
+	if err := c.enqueueMsg(msg, entry, priority, block); err != nil {
+		// 没有进入发送队列的可靠消息不再等待确认，报告为投递失败
+		c.cancelReliable(msg)
+		return err
+	}
+	return nil
+}
+
+// 将系统消息封包后放入对应优先级的发送通道，不记录到会话中
+func (c *Connection) writeMsg(msg ziface.IMessage, priority ziface.MsgPriority) error {
+	return c.enqueueMsg(msg, nil, priority, true)
+}
+
+// 将消息封包后放入对应优先级的发送通道，entry不为nil时消息写入之后记录到会话中
+func (c *Connection) enqueueMsg(msg ziface.IMessage, entry *sessionEntry, priority ziface.MsgPriority, block bool) error {
+	frames, err := c.packMsg(msg)
 	if err != nil {
-		fmt.Println("Pack error msg id = ", msgId)
 		return err
 	}
-	// 将数据发送给channel
-	c.msgChan <- binaryMsg
+	return c.enqueue(frames, entry, priority, block)
+}
+
+// 将data进行封包，超过最大包长度的消息会被拆分为多个分片
+func (c *Connection) packMsg(msg ziface.IMessage) ([][]byte, error) {
+	if c.ctx.Err() != nil {
+		return nil, ErrConnClosed
+	}
+	dp := c.packet
+	frames, err := dp.PackFragments(msg, atomic.AddUint32(&c.fragID, 1))
+	if err != nil {
+		fmt.Println("Pack error msg id = ", msg.GetMsgId())
+		return nil, err
+	}
+	return frames, nil
+}
+
+// 将一个消息的所有帧放入对应优先级的发送通道，分片在同一个通道中保持顺序
+// block为false时通道没有足够空间直接返回ErrSendQueueFull，为true时等待写goroutine取出消息
+func (c *Connection) enqueue(frames [][]byte, entry *sessionEntry, priority ziface.MsgPriority, block bool) error {
+	lane := c.sendLanes[priority]
+	queued := time.Now()
+	for len(frames) > 0 {
+		// 只有写goroutine从通道中取出消息，持有锁期间空间只会增加，放入的帧不会阻塞
+		c.laneLocks[priority].Lock()
+		if c.ctx.Err() != nil {
+			// 连接已经停止，写goroutine不会再取出消息
+			c.laneLocks[priority].Unlock()
+			return ErrConnClosed
+		}
+		room := cap(lane) - len(lane)
+		if !block && room < len(frames) {
+			c.laneLocks[priority].Unlock()
+			return ErrSendQueueFull
+		}
+		n := min(room, len(frames))
+		for i, frame := range frames[:n] {
+			f := laneFrame{data: frame, queued: queued}
+			if i == len(frames)-1 {
+				f.entry = entry
+			}
+			lane <- f
+		}
+		c.laneLocks[priority].Unlock()
+		// 超过通道空间的大消息，等待写goroutine取出消息之后继续放入
+		if frames = frames[n:]; len(frames) > 0 {
+			select {
+			case <-c.laneFreed[priority]:
+			case <-c.ctx.Done():
+			}
+		}
+	}
 	return nil
 }
 
 func (c *Connection) Start() {
 	fmt.Println("Conn Start()... ConnID = ", c.ConnID)
+	// 在任何路由处理消息之前完成连接握手
+	if err := c.handshake(); err != nil {
+		fmt.Println("Conn handshake err:", err, "ConnID = ", c.ConnID)
+		c.abort()
+		return
+	}
 	// 启动当前连接的读数据业务
 	go c.StartReader()
 	// 启动当前连接的写数据业务
 	go c.StartWriter()
 	// 启动心跳检测
-	go c.startHeartbeat()
+	c.startHeartbeat()
+	// 开启认证时，连接需要在期限内完成认证
+	c.startAuthDeadline()
+	// 开启会话恢复时下发恢复token
+	if c.sessions != nil {
+		if err := c.sessions.issue(c); err != nil {
+			fmt.Println("issue session err:", err, "ConnID = ", c.ConnID)
+		}
+	}
 	// 按照开发者传递进来的创建连接时需要处理的业务，执行hook方法
 	c.TCPServer.CallOnConnStart(c)
 }
 
-// 停止连接，结束当前连接状态
+// 停止连接，结束当前连接状态，开启会话恢复时保留会话等待客户端重连
 func (c *Connection) Stop() {
+	c.stop(false)
+}
+
+// 停止连接并丢弃会话，客户端不能再恢复，用于踢下线和协议违规
+func (c *Connection) StopAndDiscardSession() {
+	c.stop(true)
+}
+
+func (c *Connection) stop(discardSession bool) {
 	fmt.Println("Conn Stop()... ConnID = ", c.ConnID)
 	// 如果当前连接已经关闭
-	if c.isClosed {
+	if !c.isClosed.CompareAndSwap(false, true) {
 		return
 	}
-	c.isClosed = true
+	// 取消连接的上下文和连接上所有的定时器
+	c.cancel()
+	c.stopTimers()
+	// 保留会话，等待客户端重连恢复，无法恢复或者丢弃会话时没有确认的可靠消息投递失败
+	if discardSession && c.sessions != nil {
+		c.sessions.discard(c)
+	}
+	if c.sessions == nil || !c.sessions.detach(c) {
+		c.failUnacked()
+	}
+	// 取消所有主题订阅
+	if c.pubsub != nil {
+		c.pubsub.UnsubscribeAll(c)
+	}
 	// 调用开发者注册的该连接的销毁之前需要处理的业务
 	c.TCPServer.CallOnConnStop(c)
 	// UnRegister方法解除当前连接的注册
 	c.UnRegister()
 	// 关闭socket连接
-	c.Conn.Close()
+	c.rawConn.Close()
 	// 告知Writer关闭
 	c.ExitChan <- true
 	// 回收资源
-	close(c.msgChan)
 	close(c.ExitChan)
 }
 
+// 握手失败时关闭连接，连接没有启动，不调用OnConnStop
+func (c *Connection) abort() {
+	if !c.isClosed.CompareAndSwap(false, true) {
+		return
+	}
+	c.cancel()
+	c.stopTimers()
+	c.UnRegister()
+	c.rawConn.Close()
+}
+
+// 获取连接的上下文，连接停止时被取消
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
 func (c *Connection) GetTCPConnection() *net.TCPConn {
 	return c.Conn
 }
@@ -235,7 +634,7 @@ func (c *Connection) GetConnID() uint32 {
 }
 
 func (c *Connection) RemoteAddr() net.Addr {
-	return c.Conn.RemoteAddr()
+	return c.rawConn.RemoteAddr()
 }
 
 func (c *Connection) Send(data []byte) error {
@@ -269,3 +668,14 @@ func (c *Connection) RemoveProperty(key string) {
 	// 删除属性
 	delete(c.property, key)
 }
+
+// 获取所有连接属性的副本
+func (c *Connection) GetProperties() map[string]interface{} {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+	properties := make(map[string]interface{}, len(c.property))
+	for key, value := range c.property {
+		properties[key] = value
+	}
+	return properties
+}
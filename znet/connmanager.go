@@ -2,8 +2,11 @@ package znet
 
 import (
 	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
 
+	"github.com/Xaytick/zinx/utils"
 	"github.com/Xaytick/zinx/ziface"
 )
 
@@ -13,6 +16,18 @@ type ConnManager struct {
 
 	userToConn map[uint]uint32 // userID (uint) -> connID (uint32)
 	userLock   sync.RWMutex    // 保护 userToConn
+
+	maxConn int64 // 允许的最大连接数，支持运行时修改
+
+	onUserBind    func(userID uint) // UserID绑定到连接时的Hook函数
+	onUserUnbind  func(userID uint) // UserID和连接解除绑定时的Hook函数
+	userListeners []*userListener   // 通过AddUserListener添加的监听函数，由userLock保护
+}
+
+// 一组UserID绑定和解除绑定的监听函数
+type userListener struct {
+	onBind   func(userID uint)
+	onUnbind func(userID uint)
 }
 
 // 创建ConnManager
@@ -20,9 +35,20 @@ func NewConnManager() *ConnManager {
 	return &ConnManager{
 		connections: make(map[uint32]ziface.IConnection),
 		userToConn:  make(map[uint]uint32),
+		maxConn:     int64(utils.GlobalObject.MaxConn),
 	}
 }
 
+// 设置允许的最大连接数
+func (cm *ConnManager) SetMaxConn(maxConn int) {
+	atomic.StoreInt64(&cm.maxConn, int64(maxConn))
+}
+
+// 获取允许的最大连接数
+func (cm *ConnManager) GetMaxConn() int {
+	return int(atomic.LoadInt64(&cm.maxConn))
+}
+
 // 添加连接
 func (cm *ConnManager) Add(conn ziface.IConnection) {
 	cm.connLock.Lock()
@@ -50,11 +76,16 @@ func (cm *ConnManager) Remove(conn ziface.IConnection) {
 		if userID, ok := userIDVal.(uint); ok {
 			cm.userLock.Lock()
 			// Check if the current connID in map matches the one being removed for this userID
-			if mappedConnID, userFound := cm.userToConn[userID]; userFound && mappedConnID == connID {
+			mappedConnID, userFound := cm.userToConn[userID]
+			unbound := userFound && mappedConnID == connID
+			if unbound {
 				delete(cm.userToConn, userID)
 				fmt.Println("UserID = ", userID, " removed from userToConn map.")
 			}
 			cm.userLock.Unlock()
+			if unbound {
+				cm.callOnUserUnbind(userID)
+			}
 		}
 	}
 
@@ -96,8 +127,15 @@ func (cm *ConnManager) ClearConns() {
 	cm.connLock.Unlock() // Release connLock before stopping connections
 
 	cm.userLock.Lock()
+	users := make([]uint, 0, len(cm.userToConn))
+	for userID := range cm.userToConn {
+		users = append(users, userID)
+	}
 	cm.userToConn = make(map[uint]uint32) // Clear userToConn map
 	cm.userLock.Unlock()                  // Release userLock
+	for _, userID := range users {
+		cm.callOnUserUnbind(userID)
+	}
 
 	// Now stop each connection. This will call Remove, which will try to lock, but it should be fine now.
 	for _, conn := range connsToStop {
@@ -133,23 +171,81 @@ func (cm *ConnManager) SetConnByUserID(connID uint32, userID uint) {
 	}
 
 	cm.userLock.Lock()
-	defer cm.userLock.Unlock()
 	cm.userToConn[userID] = connID
+	onUserBind := cm.onUserBind
+	listeners := cm.userListeners
+	cm.userLock.Unlock()
 	fmt.Printf("Associated UserID %d with ConnID %d\n", userID, connID)
+	if onUserBind != nil {
+		onUserBind(userID)
+	}
+	for _, l := range listeners {
+		if l.onBind != nil {
+			l.onBind(userID)
+		}
+	}
 }
 
 // 清除特定UserID的映射
 func (cm *ConnManager) ClearConnByUserID(userID uint) {
 	cm.userLock.Lock()
-	defer cm.userLock.Unlock()
-	if _, ok := cm.userToConn[userID]; ok {
-		delete(cm.userToConn, userID)
+	_, ok := cm.userToConn[userID]
+	delete(cm.userToConn, userID)
+	cm.userLock.Unlock()
+	if ok {
 		fmt.Printf("Cleared UserID %d from userToConn map.\n", userID)
+		cm.callOnUserUnbind(userID)
 	} else {
 		fmt.Printf("ClearConnByUserID: UserID %d not found in userToConn map.\n", userID)
 	}
 }
 
+// 注册UserID绑定到连接时的Hook函数，运行期间也可以修改，Hook函数在锁外调用
+func (cm *ConnManager) SetOnUserBind(hookFunc func(userID uint)) {
+	cm.userLock.Lock()
+	defer cm.userLock.Unlock()
+	cm.onUserBind = hookFunc
+}
+
+// 注册UserID和连接解除绑定时的Hook函数，运行期间也可以修改，Hook函数在锁外调用
+func (cm *ConnManager) SetOnUserUnbind(hookFunc func(userID uint)) {
+	cm.userLock.Lock()
+	defer cm.userLock.Unlock()
+	cm.onUserUnbind = hookFunc
+}
+
+// 添加一组UserID绑定和解除绑定的监听函数，多个模块可以同时监听，监听函数在锁外调用
+func (cm *ConnManager) AddUserListener(onBind, onUnbind func(userID uint)) (remove func()) {
+	l := &userListener{onBind: onBind, onUnbind: onUnbind}
+	cm.userLock.Lock()
+	defer cm.userLock.Unlock()
+	// 每次修改都创建新的切片，调用监听函数时使用的旧切片不受影响
+	cm.userListeners = append(slices.Clip(cm.userListeners), l)
+	return func() {
+		cm.userLock.Lock()
+		defer cm.userLock.Unlock()
+		if i := slices.Index(cm.userListeners, l); i >= 0 {
+			cm.userListeners = slices.Delete(slices.Clone(cm.userListeners), i, i+1)
+		}
+	}
+}
+
+// 调用UserID解除绑定的Hook函数和监听函数
+func (cm *ConnManager) callOnUserUnbind(userID uint) {
+	cm.userLock.RLock()
+	onUserUnbind := cm.onUserUnbind
+	listeners := cm.userListeners
+	cm.userLock.RUnlock()
+	if onUserUnbind != nil {
+		onUserUnbind(userID)
+	}
+	for _, l := range listeners {
+		if l.onUnbind != nil {
+			l.onUnbind(userID)
+		}
+	}
+}
+
 // 根据UserID获取连接 (Optimized with userToConn map)
 func (cm *ConnManager) GetConnByUserID(userID uint) ziface.IConnection {
 	cm.userLock.RLock()
@@ -3,6 +3,10 @@ package znet
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
 
 	"github.com/Xaytick/zinx/utils"
 	"github.com/Xaytick/zinx/ziface"
@@ -22,23 +26,132 @@ PASS
 ok      zinx/znet       0.639s
 */
 type DataPack struct {
+	// 允许的最大数据包长度，0表示不限制，支持运行时修改，按协议握手派生的DataPack共享同一个值
+	maxPackageSize *atomic.Uint32
+	// 消息压缩算法，nil表示不压缩
+	compressor ziface.ICompressor
+	// 消息体达到该长度时才进行压缩
+	compressThreshold uint32
+	// 解压后的消息体最大长度，防止压缩炸弹
+	maxDecompressSize uint32
+	// 是否在消息头中携带CRC32C校验和
+	checksum bool
 }
 
+// 校验和不匹配时返回的错误
+var ErrChecksumMismatch = errors.New("msg checksum mismatch")
+
+// CRC32C(Castagnoli)校验表
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 消息头中长度字段的低24位表示消息体长度，高8位为消息标志位
+const (
+	msgLenMask   uint32 = 1<<24 - 1
+	msgFlagShift        = 24
+)
+
 func NewDataPack() *DataPack {
-	return &DataPack{}
+	// 从全局配置中获取
+	return NewDataPackWithConfig(utils.GlobalObject)
+}
+
+// 使用指定的配置创建DataPack
+func NewDataPackWithConfig(conf *utils.GlobalObj) *DataPack {
+	dp := &DataPack{
+		maxPackageSize: new(atomic.Uint32),
+		checksum:       conf.FrameChecksum,
+	}
+	dp.maxPackageSize.Store(conf.MaxPackageSize)
+	if conf.Compression != "" {
+		compressor, err := GetCompressor(conf.Compression)
+		if err != nil {
+			fmt.Println("[zinx] compression disabled:", err)
+		} else {
+			dp.SetCompression(compressor, conf.CompressThreshold, conf.MaxDecompressSize)
+		}
+	}
+	return dp
+}
+
+// 按照协议握手协商的压缩算法和校验和创建DataPack，其他设置使用conf
+func NewDataPackWithProtocol(conf *utils.GlobalObj, info ziface.ProtocolInfo) *DataPack {
+	negotiated := *conf
+	negotiated.Compression = info.Compression
+	negotiated.FrameChecksum = info.Checksum
+	return NewDataPackWithConfig(&negotiated)
+}
+
+// 按照协议握手协商的压缩算法和校验和派生一个DataPack，压缩阈值等其他设置和dp相同，
+// 最大数据包长度和dp共享，运行时修改dp的最大数据包长度时同时生效
+func (dp *DataPack) WithProtocol(info ziface.ProtocolInfo) *DataPack {
+	derived := &DataPack{
+		maxPackageSize: dp.maxPackageSize,
+		checksum:       info.Checksum,
+	}
+	if info.Compression != "" {
+		compressor, err := GetCompressor(info.Compression)
+		if err != nil {
+			fmt.Println("[zinx] compression disabled:", err)
+		} else {
+			derived.SetCompression(compressor, dp.compressThreshold, dp.maxDecompressSize)
+		}
+	}
+	return derived
+}
+
+// 设置消息压缩算法，消息体达到threshold时进行压缩，解压后的长度不能超过maxDecompressSize
+// compressor为nil时关闭压缩，需要在使用DataPack之前设置
+func (dp *DataPack) SetCompression(compressor ziface.ICompressor, threshold, maxDecompressSize uint32) {
+	if maxDecompressSize == 0 || maxDecompressSize > msgLenMask {
+		maxDecompressSize = msgLenMask
+	}
+	dp.compressor = compressor
+	dp.compressThreshold = threshold
+	dp.maxDecompressSize = maxDecompressSize
+}
+
+// 设置是否在消息头中携带CRC32C校验和，通信双方的设置必须一致，需要在使用DataPack之前设置
+func (dp *DataPack) SetChecksum(enabled bool) {
+	dp.checksum = enabled
+}
+
+// 设置允许的最大数据包长度
+func (dp *DataPack) SetMaxPackageSize(size uint32) {
+	dp.maxPackageSize.Store(size)
+}
+
+// 获取允许的最大数据包长度
+func (dp *DataPack) GetMaxPackageSize() uint32 {
+	return dp.maxPackageSize.Load()
 }
 
 func (dp *DataPack) GetHeadLen() uint32 {
-	//DataLen uint32(4字节) + ID uint32(4字节)
+	//DataLen uint32(4字节，高8位为标志位) + ID uint32(4字节)
+	//开启校验和时再加上 消息头校验和 uint32(4字节) + 消息体校验和 uint32(4字节)
+	if dp.checksum {
+		return 16
+	}
 	return 8
 }
 
 func (dp *DataPack) Pack(msg ziface.IMessage) ([]byte, error) {
+	// 分片在拆分之前已经整体编码过，不再单独处理
+	data, flags := msg.GetData(), msg.GetFlags()
+	if flags&MsgFlagFragment == 0 {
+		var err error
+		if data, flags, err = dp.encodeBody(msg); err != nil {
+			return nil, err
+		}
+	}
+	if uint32(len(data)) > msgLenMask {
+		return nil, errors.New("Too large msg data to pack")
+	}
+
 	//创建一个存放bytes字节的缓冲
-	databuf := bytes.NewBuffer([]byte{})
+	databuf := bytes.NewBuffer(make([]byte, 0, int(dp.GetHeadLen())+len(data)))
 
-	// 将datalen写进databuf中
-	if err := binary.Write(databuf, binary.LittleEndian, msg.GetMsgLen()); err != nil {
+	// 将datalen和标志位写进databuf中
+	if err := binary.Write(databuf, binary.LittleEndian, uint32(len(data))|uint32(flags)<<msgFlagShift); err != nil {
 		return nil, err
 	}
 
@@ -47,34 +160,191 @@ func (dp *DataPack) Pack(msg ziface.IMessage) ([]byte, error) {
 		return nil, err
 	}
 
+	// 将消息头和消息体的校验和写进databuf中
+	if dp.checksum {
+		headCRC := crc32.Checksum(databuf.Bytes()[:8], crc32cTable)
+		if err := binary.Write(databuf, binary.LittleEndian, headCRC); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(databuf, binary.LittleEndian, crc32.Checksum(data, crc32cTable)); err != nil {
+			return nil, err
+		}
+	}
+
 	// 将data数据写进databuf中
-	if err := binary.Write(databuf, binary.LittleEndian, msg.GetData()); err != nil {
+	if err := binary.Write(databuf, binary.LittleEndian, data); err != nil {
 		return nil, err
 	}
 
 	return databuf.Bytes(), nil
 }
 
+// 编码消息体，先在消息体前依次加上可靠投递序号和链路追踪扩展头，再进行压缩
+func (dp *DataPack) encodeBody(msg ziface.IMessage) ([]byte, uint8, error) {
+	data, flags := msg.GetData(), msg.GetFlags()
+	seq, trace := msg.GetSeq(), msg.GetTrace()
+	addSeq := seq != 0 && flags&MsgFlagReliable == 0
+	addTrace := trace.IsValid() && flags&MsgFlagTrace == 0
+	if addSeq || addTrace {
+		buf := make([]byte, 0, seqExtLen+traceExtLen+len(data))
+		if addSeq {
+			buf = appendSeq(buf, seq)
+			flags |= MsgFlagReliable
+		}
+		if addTrace {
+			buf = appendTrace(buf, trace)
+			flags |= MsgFlagTrace
+		}
+		data = append(buf, data...)
+	}
+	return dp.compress(data, flags)
+}
+
+// 消息体达到阈值时进行压缩，压缩后没有变小则返回原始数据
+func (dp *DataPack) compress(data []byte, flags uint8) ([]byte, uint8, error) {
+	if dp.compressor == nil || flags&MsgFlagCompressed != 0 || uint32(len(data)) < dp.compressThreshold {
+		return data, flags, nil
+	}
+	compressed, err := dp.compressor.Compress(data)
+	if err != nil {
+		return nil, flags, err
+	}
+	if len(compressed) >= len(data) {
+		return data, flags, nil
+	}
+	return compressed, flags | MsgFlagCompressed, nil
+}
+
 // 拆包方法(将包的head信息读出来)之后再根据head信息里的data长度，再进行一次读包，将data读出来
 func (dp *DataPack) Unpack(binaryData []byte) (ziface.IMessage, error) {
 	// 创建一个从输入二进制数据的ioReader
 	databuf := bytes.NewReader(binaryData)
 	// 只解压head的信息，得到dataLen和msgID
 	msg := &Message{}
-	// 读dataLen
-	if err := binary.Read(databuf, binary.LittleEndian, &msg.DataLen); err != nil {
+	// 读dataLen和标志位
+	var lenAndFlags uint32
+	if err := binary.Read(databuf, binary.LittleEndian, &lenAndFlags); err != nil {
 		return nil, err
 	}
+	msg.DataLen = lenAndFlags & msgLenMask
+	msg.Flags = uint8(lenAndFlags >> msgFlagShift)
 
 	// 读msgID
 	if err := binary.Read(databuf, binary.LittleEndian, &msg.Id); err != nil {
 		return nil, err
 	}
 
+	// 校验消息头，消息头损坏时无法信任其中的长度，消息体的校验和在读取消息体之后校验
+	if dp.checksum {
+		var headCRC uint32
+		if err := binary.Read(databuf, binary.LittleEndian, &headCRC); err != nil {
+			return nil, err
+		}
+		if crc32.Checksum(binaryData[:8], crc32cTable) != headCRC {
+			return nil, errors.Wrap(ErrChecksumMismatch, "msg head")
+		}
+		if err := binary.Read(databuf, binary.LittleEndian, &msg.checksum); err != nil {
+			return nil, err
+		}
+		msg.checksumPending = true
+	}
+
 	// 判断DataLen是否已经超出了我们允许的最大包长度
-	if utils.GlobalObject.MaxPackageSize > 0 && msg.DataLen > utils.GlobalObject.MaxPackageSize {
+	if maxSize := dp.GetMaxPackageSize(); maxSize > 0 && msg.DataLen > maxSize {
 		return nil, errors.New("Too large msg data received")
 	}
 
 	return msg, nil
 }
+
+// 读取完消息体之后校验并还原消息体，压缩过的消息体在这里解压，并取出链路追踪扩展头
+// 分片只做校验，在重组完成之后再对完整的消息调用一次进行还原
+func (dp *DataPack) UnpackData(msg ziface.IMessage) error {
+	if m, ok := msg.(*Message); ok && m.checksumPending {
+		if crc32.Checksum(m.Data, crc32cTable) != m.checksum {
+			return errors.Wrap(ErrChecksumMismatch, "msg data")
+		}
+		m.checksumPending = false
+	}
+	if msg.GetFlags()&MsgFlagFragment != 0 {
+		return nil
+	}
+	if msg.GetFlags()&MsgFlagCompressed != 0 {
+		if dp.compressor == nil {
+			return errors.New("compressed msg received but compression is disabled")
+		}
+		data, err := dp.compressor.Decompress(msg.GetData(), dp.maxDecompressSize)
+		if err != nil {
+			return errors.Wrap(err, "decompress msg data")
+		}
+		msg.SetData(data)
+		msg.SetMsgLen(uint32(len(data)))
+		msg.SetFlags(msg.GetFlags() &^ MsgFlagCompressed)
+	}
+	if msg.GetFlags()&MsgFlagReliable != 0 {
+		if err := decodeSeq(msg); err != nil {
+			return err
+		}
+	}
+	if msg.GetFlags()&MsgFlagTrace != 0 {
+		return decodeTrace(msg)
+	}
+	return nil
+}
+
+// 封包并写入一个消息，用于连接建立阶段的握手以及客户端
+func WriteMsg(w io.Writer, dp ziface.IDataPack, msgID uint32, data []byte) error {
+	binaryMsg, err := dp.Pack(NewMsgPackage(msgID, data))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(binaryMsg)
+	return err
+}
+
+// 读取并拆包一个完整的消息，用于连接建立阶段的握手以及客户端
+func ReadMsg(r io.Reader, dp ziface.IDataPack) (ziface.IMessage, error) {
+	headData := make([]byte, dp.GetHeadLen())
+	if _, err := io.ReadFull(r, headData); err != nil {
+		return nil, err
+	}
+	msg, err := dp.Unpack(headData)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if msg.GetMsgLen() > 0 {
+		data = make([]byte, msg.GetMsgLen())
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+	}
+	msg.SetData(data)
+	if err := dp.UnpackData(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 读取一个完整的消息，分片交给reassembler重组，直到得到完整的消息，用于客户端和网关等自己读取连接的场景
+func ReadFullMsg(r io.Reader, dp ziface.IDataPack, reassembler *Reassembler) (ziface.IMessage, error) {
+	for {
+		msg, err := ReadMsg(r, dp)
+		if err != nil {
+			return nil, err
+		}
+		if msg.GetFlags()&MsgFlagFragment == 0 {
+			return msg, nil
+		}
+		if msg, err = reassembler.Add(msg); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		if err := dp.UnpackData(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
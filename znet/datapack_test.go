@@ -1,10 +1,18 @@
 package znet
 
 import (
+	"bytes"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
 )
 
 /*
@@ -110,4 +118,241 @@ func TestDataPack(t *testing.T) {
 	sendData1 = append(sendData1, sendData2...)
 	conn.Write(sendData1)
 
-}
\ No newline at end of file
+}
+
+/*
+	消息压缩的测试
+*/
+
+func TestDataPackCompression(t *testing.T) {
+	compressor, err := GetCompressor("gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := NewDataPack()
+	dp.SetMaxPackageSize(0)
+	dp.SetCompression(compressor, 64, 4096)
+
+	// 超过阈值的消息被压缩
+	data := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+	binaryMsg, err := dp.Pack(NewMsgPackage(3, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binaryMsg) >= len(data) {
+		t.Fatalf("msg not compressed, len = %d", len(binaryMsg))
+	}
+
+	msg, err := dp.Unpack(binaryMsg[:dp.GetHeadLen()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetFlags()&MsgFlagCompressed == 0 {
+		t.Fatal("compressed flag not set")
+	}
+	msg.SetData(binaryMsg[dp.GetHeadLen():])
+	if err := dp.UnpackData(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.GetData(), data) || msg.GetMsgLen() != uint32(len(data)) {
+		t.Fatal("decompressed data mismatch")
+	}
+
+	// 解压后超过上限的消息被拒绝
+	dp.SetCompression(compressor, 64, 100)
+	msg, _ = dp.Unpack(binaryMsg[:dp.GetHeadLen()])
+	msg.SetData(binaryMsg[dp.GetHeadLen():])
+	if err := dp.UnpackData(msg); err == nil {
+		t.Fatal("compression bomb not rejected")
+	}
+}
+
+/*
+	大消息分片和重组的测试
+*/
+
+func TestDataPackFragments(t *testing.T) {
+	dp := NewDataPack()
+	dp.SetMaxPackageSize(64)
+
+	data1 := bytes.Repeat([]byte("a"), 200)
+	data2 := bytes.Repeat([]byte("b"), 150)
+	frames1, err := dp.PackFragments(NewMsgPackage(1, data1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames2, err := dp.PackFragments(NewMsgPackage(2, data2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames1) != 4 || len(frames2) != 3 {
+		t.Fatalf("unexpected fragment count %d, %d", len(frames1), len(frames2))
+	}
+
+	// 两个消息的分片交错到达
+	var frames [][]byte
+	for i := 0; i < len(frames1); i++ {
+		frames = append(frames, frames1[i])
+		if i < len(frames2) {
+			frames = append(frames, frames2[i])
+		}
+	}
+
+	r := NewReassembler(1024, time.Second)
+	var msgs []ziface.IMessage
+	for _, frame := range frames {
+		msg, err := ReadMsg(bytes.NewReader(frame), dp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetMsgLen() > dp.GetMaxPackageSize() {
+			t.Fatalf("fragment too large: %d", msg.GetMsgLen())
+		}
+		if msg, err = r.Add(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg != nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("reassembled %d msgs", len(msgs))
+	}
+	if msgs[0].GetMsgId() != 2 || !bytes.Equal(msgs[0].GetData(), data2) {
+		t.Fatal("msg 2 mismatch")
+	}
+	if msgs[1].GetMsgId() != 1 || !bytes.Equal(msgs[1].GetData(), data1) {
+		t.Fatal("msg 1 mismatch")
+	}
+
+	// 超过重组上限的消息被拒绝
+	r = NewReassembler(100, time.Second)
+	msg, _ := ReadMsg(bytes.NewReader(frames1[0]), dp)
+	if _, err := r.Add(msg); err == nil {
+		t.Fatal("oversized msg not rejected")
+	}
+
+	// 同时重组的消息已经收到的数据总量超过上限时被拒绝
+	r = NewReassembler(200, time.Second)
+	var budgetErr error
+	for fragID := uint32(10); fragID < 13 && budgetErr == nil; fragID++ {
+		frames, err := dp.PackFragments(NewMsgPackage(1, data1), fragID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range frames[:len(frames)-1] {
+			msg, _ := ReadMsg(bytes.NewReader(frame), dp)
+			if _, budgetErr = r.Add(msg); budgetErr != nil {
+				break
+			}
+		}
+	}
+	if budgetErr == nil {
+		t.Fatal("reassembly budget not enforced")
+	}
+}
+
+func TestDataPackChecksum(t *testing.T) {
+	dp := NewDataPack()
+	dp.SetChecksum(true)
+
+	frame, err := dp.Pack(NewMsgPackage(1, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadMsg(bytes.NewReader(frame), dp)
+	if err != nil || string(msg.GetData()) != "hello" {
+		t.Fatalf("read msg failed: %v", err)
+	}
+
+	// 消息体损坏时在UnpackData中发现
+	corrupted := append([]byte{}, frame...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	if _, err := ReadMsg(bytes.NewReader(corrupted), dp); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("data corruption not detected: %v", err)
+	}
+
+	// 消息头损坏时在Unpack中发现
+	corrupted = append([]byte{}, frame...)
+	corrupted[4] ^= 0xFF
+	if _, err := dp.Unpack(corrupted[:dp.GetHeadLen()]); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("head corruption not detected: %v", err)
+	}
+}
+
+func TestDataPackTrace(t *testing.T) {
+	dp := NewDataPack()
+	dp.SetMaxPackageSize(64)
+	dp.SetCompression(&GzipCompressor{}, 16, 0)
+
+	// 随机数据压缩之后不会变小，需要分片
+	random := make([]byte, 300)
+	rand.Read(random)
+
+	trace := ziface.TraceContext{TraceID: NewTraceID(), SpanID: NewSpanID(), Flags: ziface.TraceFlagSampled}
+	for _, data := range [][]byte{[]byte("hi"), bytes.Repeat([]byte("trace"), 100), random} {
+		msg := NewMsgPackage(3, data)
+		msg.SetTrace(trace)
+		msg.SetSeq(7)
+		frames, err := dp.PackFragments(msg, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 可靠投递序号和扩展头在分片之前加入，重组之后取出
+		r := NewReassembler(0, time.Second)
+		var got ziface.IMessage
+		for _, frame := range frames {
+			if got, err = ReadMsg(bytes.NewReader(frame), dp); err != nil {
+				t.Fatal(err)
+			}
+			if got.GetFlags()&MsgFlagFragment != 0 {
+				if got, err = r.Add(got); err != nil {
+					t.Fatal(err)
+				}
+				if got != nil {
+					if err := dp.UnpackData(got); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		if got == nil || !bytes.Equal(got.GetData(), data) || got.GetTrace() != trace || got.GetSeq() != 7 {
+			t.Fatalf("trace round trip failed, len = %d", len(data))
+		}
+	}
+}
+
+// 按协议握手派生的DataPack使用协商的设置，并和原来的DataPack共享最大数据包长度
+func TestDataPackWithProtocol(t *testing.T) {
+	conf := *utils.GlobalObject
+	conf.MaxPackageSize = 1024
+	conf.Compression = "gzip"
+	conf.CompressThreshold = 16
+	conf.FrameChecksum = true
+	dp := NewDataPackWithConfig(&conf)
+	derived := dp.WithProtocol(ziface.ProtocolInfo{Compression: "deflate"})
+
+	data := bytes.Repeat([]byte("zinx"), 64)
+	packed, err := derived.Pack(NewMsgPackage(1, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := derived.Unpack(packed[:derived.GetHeadLen()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.SetData(packed[derived.GetHeadLen():])
+	if msg.GetFlags()&MsgFlagCompressed == 0 {
+		t.Fatal("derived datapack did not compress")
+	}
+	if err := derived.UnpackData(msg); err != nil || !bytes.Equal(msg.GetData(), data) {
+		t.Fatalf("unpack derived msg err: %v", err)
+	}
+
+	// 热加载修改最大数据包长度时，派生的DataPack同时生效
+	dp.SetMaxPackageSize(64)
+	if derived.GetMaxPackageSize() != 64 {
+		t.Fatalf("derived max package size = %d", derived.GetMaxPackageSize())
+	}
+}
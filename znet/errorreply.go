@@ -0,0 +1,38 @@
+package znet
+
+import (
+	"encoding/json"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	标准错误回复
+	请求被框架拒绝时，通过ERROR_MSG_ID向客户端回复一个JSON格式的错误
+*/
+
+// 系统错误码
+const (
+	ErrCodeUnauthenticated = 1001 // 连接还没有完成认证
+	ErrCodeAuthFailed      = 1002 // 认证失败
+	ErrCodeForbidden       = 1003 // 没有调用该消息的权限
+	ErrCodeUnsupported     = 1004 // 不支持的消息ID
+	ErrCodeResumeFailed    = 1005 // 会话恢复失败
+	ErrCodeUnavailable     = 1006 // 网关没有可用的后端服务
+)
+
+type ErrorReply struct {
+	Code  int    `json:"code"`  // 错误码
+	MsgID uint32 `json:"msgId"` // 被拒绝的请求的消息ID
+	Msg   string `json:"msg"`   // 错误描述
+}
+
+// 向连接回复一个标准错误
+func SendErrorReply(conn ziface.IConnection, code int, msgID uint32, msg string) error {
+	data, err := json.Marshal(&ErrorReply{Code: code, MsgID: msgID, Msg: msg})
+	if err != nil {
+		return err
+	}
+	return conn.SendMsg(utils.ERROR_MSG_ID, data)
+}
@@ -0,0 +1,136 @@
+package znet
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	未注册消息的兜底处理
+	msgID没有精确匹配的路由时，依次尝试区间和掩码路由(匹配范围更小的优先)、默认路由，
+	都没有匹配时认为是未知消息：调用OnUnknownMsg Hook，可选地回复unsupported错误，并计入连接的协议违规分数
+*/
+
+// 按区间或掩码匹配msgID的路由
+type patternRoute struct {
+	// 判断msgID是否匹配
+	match func(msgID uint32) bool
+	// 能够匹配的msgID数量，用于排序
+	span uint64
+	// 匹配规则的描述
+	desc   string
+	router ziface.IRouter
+}
+
+// 为[start, end]区间内的msgID添加路由，区间重叠时范围更小的区间优先
+// start大于end或者相同的区间已经注册时返回错误
+func (mh *MsgHandler) AddRangeRouter(start, end uint32, router ziface.IRouter) error {
+	if start > end {
+		return fmt.Errorf("invalid msgID range [%d, %d]", start, end)
+	}
+	err := mh.addPatternRoute(patternRoute{
+		match:  func(msgID uint32) bool { return msgID >= start && msgID <= end },
+		span:   uint64(end-start) + 1,
+		desc:   fmt.Sprintf("[%d, %d]", start, end),
+		router: router,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Add api msgID range = [%d, %d]\n", start, end)
+	return nil
+}
+
+// 为满足msgID&mask == value的msgID添加路由，相同的规则已经注册时返回错误
+func (mh *MsgHandler) AddMaskRouter(mask, value uint32, router ziface.IRouter) error {
+	value &= mask
+	err := mh.addPatternRoute(patternRoute{
+		match:  func(msgID uint32) bool { return msgID&mask == value },
+		span:   uint64(1) << uint(32-bits.OnesCount32(mask)),
+		desc:   fmt.Sprintf("0x%08X/0x%08X", value, mask),
+		router: router,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Add api msgID mask = 0x%08X, value = 0x%08X\n", mask, value)
+	return nil
+}
+
+func (mh *MsgHandler) addPatternRoute(route patternRoute) error {
+	return mh.updateRoutes(func(rt *routeTable) error {
+		for _, r := range rt.patterns {
+			if r.desc == route.desc {
+				return fmt.Errorf("repeat api, msgID pattern = %s", route.desc)
+			}
+		}
+		rt.patterns = append(rt.patterns, route)
+		sort.SliceStable(rt.patterns, func(i, j int) bool {
+			return rt.patterns[i].span < rt.patterns[j].span
+		})
+		return nil
+	})
+}
+
+// 设置默认路由，处理没有其他路由匹配的消息
+func (mh *MsgHandler) SetDefaultRouter(router ziface.IRouter) {
+	mh.updateRoutes(func(rt *routeTable) error {
+		rt.defaultRouter = router
+		return nil
+	})
+}
+
+// 设置未知消息的Hook函数，没有任何路由匹配时调用
+func (mh *MsgHandler) SetOnUnknownMsg(hookFunc func(request ziface.IRequest)) {
+	mh.onUnknownMsg = hookFunc
+}
+
+// 设置是否向未知消息回复unsupported错误
+func (mh *MsgHandler) SetUnsupportedReply(enabled bool) {
+	mh.unsupportedReply = enabled
+}
+
+// 查找msgID对应的路由，依次匹配精确路由、区间和掩码路由、默认路由
+func (mh *MsgHandler) findRouter(msgID uint32) (ziface.IRouter, bool) {
+	rt := mh.getRoutes()
+	if router, ok := rt.apis[msgID]; ok {
+		return router, true
+	}
+	for _, route := range rt.patterns {
+		if route.match(msgID) {
+			return route.router, true
+		}
+	}
+	if rt.defaultRouter != nil {
+		return rt.defaultRouter, true
+	}
+	return nil, false
+}
+
+// 处理没有任何路由匹配的消息
+func (mh *MsgHandler) handleUnknownMsg(request ziface.IRequest) {
+	conn := request.GetConnection()
+	fmt.Println("api msgID = ", request.GetMsgID(), " is not found and need registry!")
+	if mh.onUnknownMsg != nil {
+		mh.onUnknownMsg(request)
+	}
+	if mh.unsupportedReply {
+		SendErrorReply(conn, ErrCodeUnsupported, request.GetMsgID(), "unsupported msgID")
+	}
+	conn.AddProtocolViolation(1)
+}
+
+// 增加连接的协议违规分数，返回当前总分，超过MaxProtocolViolations时关闭连接并丢弃会话
+func (c *Connection) AddProtocolViolation(points int) int {
+	score := int(atomic.AddInt32(&c.violations, int32(points)))
+	c.metrics.incProtocolViolations()
+	if limit := c.conf.MaxProtocolViolations; limit > 0 && score > limit {
+		fmt.Printf("协议违规分数过高，关闭连接 ConnID=%d, Score=%d\n", c.ConnID, score)
+		c.StopAndDiscardSession()
+	}
+	return score
+}
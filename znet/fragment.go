@@ -0,0 +1,192 @@
+package znet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	大消息的分片和重组
+	消息体超过最大包长度时，先整体压缩，再拆分为多个带MsgFlagFragment标志的分片，
+	每个分片的消息体为: fragID uint32(4字节) + 消息总长度 uint32(4字节) + 分片数据。
+	同一个消息的分片按顺序发送，不同消息的分片可以交错，接收端按fragID重组为一个完整的消息
+*/
+
+// 分片头的长度
+const fragHeadLen = 8
+
+// 同一个连接上同时重组的消息数量上限
+const maxPartialMsgs = 64
+
+// 没有配置消息最大长度时使用的重组上限
+const defaultMaxReassemblySize = 4 << 20
+
+// 同时重组的所有消息已经收到的数据总量上限为单个消息上限的倍数，允许不同优先级的大消息交错到达
+const reassemblyBudgetFactor = 2
+
+// 封包，消息体超过最大包长度时拆分为多个分片，fragID用于标识同一个消息的分片
+func (dp *DataPack) PackFragments(msg ziface.IMessage, fragID uint32) ([][]byte, error) {
+	// 单个数据包允许的最大消息体长度
+	limit := msgLenMask
+	if maxSize := dp.GetMaxPackageSize(); maxSize > 0 && maxSize < limit {
+		limit = maxSize
+	}
+	if limit <= fragHeadLen {
+		return nil, fmt.Errorf("max package size %d is too small to fragment", limit)
+	}
+
+	// 分片之前先对整个消息体进行编码和压缩
+	msgID := msg.GetMsgId()
+	data, flags, err := dp.encodeBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(data)) <= limit {
+		binaryMsg, err := dp.Pack(&Message{Id: msgID, DataLen: uint32(len(data)), Data: data, Flags: flags})
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{binaryMsg}, nil
+	}
+
+	chunkSize := int(limit - fragHeadLen)
+	frames := make([][]byte, 0, len(data)/chunkSize+1)
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		body := bytes.NewBuffer(make([]byte, 0, fragHeadLen+end-offset))
+		binary.Write(body, binary.LittleEndian, fragID)
+		binary.Write(body, binary.LittleEndian, uint32(len(data)))
+		body.Write(data[offset:end])
+
+		binaryMsg, err := dp.Pack(&Message{
+			Id:      msgID,
+			DataLen: uint32(body.Len()),
+			Data:    body.Bytes(),
+			Flags:   flags | MsgFlagFragment,
+		})
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, binaryMsg)
+	}
+	return frames, nil
+}
+
+// 正在重组的消息
+type partialMsg struct {
+	msgID    uint32
+	flags    uint8
+	data     []byte
+	total    uint32
+	deadline time.Time
+}
+
+// 分片重组器，不是并发安全的，每个连接的读goroutine各自持有一个
+type Reassembler struct {
+	// 重组后的消息最大长度
+	maxSize uint32
+	// 所有正在重组的消息已经收到的数据总量上限
+	budget uint64
+	// 所有正在重组的消息已经收到的数据总量
+	buffered uint64
+	// 一个消息的分片需要在该时间内全部到达
+	timeout time.Duration
+	// 正在重组的消息
+	partials map[uint32]*partialMsg
+}
+
+// 创建一个分片重组器，maxSize为0时使用默认的4MB
+func NewReassembler(maxSize uint32, timeout time.Duration) *Reassembler {
+	if maxSize == 0 {
+		maxSize = defaultMaxReassemblySize
+	}
+	return &Reassembler{
+		maxSize:  maxSize,
+		budget:   uint64(maxSize) * reassemblyBudgetFactor,
+		timeout:  timeout,
+		partials: make(map[uint32]*partialMsg),
+	}
+}
+
+// 添加一个分片，消息重组完成时返回完整的消息，还没有完成时返回nil
+func (r *Reassembler) Add(frag ziface.IMessage) (ziface.IMessage, error) {
+	data := frag.GetData()
+	if len(data) < fragHeadLen {
+		return nil, errors.New("fragment too short")
+	}
+	fragID := binary.LittleEndian.Uint32(data[0:4])
+	total := binary.LittleEndian.Uint32(data[4:8])
+	chunk := data[fragHeadLen:]
+
+	now := time.Now()
+	r.expire(now)
+
+	p, ok := r.partials[fragID]
+	if !ok {
+		if total > r.maxSize {
+			return nil, fmt.Errorf("fragmented msg size %d exceeds %d", total, r.maxSize)
+		}
+		if len(r.partials) >= maxPartialMsgs {
+			return nil, errors.New("too many fragmented msgs in progress")
+		}
+		// 消息总长度由对端声明，缓冲区随收到的分片增长，不预先分配
+		p = &partialMsg{
+			msgID:    frag.GetMsgId(),
+			flags:    frag.GetFlags() &^ MsgFlagFragment,
+			total:    total,
+			deadline: now.Add(r.timeout),
+		}
+		r.partials[fragID] = p
+	}
+	if p.msgID != frag.GetMsgId() || p.total != total {
+		r.remove(fragID)
+		return nil, fmt.Errorf("fragment %d does not match the msg in progress", fragID)
+	}
+	if uint64(len(p.data))+uint64(len(chunk)) > uint64(p.total) {
+		r.remove(fragID)
+		return nil, fmt.Errorf("fragment %d overflows msg size %d", fragID, p.total)
+	}
+	if r.buffered+uint64(len(chunk)) > r.budget {
+		r.remove(fragID)
+		return nil, fmt.Errorf("fragmented msgs in progress exceed %d bytes", r.budget)
+	}
+	p.data = append(p.data, chunk...)
+	r.buffered += uint64(len(chunk))
+	if uint32(len(p.data)) < p.total {
+		return nil, nil
+	}
+
+	r.remove(fragID)
+	return &Message{Id: p.msgID, DataLen: p.total, Data: p.data, Flags: p.flags}, nil
+}
+
+// 移除一个正在重组的消息，释放它占用的数据总量
+func (r *Reassembler) remove(fragID uint32) {
+	if p, ok := r.partials[fragID]; ok {
+		r.buffered -= uint64(len(p.data))
+		delete(r.partials, fragID)
+	}
+}
+
+// 丢弃超时还没有重组完成的消息
+func (r *Reassembler) expire(now time.Time) {
+	if r.timeout <= 0 {
+		return
+	}
+	for fragID, p := range r.partials {
+		if now.After(p.deadline) {
+			fmt.Printf("fragmented msg timeout, fragID = %d, msgID = %d, received %d/%d\n",
+				fragID, p.msgID, len(p.data), p.total)
+			r.remove(fragID)
+		}
+	}
+}
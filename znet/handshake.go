@@ -0,0 +1,105 @@
+package znet
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	连接握手
+	在连接的读写goroutine启动之前完成，握手期间收到的数据不会交给路由处理。
+	开启协议握手时先协商协议版本和特性，之后再进行会话加密握手，
+	连接之后按照协商的压缩算法和校验和进行封包和拆包
+*/
+
+// 执行连接握手，握手失败时连接会被关闭
+func (c *Connection) handshake() error {
+	// 没有开启协议握手时，直接使用服务端的配置
+	c.protocol = ziface.ProtocolInfo{
+		Compression: c.conf.Compression,
+		Encryption:  c.conf.SessionEncryption,
+		Checksum:    c.conf.FrameChecksum,
+	}
+	if !c.conf.ProtocolHandshake && !c.conf.SessionEncryption {
+		return nil
+	}
+
+	// 握手需要在超时时间内完成
+	if c.conf.HandshakeTimeout > 0 {
+		c.rawConn.SetDeadline(time.Now().Add(time.Duration(c.conf.HandshakeTimeout) * time.Second))
+		defer c.rawConn.SetDeadline(time.Time{})
+	}
+
+	if c.conf.ProtocolHandshake {
+		info, err := ServerProtocolHandshake(c.stream, c.conf)
+		if err != nil {
+			if _, ok := err.(*ProtocolRejectError); ok {
+				c.metrics.incHandshakeRejects()
+				fmt.Printf("ConnID = %d, IP = %s %v\n", c.ConnID, c.RemoteAddr().String(), err)
+			}
+			return err
+		}
+		c.protocol = info
+		c.peerTrace.Store(info.Trace)
+		// 从Server的DataPack派生，热加载修改的最大数据包长度对已经握手的连接同样生效
+		if dp, ok := c.TCPServer.GetPacket().(*DataPack); ok {
+			c.packet = dp.WithProtocol(info)
+		} else {
+			c.packet = NewDataPackWithProtocol(c.conf, info)
+		}
+	}
+
+	if c.conf.SessionEncryption {
+		stream, err := SecureServerHandshake(c.stream, c.packet)
+		if err != nil {
+			return err
+		}
+		c.stream = stream
+	}
+	return nil
+}
+
+// 获取连接握手时协商的协议信息
+func (c *Connection) GetProtocolInfo() ziface.ProtocolInfo {
+	return c.protocol
+}
+
+// 客户端连接握手，按照conf进行协议握手和会话加密，返回之后收发数据使用的连接和协商的协议信息，
+// 之后使用NewDataPackWithProtocol(conf, info)创建的DataPack进行封包和拆包
+func ClientHandshake(conn net.Conn, conf *utils.GlobalObj) (net.Conn, ziface.ProtocolInfo, error) {
+	info := ziface.ProtocolInfo{
+		Compression: conf.Compression,
+		Encryption:  conf.SessionEncryption,
+		Checksum:    conf.FrameChecksum,
+	}
+	if conf.ProtocolHandshake {
+		// DataPack总是能够解析链路追踪扩展头
+		hello := ProtocolHello{Version: ProtocolVersion, Features: FeatureTrace, Codecs: conf.Codecs}
+		if conf.SessionEncryption {
+			hello.Features |= FeatureEncryption
+		}
+		if conf.FrameChecksum {
+			hello.Features |= FeatureChecksum
+		}
+		if conf.Compression != "" {
+			hello.Features |= FeatureCompression
+			hello.Compressions = []string{conf.Compression}
+		}
+		var err error
+		if info, err = ClientProtocolHandshake(conn, hello); err != nil {
+			return nil, info, err
+		}
+	}
+	if conf.SessionEncryption {
+		secure, err := SecureClientHandshake(conn, NewDataPackWithProtocol(conf, info))
+		if err != nil {
+			return nil, info, err
+		}
+		return secure, info, nil
+	}
+	return conn, info, nil
+}
@@ -1,7 +1,9 @@
 package znet
 
 import (
+	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/Xaytick/zinx/utils"
 	"github.com/Xaytick/zinx/ziface"
@@ -22,10 +24,67 @@ func (hr *HeartbeatRouter) Handle(request ziface.IRequest) {
 	}
 
 	// 回复一个PONG消息
-	err := conn.SendMsg(utils.PONG_MSG_ID, []byte("pong"))
+	err := conn.SendMsgWithPriority(ziface.PriorityHigh, utils.PONG_MSG_ID, []byte("pong"))
 	if err != nil {
 		fmt.Println("回复心跳消息失败:", err)
 	} else {
 		fmt.Printf("心跳响应: PONG 发送至 ConnID=%d\n", conn.GetConnID())
 	}
 }
+
+// HeartbeatPongRouter 处理客户端对服务端主动心跳的回复
+// 客户端需要将PING中携带的时间戳原样放在PONG中返回
+type HeartbeatPongRouter struct {
+	BaseRouter
+}
+
+// Handle 根据PONG中的时间戳计算RTT
+func (hr *HeartbeatPongRouter) Handle(request ziface.IRequest) {
+	c, ok := request.GetConnection().(*Connection)
+	if !ok {
+		return
+	}
+	data := request.GetData()
+	if len(data) < 8 {
+		fmt.Printf("心跳回复格式错误 ConnID=%d, len=%d\n", c.GetConnID(), len(data))
+		return
+	}
+	sendTime := time.Unix(0, int64(binary.LittleEndian.Uint64(data)))
+	c.recordRTT(time.Since(sendTime))
+}
+
+// 发送一个携带当前时间戳的PING
+func (c *Connection) sendPing() error {
+	c.rttLock.Lock()
+	c.rttStats.Missed++
+	c.rttLock.Unlock()
+
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+	// 在时间轮的执行goroutine中调用，不能阻塞，发送队列已满时本次心跳计为丢失
+	return c.TrySendMsg(ziface.PriorityHigh, utils.PING_MSG_ID, data)
+}
+
+// 记录一次RTT样本，并清空连续丢失的心跳次数
+func (c *Connection) recordRTT(rtt time.Duration) {
+	c.rttLock.Lock()
+	defer c.rttLock.Unlock()
+	stats := &c.rttStats
+	stats.Missed = 0
+	stats.Last = rtt
+	if stats.Samples == 0 || rtt < stats.Min {
+		stats.Min = rtt
+	}
+	if rtt > stats.Max {
+		stats.Max = rtt
+	}
+	stats.Avg = time.Duration((int64(stats.Avg)*int64(stats.Samples) + int64(rtt)) / int64(stats.Samples+1))
+	stats.Samples++
+}
+
+// 获取服务端主动心跳测量的RTT统计
+func (c *Connection) GetRTTStats() ziface.RTTStats {
+	c.rttLock.Lock()
+	defer c.rttLock.Unlock()
+	return c.rttStats
+}
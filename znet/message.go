@@ -1,5 +1,19 @@
 package znet
 
+import "github.com/Xaytick/zinx/ziface"
+
+// 消息标志位，占用消息头中长度字段的高8位
+const (
+	// 消息体经过压缩
+	MsgFlagCompressed uint8 = 1 << 0
+	// 消息是一个大消息的分片
+	MsgFlagFragment uint8 = 1 << 1
+	// 消息体前携带链路追踪扩展头
+	MsgFlagTrace uint8 = 1 << 2
+	// 消息体前携带可靠投递的序号
+	MsgFlagReliable uint8 = 1 << 3
+)
+
 type Message struct {
 	// 消息的ID
 	Id uint32
@@ -7,38 +21,83 @@ type Message struct {
 	DataLen uint32
 	// 消息的内容
 	Data []byte
+	// 消息的标志位
+	Flags uint8
+	// 消息携带的链路追踪上下文
+	Trace ziface.TraceContext
+	// 可靠消息的序号，0表示不是可靠消息
+	Seq uint64
+	// 消息头中携带的消息体校验和
+	checksum uint32
+	// 消息体的校验和是否还没有校验
+	checksumPending bool
 }
 
 // 获取消息的ID
 func (m *Message) GetMsgId() uint32 {
 	return m.Id
 }
+
 // 获取消息的长度
 func (m *Message) GetMsgLen() uint32 {
 	return m.DataLen
 }
+
 // 获取消息的内容
 func (m *Message) GetData() []byte {
 	return m.Data
 }
+
 // 设置消息的ID
 func (m *Message) SetMsgId(Id uint32) {
 	m.Id = Id
 }
+
 // 设置消息的长度
 func (m *Message) SetMsgLen(Len uint32) {
 	m.DataLen = Len
 }
+
 // 设置消息的内容
 func (m *Message) SetData(Data []byte) {
 	m.Data = Data
 }
 
+// 获取消息的标志位
+func (m *Message) GetFlags() uint8 {
+	return m.Flags
+}
+
+// 设置消息的标志位
+func (m *Message) SetFlags(flags uint8) {
+	m.Flags = flags
+}
+
+// 获取消息携带的链路追踪上下文
+func (m *Message) GetTrace() ziface.TraceContext {
+	return m.Trace
+}
+
+// 设置消息携带的链路追踪上下文
+func (m *Message) SetTrace(trace ziface.TraceContext) {
+	m.Trace = trace
+}
+
+// 获取可靠消息的序号
+func (m *Message) GetSeq() uint64 {
+	return m.Seq
+}
+
+// 设置可靠消息的序号
+func (m *Message) SetSeq(seq uint64) {
+	m.Seq = seq
+}
+
 // 创建一个Message消息包
 func NewMsgPackage(id uint32, data []byte) *Message {
 	return &Message{
-		Id: id,
+		Id:      id,
 		DataLen: uint32(len(data)),
-		Data: data,
+		Data:    data,
 	}
-}
\ No newline at end of file
+}
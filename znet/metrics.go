@@ -0,0 +1,45 @@
+package znet
+
+import "sync/atomic"
+
+/*
+	Server运行指标的统计
+	所有计数都使用原子操作，可以在任意goroutine中读取
+*/
+
+type Metrics struct {
+	// 校验和不匹配的消息数量
+	ChecksumMismatches uint64
+	// 被丢弃的消息数量
+	DroppedMsgs uint64
+	// 协议握手被拒绝的连接数量
+	HandshakeRejects uint64
+	// 协议违规的次数
+	ProtocolViolations uint64
+}
+
+// 获取当前指标的快照
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		ChecksumMismatches: atomic.LoadUint64(&m.ChecksumMismatches),
+		DroppedMsgs:        atomic.LoadUint64(&m.DroppedMsgs),
+		HandshakeRejects:   atomic.LoadUint64(&m.HandshakeRejects),
+		ProtocolViolations: atomic.LoadUint64(&m.ProtocolViolations),
+	}
+}
+
+func (m *Metrics) incChecksumMismatches() {
+	atomic.AddUint64(&m.ChecksumMismatches, 1)
+}
+
+func (m *Metrics) incDroppedMsgs() {
+	atomic.AddUint64(&m.DroppedMsgs, 1)
+}
+
+func (m *Metrics) incHandshakeRejects() {
+	atomic.AddUint64(&m.HandshakeRejects, 1)
+}
+
+func (m *Metrics) incProtocolViolations() {
+	atomic.AddUint64(&m.ProtocolViolations, 1)
+}
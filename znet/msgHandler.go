@@ -1,7 +1,9 @@
 package znet
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/Xaytick/zinx/utils"
@@ -13,57 +15,102 @@ import (
 */
 
 type MsgHandler struct {
-	// 存放每个MsgID 所对应的处理方法
-	Apis map[uint32]ziface.IRouter
+	// 存放每个MsgID所对应的处理方法，写时复制
+	routes atomic.Pointer[routeTable]
+	// 修改路由表时的锁
+	routeLock sync.Mutex
 	// 负责worker取任务的消息队列
 	TaskQueue []chan ziface.IRequest
 	// 负责worker池的worker数量
 	WorkerPoolSize uint32
+	// 每个worker对应的任务队列的最大长度
+	MaxTaskLen uint32
+	// 轮询分配worker的计数
+	rrIndex uint32
+	// 认证配置，为nil时不需要认证，worker处理消息时并发读取，整体替换
+	auth atomic.Pointer[authConfig]
+	// 消息权限校验，为nil时不做校验
+	authorizer atomic.Pointer[ziface.IAuthorizer]
+	// 权限审计日志的输出
+	auditLog atomic.Pointer[func(entry AuditEntry)]
+	// 未知消息的Hook函数
+	onUnknownMsg func(request ziface.IRequest)
+	// 是否向未知消息回复unsupported错误
+	unsupportedReply bool
+	// Span导出器，为nil时不开启链路追踪
+	spanExporter atomic.Pointer[ziface.ISpanExporter]
 }
 
 // 初始化,创建MsgHandler方法
 func NewMsgHandler() *MsgHandler {
-	return &MsgHandler{
-		Apis:           make(map[uint32]ziface.IRouter),
-		TaskQueue:      make([]chan ziface.IRequest, utils.GlobalObject.WorkerPoolSize),
-		WorkerPoolSize: utils.GlobalObject.WorkerPoolSize, // 从全局配置中获取
+	// 从全局配置中获取
+	return NewMsgHandlerWithPool(utils.GlobalObject.WorkerPoolSize, utils.GlobalObject.MaxTaskLen)
+}
+
+// 使用指定的worker池大小和任务队列长度创建MsgHandler
+func NewMsgHandlerWithPool(workerPoolSize, maxTaskLen uint32) *MsgHandler {
+	mh := &MsgHandler{
+		TaskQueue:      make([]chan ziface.IRequest, workerPoolSize),
+		WorkerPoolSize: workerPoolSize,
+		MaxTaskLen:     maxTaskLen,
 	}
+	mh.routes.Store(newRouteTable())
+	return mh
+}
+
+// 获取worker池的worker数量，为0时表示没有开启工作池
+func (mh *MsgHandler) GetWorkerPoolSize() uint32 {
+	return mh.WorkerPoolSize
 }
 
 // 调度,执行对应的Router消息处理方法
 func (mh *MsgHandler) DoMsgHandler(Request ziface.IRequest) {
+	// 开启链路追踪时，为整个处理过程创建一个Span
+	if exporter := mh.getSpanExporter(); exporter != nil {
+		span := mh.startSpan(Request)
+		defer mh.finishSpan(Request, exporter, span)
+	}
+	mh.dispatch(Request)
+}
+
+// 经过认证和权限检查之后，交给匹配的路由处理
+func (mh *MsgHandler) dispatch(Request ziface.IRequest) {
+	// 0.没有完成认证的连接只能处理白名单中的消息
+	if !mh.checkAuth(Request) {
+		return
+	}
+	// 校验连接的角色是否有权限调用该消息
+	if !mh.checkPermission(Request) {
+		return
+	}
 	// 1.从Request中找到msgID
-	handler, ok := mh.Apis[Request.GetMsgID()]
+	handler, ok := mh.findRouter(Request.GetMsgID())
 	if !ok {
-		fmt.Println("api msgID = ", Request.GetMsgID(), " is not found and need registry!")
+		mh.handleUnknownMsg(Request)
 		return
 	}
+	// 设置了处理超时时间的消息，在超时后取消请求的上下文
+	if timeout, ok := mh.getRoutes().timeouts[Request.GetMsgID()]; ok {
+		ctx, cancel := context.WithTimeout(Request.Context(), timeout)
+		defer cancel()
+		Request.SetContext(ctx)
+	}
 	// 2.根据msgID调度对应的router业务
 	handler.PreHandle(Request)
 	handler.Handle(Request)
 	handler.PostHandle(Request)
-}
-
-// 为消息添加具体的处理逻辑
-func (mh *MsgHandler) AddRouter(msgID uint32, router ziface.IRouter) {
-	// 1.判断当前msg绑定的API处理方法是否已经存在
-	if _, ok := mh.Apis[msgID]; ok {
-		// id已经注册
-		panic(fmt.Sprintf("repeat api, msgID = %d", msgID))
+	if Request.Context().Err() == context.DeadlineExceeded {
+		fmt.Println("api msgID = ", Request.GetMsgID(), " handle timeout, ConnID = ", Request.GetConnection().GetConnID())
 	}
-
-	// 2.添加msg与api的绑定关系
-	mh.Apis[msgID] = router
-	fmt.Println("Add api msgID = ", msgID)
 }
 
-// 启动一个Worker工作池(开启工作池的动作只能发生一次，一个zinx框架只能有一个worker工作池)
+// 启动一个Worker工作池(开启工作池的动作只能发生一次，每个Server有自己独立的worker工作池)
 func (mh *MsgHandler) StartWorkerPool() {
 	// 根据workerPoolSize 分别开启Worker，每个Worker用一个go来承载
 	for i := 0; i < int(mh.WorkerPoolSize); i++ {
 		// 一个worker被启动
 		// 1.当前的worker对应的channel消息队列，开辟空间，第i个worker就用第i个channel
-		mh.TaskQueue[i] = make(chan ziface.IRequest, utils.GlobalObject.MaxTaskLen)
+		mh.TaskQueue[i] = make(chan ziface.IRequest, mh.MaxTaskLen)
 		go mh.StartOneWorker(i, mh.TaskQueue[i])
 	}
 }
@@ -78,12 +125,19 @@ func (mh *MsgHandler) StartOneWorker(workerID int, taskQueue chan ziface.IReques
 	}
 }
 
-// 将消息交给TaskQueue，由Worker进行处理
-var rrIndex uint32 = 0
+// 获取每个worker任务队列中等待处理的请求数量
+func (mh *MsgHandler) GetTaskQueueLens() []int {
+	lens := make([]int, len(mh.TaskQueue))
+	for i, queue := range mh.TaskQueue {
+		lens[i] = len(queue)
+	}
+	return lens
+}
 
+// 将消息交给TaskQueue，由Worker进行处理
 func (mh *MsgHandler) SendMsgToTaskQueue(request ziface.IRequest) {
 	// 轮询分配worker, 使用原子操作保证线程安全
-	idx := atomic.AddUint32(&rrIndex, 1)
+	idx := atomic.AddUint32(&mh.rrIndex, 1)
 	workerID := idx % mh.WorkerPoolSize
 	fmt.Println("Add ConnID = ", request.GetConnection().GetConnID(),
 		"request MsgID = ", request.GetMsgID(),
@@ -0,0 +1,193 @@
+package znet
+
+import (
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+)
+
+/*
+	Server的配置选项
+	每个Server持有一份独立的配置，默认从utils.GlobalObject复制，
+	通过Option可以覆盖其中的任意配置项，从而在一个进程中运行多个不同配置的Server
+*/
+
+type Option func(s *Server)
+
+// 使用指定的配置作为Server的配置，conf会被复制，之后对conf的修改不影响Server
+func WithConfig(conf *utils.GlobalObj) Option {
+	return func(s *Server) {
+		*s.Config = *conf
+	}
+}
+
+// 设置Server的名称，会覆盖NewServer的name参数
+func WithName(name string) Option {
+	return func(s *Server) {
+		s.Config.Name = name
+		s.nameSet = true
+	}
+}
+
+// 设置Server监听的IP和端口
+func WithAddress(host string, port int) Option {
+	return func(s *Server) {
+		s.Config.Host = host
+		s.Config.TcpPort = port
+	}
+}
+
+// 设置Server的版本号
+func WithVersion(version string) Option {
+	return func(s *Server) {
+		s.Config.Version = version
+	}
+}
+
+// 设置Server允许的最大连接数
+func WithMaxConn(maxConn int) Option {
+	return func(s *Server) {
+		s.Config.MaxConn = maxConn
+	}
+}
+
+// 设置Server允许的最大数据包长度
+func WithMaxPackageSize(size uint32) Option {
+	return func(s *Server) {
+		s.Config.MaxPackageSize = size
+	}
+}
+
+// 设置Server的Worker池大小和每个Worker的任务队列长度
+func WithWorkerPool(workerPoolSize, maxTaskLen uint32) Option {
+	return func(s *Server) {
+		s.Config.WorkerPoolSize = workerPoolSize
+		s.Config.MaxTaskLen = maxTaskLen
+	}
+}
+
+// 设置Server的心跳检测间隔和超时时间，单位为秒
+func WithHeartbeat(interval, timeout int) Option {
+	return func(s *Server) {
+		s.Config.HeartbeatInterval = interval
+		s.Config.HeartbeatTimeout = timeout
+	}
+}
+
+// 设置Server热加载的配置文件和轮询间隔，单位为秒，reloadInterval为0时不开启热加载
+func WithConfigFile(path string, reloadInterval int) Option {
+	return func(s *Server) {
+		s.confFile = path
+		s.Config.ConfigReloadInterval = reloadInterval
+	}
+}
+
+// 开启服务端主动心跳，maxMissed为允许连续丢失的心跳次数
+func WithActiveHeartbeat(maxMissed int) Option {
+	return func(s *Server) {
+		s.Config.HeartbeatActive = true
+		s.Config.HeartbeatMaxMissed = maxMissed
+	}
+}
+
+// 设置消息压缩算法，消息体达到threshold时进行压缩，解压后的长度不能超过maxDecompressSize
+func WithCompression(name string, threshold, maxDecompressSize uint32) Option {
+	return func(s *Server) {
+		s.Config.Compression = name
+		s.Config.CompressThreshold = threshold
+		s.Config.MaxDecompressSize = maxDecompressSize
+	}
+}
+
+// 开启会话加密，连接建立时进行ECDH密钥交换，之后所有数据使用AES-GCM加密
+func WithSessionEncryption() Option {
+	return func(s *Server) {
+		s.Config.SessionEncryption = true
+	}
+}
+
+// 设置连接完成认证的期限，单位为秒
+func WithAuthTimeout(timeout int) Option {
+	return func(s *Server) {
+		s.Config.AuthTimeout = timeout
+	}
+}
+
+// 设置分片重组后的消息最大长度，以及一个消息的所有分片到达的超时时间，单位为秒
+// maxSize为0时和解压后的最大长度相同
+func WithReassembly(maxSize uint32, timeout int) Option {
+	return func(s *Server) {
+		s.Config.MaxReassemblySize = maxSize
+		s.Config.ReassemblyTimeout = timeout
+	}
+}
+
+// 开启消息头中的CRC32C校验和，action为消息体校验和不匹配时的处理方式，drop丢弃该消息，close关闭连接
+func WithFrameChecksum(action string) Option {
+	return func(s *Server) {
+		s.Config.FrameChecksum = true
+		s.Config.ChecksumMismatchAction = action
+	}
+}
+
+// 开启协议握手，不支持当前协议、不支持会话加密或者没有共同消息编码的客户端会被拒绝
+func WithProtocolHandshake() Option {
+	return func(s *Server) {
+		s.Config.ProtocolHandshake = true
+	}
+}
+
+// 设置协议握手时可以选择的消息编码，按优先级排列，需要同时开启协议握手
+func WithCodecs(codecs ...string) Option {
+	return func(s *Server) {
+		s.Config.Codecs = codecs
+	}
+}
+
+// 设置协议违规分数的上限，连接超过该分数时被关闭，0表示不限制
+func WithMaxProtocolViolations(limit int) Option {
+	return func(s *Server) {
+		s.Config.MaxProtocolViolations = limit
+	}
+}
+
+// 开启链路追踪，Span以JSON格式逐行写入path
+func WithTraceFile(path string) Option {
+	return func(s *Server) {
+		s.Config.TraceFile = path
+	}
+}
+
+// 开启管理HTTP接口，addr为监听地址，token为访问需要的token
+func WithAdmin(addr, token string) Option {
+	return func(s *Server) {
+		s.Config.AdminAddr = addr
+		s.Config.AdminToken = token
+	}
+}
+
+// 开启会话恢复，grace为断线后会话保留的秒数，replaySize为保留的最近消息数量
+func WithSessionResume(grace, replaySize int) Option {
+	return func(s *Server) {
+		s.Config.SessionGracePeriod = grace
+		s.Config.SessionReplaySize = replaySize
+	}
+}
+
+// 为msgID开启可靠投递，发送的消息需要对端确认
+func WithReliable(msgIDs ...uint32) Option {
+	return func(s *Server) {
+		// 复制一份，避免修改utils.GlobalObject中的切片
+		s.Config.ReliableMsgIDs = append(append([]uint32(nil), s.Config.ReliableMsgIDs...), msgIDs...)
+	}
+}
+
+// 设置出站消息的优先级通道，queueSize为每个通道的缓冲消息数量，weights为高、普通、低优先级的发送权重，
+// starvation为消息排队超过该时间时优先发送，0表示不开启
+func WithPriorityLanes(queueSize int, weights []int, starvation time.Duration) Option {
+	return func(s *Server) {
+		s.Config.SendQueueSize = queueSize
+		s.Config.PriorityWeights = weights
+		s.Config.StarvationTimeout = int(starvation / time.Millisecond)
+	}
+}
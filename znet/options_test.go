@@ -0,0 +1,100 @@
+package znet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+)
+
+/*
+	Server配置选项的测试
+*/
+
+// name参数作为Server的名称，WithName优先于name参数，name参数优先于WithConfig中的名称
+func TestServerName(t *testing.T) {
+	if s := NewServer("alpha"); s.Name != "alpha" || s.Config.Name != "alpha" {
+		t.Fatalf("name argument ignored, got %q", s.Name)
+	}
+	if s := NewServer("alpha", WithName("beta")); s.Name != "beta" {
+		t.Fatalf("WithName should override the name argument, got %q", s.Name)
+	}
+	if s := NewServer(""); s.Name != utils.GlobalObject.Name {
+		t.Fatalf("empty name should keep the configured name, got %q", s.Name)
+	}
+	conf := *utils.GlobalObject
+	conf.Name = "from-config"
+	if s := NewServer("alpha", WithConfig(&conf)); s.Name != "alpha" {
+		t.Fatalf("name argument should override WithConfig, got %q", s.Name)
+	}
+	if s := NewServer("", WithConfig(&conf)); s.Name != "from-config" {
+		t.Fatalf("WithConfig name ignored, got %q", s.Name)
+	}
+}
+
+// 每个Server持有独立的配置，选项应用到Server的各个模块，不影响utils.GlobalObject和其他Server
+func TestServerOptions(t *testing.T) {
+	global := *utils.GlobalObject
+	globalReliable := len(utils.GlobalObject.ReliableMsgIDs)
+
+	s := NewServer("opts",
+		WithAddress("127.0.0.1", 9100),
+		WithMaxConn(3),
+		WithMaxPackageSize(64),
+		WithWorkerPool(2, 16),
+		WithHeartbeat(5, 20),
+		WithActiveHeartbeat(4),
+		WithReliable(77),
+	)
+	other := NewServer("other")
+
+	if s.IP != "127.0.0.1" || s.Port != 9100 {
+		t.Fatalf("address = %s:%d", s.IP, s.Port)
+	}
+	if n := s.GetConnManager().(*ConnManager).GetMaxConn(); n != 3 {
+		t.Fatalf("max conn = %d", n)
+	}
+	if n := s.MsgHandler.(*MsgHandler).GetWorkerPoolSize(); n != 2 {
+		t.Fatalf("worker pool size = %d", n)
+	}
+	if interval, timeout := s.GetHeartbeatConfig(); interval != 5*time.Second || timeout != 20*time.Second {
+		t.Fatalf("heartbeat = %v/%v", interval, timeout)
+	}
+	if enabled, maxMissed := s.GetActiveHeartbeat(); !enabled || maxMissed != 4 {
+		t.Fatalf("active heartbeat = %v/%d", enabled, maxMissed)
+	}
+	if s.Reliable == nil || !s.Reliable.IsReliable(77) {
+		t.Fatal("msgID 77 should be reliable")
+	}
+
+	// 超过最大数据包长度的消息被拒绝，其他Server仍然使用默认的长度
+	frame, err := other.GetPacket().Pack(NewMsgPackage(10, make([]byte, 65)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetPacket().Unpack(frame); err == nil {
+		t.Fatal("unpack over max package size should fail")
+	}
+	if _, err := other.GetPacket().Unpack(frame); err != nil {
+		t.Fatalf("other server should keep the default max package size: %v", err)
+	}
+
+	if other.Config.MaxConn != global.MaxConn || other.Config.MaxPackageSize != global.MaxPackageSize {
+		t.Fatal("options leaked into another server")
+	}
+	if utils.GlobalObject.MaxConn != global.MaxConn || utils.GlobalObject.TcpPort != global.TcpPort ||
+		len(utils.GlobalObject.ReliableMsgIDs) != globalReliable {
+		t.Fatal("options modified utils.GlobalObject")
+	}
+}
+
+// WithConfig复制配置，之后修改conf不影响Server
+func TestWithConfigCopies(t *testing.T) {
+	conf := *utils.GlobalObject
+	conf.MaxConn = 7
+	s := NewServer("copy", WithConfig(&conf))
+	conf.MaxConn = 100
+	if s.Config.MaxConn != 7 {
+		t.Fatalf("server config changed with conf, max conn = %d", s.Config.MaxConn)
+	}
+}
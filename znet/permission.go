@@ -0,0 +1,164 @@
+package znet
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	基于角色的消息权限校验
+	PermissionTable记录每个msgID或msgID区间需要的角色，连接拥有其中任意一个角色即可调用，
+	没有出现在权限表中的msgID不做限制。
+	被拒绝的请求会收到标准错误回复，同时记录一条审计日志
+*/
+
+// 连接属性中保存角色列表的key
+const RolesProperty = "roles"
+
+// msgID区间需要的角色
+type permissionRange struct {
+	start, end uint32
+	roles      []string
+}
+
+type PermissionTable struct {
+	// 单个msgID需要的角色
+	exact map[uint32][]string
+	// msgID区间需要的角色，按区间大小从小到大排列
+	ranges []permissionRange
+	// 保护权限表的锁
+	lock sync.RWMutex
+}
+
+// 创建一个空的权限表
+func NewPermissionTable() *PermissionTable {
+	return &PermissionTable{
+		exact: make(map[uint32][]string),
+	}
+}
+
+// 设置调用msgID需要的角色
+func (pt *PermissionTable) Require(msgID uint32, roles ...string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.exact[msgID] = roles
+}
+
+// 设置调用[start, end]区间内msgID需要的角色，区间重叠时范围更小的区间优先
+func (pt *PermissionTable) RequireRange(start, end uint32, roles ...string) error {
+	if start > end {
+		return fmt.Errorf("invalid permission range [%d, %d]", start, end)
+	}
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.ranges = append(pt.ranges, permissionRange{start: start, end: end, roles: roles})
+	sort.SliceStable(pt.ranges, func(i, j int) bool {
+		return pt.ranges[i].size() < pt.ranges[j].size()
+	})
+	return nil
+}
+
+// 区间内msgID的数量减一，start <= end时不会溢出
+func (r permissionRange) size() uint32 {
+	return r.end - r.start
+}
+
+// 获取调用msgID需要的角色，单个msgID的设置优先于区间，没有限制时返回nil
+func (pt *PermissionTable) RequiredRoles(msgID uint32) []string {
+	pt.lock.RLock()
+	defer pt.lock.RUnlock()
+	if roles, ok := pt.exact[msgID]; ok {
+		return roles
+	}
+	for _, r := range pt.ranges {
+		if msgID >= r.start && msgID <= r.end {
+			return r.roles
+		}
+	}
+	return nil
+}
+
+// 判断拥有roles角色的连接是否可以调用msgID
+func (pt *PermissionTable) Allowed(msgID uint32, roles []string) bool {
+	required := pt.RequiredRoles(msgID)
+	if len(required) == 0 {
+		return true
+	}
+	for _, need := range required {
+		for _, role := range roles {
+			if need == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 一条权限审计日志
+type AuditEntry struct {
+	Time   time.Time // 请求被拒绝的时间
+	ConnID uint32    // 连接ID
+	UserID uint      // 连接绑定的用户ID，没有绑定时为0
+	MsgID  uint32    // 被拒绝的消息ID
+	Roles  []string  // 连接拥有的角色
+}
+
+// 默认的审计日志，输出到标准输出
+func defaultAuditLog(entry AuditEntry) {
+	fmt.Printf("[AUDIT] %s permission denied: ConnID=%d, UserID=%d, MsgID=%d, Roles=%v\n",
+		entry.Time.Format("2006-01-02 15:04:05"), entry.ConnID, entry.UserID, entry.MsgID, entry.Roles)
+}
+
+// 获取连接拥有的角色
+func getConnRoles(conn ziface.IConnection) []string {
+	if value, err := conn.GetProperty(RolesProperty); err == nil {
+		if roles, ok := value.([]string); ok {
+			return roles
+		}
+	}
+	return nil
+}
+
+// 设置消息权限校验，authorizer为nil时关闭校验，可以在Server运行时调用
+func (mh *MsgHandler) SetAuthorizer(authorizer ziface.IAuthorizer) {
+	mh.authorizer.Store(&authorizer)
+}
+
+// 设置审计日志的输出，为nil时使用默认的标准输出，可以在Server运行时调用
+func (mh *MsgHandler) SetAuditLog(auditLog func(entry AuditEntry)) {
+	mh.auditLog.Store(&auditLog)
+}
+
+// 权限检查，返回请求是否可以继续交给路由处理
+func (mh *MsgHandler) checkPermission(request ziface.IRequest) bool {
+	p := mh.authorizer.Load()
+	if p == nil || *p == nil {
+		return true
+	}
+	conn := request.GetConnection()
+	roles := getConnRoles(conn)
+	if (*p).Allowed(request.GetMsgID(), roles) {
+		return true
+	}
+
+	entry := AuditEntry{
+		Time:   time.Now(),
+		ConnID: conn.GetConnID(),
+		MsgID:  request.GetMsgID(),
+		Roles:  roles,
+	}
+	if value, err := conn.GetProperty("userID"); err == nil {
+		entry.UserID, _ = value.(uint)
+	}
+	if auditLog := mh.auditLog.Load(); auditLog != nil && *auditLog != nil {
+		(*auditLog)(entry)
+	} else {
+		defaultAuditLog(entry)
+	}
+	SendErrorReply(conn, ErrCodeForbidden, request.GetMsgID(), "permission denied")
+	return false
+}
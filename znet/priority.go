@@ -0,0 +1,145 @@
+package znet
+
+import (
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	出站消息的优先级通道
+	每个连接有高、普通、低三个发送通道，写goroutine按权重轮流从有消息的通道中取出消息发送，
+	高优先级的通道每一轮可以发送更多的消息。
+	一个通道的消息排队超过StarvationTimeout时先发送该消息，保证低优先级的消息也能继续发送。
+	同一个通道内的消息保持发送顺序，不同通道之间的消息可能乱序
+*/
+
+// 在发送通道中排队的一帧数据
+type laneFrame struct {
+	data []byte
+	// 进入发送通道的时间
+	queued time.Time
+	// 会话中的业务消息在最后一帧上携带会话记录，写入之后记录到会话中
+	entry *sessionEntry
+}
+
+// 按权重调度各个发送通道，只在写goroutine中使用
+type laneScheduler struct {
+	lanes *[ziface.PriorityCount]chan laneFrame
+	// 每个通道每一轮可以发送的消息数量
+	weights [ziface.PriorityCount]int
+	// 每个通道在当前一轮中剩余可以发送的消息数量
+	credits [ziface.PriorityCount]int
+	// 每个通道中已经取出、等待发送的一帧
+	heads [ziface.PriorityCount]*laneFrame
+	// 排队超过该时间的消息优先发送，0表示不开启
+	starvation time.Duration
+	// 从通道中取出一帧之后发出通知，唤醒等待发送空间的发送者，为nil时不通知
+	freed *[ziface.PriorityCount]chan struct{}
+}
+
+func newLaneScheduler(lanes *[ziface.PriorityCount]chan laneFrame, weights []int, starvation time.Duration) *laneScheduler {
+	s := &laneScheduler{lanes: lanes, starvation: starvation}
+	for i := range s.weights {
+		// 没有配置或者配置错误的权重按1处理，保证每个通道都能发送
+		s.weights[i] = 1
+		if i < len(weights) && weights[i] > 0 {
+			s.weights[i] = weights[i]
+		}
+	}
+	s.credits = s.weights
+	return s
+}
+
+// 取出下一帧要发送的数据，所有通道都没有消息时阻塞，exit关闭时返回false
+func (s *laneScheduler) next(exit <-chan bool) (laneFrame, bool) {
+	if !s.fill() {
+		var frame laneFrame
+		select {
+		case frame = <-s.lanes[ziface.PriorityHigh]:
+			s.setHead(ziface.PriorityHigh, &frame)
+		case frame = <-s.lanes[ziface.PriorityNormal]:
+			s.setHead(ziface.PriorityNormal, &frame)
+		case frame = <-s.lanes[ziface.PriorityLow]:
+			s.setHead(ziface.PriorityLow, &frame)
+		case <-exit:
+			return laneFrame{}, false
+		}
+	}
+	return s.pick(), true
+}
+
+// 从每个空闲的通道中取出一帧，返回是否有等待发送的帧
+func (s *laneScheduler) fill() bool {
+	found := false
+	for i := range s.heads {
+		if s.heads[i] == nil {
+			select {
+			case frame := <-s.lanes[i]:
+				s.setHead(ziface.MsgPriority(i), &frame)
+			default:
+			}
+		}
+		if s.heads[i] != nil {
+			found = true
+		}
+	}
+	return found
+}
+
+// 记录从通道中取出的一帧，并通知通道有了空闲的空间
+func (s *laneScheduler) setHead(i ziface.MsgPriority, frame *laneFrame) {
+	s.heads[i] = frame
+	if s.freed != nil {
+		select {
+		case s.freed[i] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 从等待发送的帧中选出一帧
+func (s *laneScheduler) pick() laneFrame {
+	// 排队最久并且超过饿死时间的帧优先发送
+	if s.starvation > 0 {
+		oldest := -1
+		for i, head := range s.heads {
+			if head != nil && time.Since(head.queued) > s.starvation &&
+				(oldest < 0 || head.queued.Before(s.heads[oldest].queued)) {
+				oldest = i
+			}
+		}
+		if oldest >= 0 {
+			return s.take(oldest)
+		}
+	}
+	// 按优先级从高到低，选择当前一轮还有发送额度的通道
+	for {
+		for i, head := range s.heads {
+			if head != nil && s.credits[i] > 0 {
+				s.credits[i]--
+				return s.take(i)
+			}
+		}
+		// 有消息的通道都用完了额度，开始新的一轮
+		s.credits = s.weights
+	}
+}
+
+func (s *laneScheduler) take(i int) laneFrame {
+	frame := *s.heads[i]
+	s.heads[i] = nil
+	return frame
+}
+
+// 取出所有已经从通道中取出、还没有发送的帧，写goroutine退出时使用
+func (s *laneScheduler) takeHeads() []laneFrame {
+	var frames []laneFrame
+	for i, head := range s.heads {
+		if head != nil {
+			frames = append(frames, *head)
+			s.heads[i] = nil
+		}
+	}
+	return frames
+}
@@ -0,0 +1,59 @@
+package znet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	出站消息优先级调度的测试
+*/
+
+func TestLaneScheduler(t *testing.T) {
+	var lanes [ziface.PriorityCount]chan laneFrame
+	for i := range lanes {
+		lanes[i] = make(chan laneFrame, 16)
+	}
+	push := func(priority ziface.MsgPriority, n int, queued time.Time) {
+		for i := 0; i < n; i++ {
+			lanes[priority] <- laneFrame{data: []byte{byte('H' + priority)}, queued: queued}
+		}
+	}
+	exit := make(chan bool)
+	order := func(s *laneScheduler, n int) string {
+		var got []byte
+		for i := 0; i < n; i++ {
+			frame, ok := s.next(exit)
+			if !ok {
+				t.Fatal("scheduler exited")
+			}
+			got = append(got, frame.data...)
+		}
+		return string(got)
+	}
+
+	// 所有通道都有消息时按权重轮流发送，低优先级的消息每一轮也能发送
+	now := time.Now()
+	push(ziface.PriorityHigh, 6, now)
+	push(ziface.PriorityNormal, 3, now)
+	push(ziface.PriorityLow, 3, now)
+	s := newLaneScheduler(&lanes, []int{2, 1, 1}, 0)
+	if got := order(s, 12); got != "HHIJHHIJHHIJ" {
+		t.Fatalf("unexpected send order %s", got)
+	}
+
+	// 排队超过饿死时间的低优先级消息先发送
+	push(ziface.PriorityHigh, 2, now)
+	push(ziface.PriorityLow, 1, now.Add(-time.Second))
+	s = newLaneScheduler(&lanes, []int{8, 4, 1}, 100*time.Millisecond)
+	if got := order(s, 3); got != "JHH" {
+		t.Fatalf("unexpected send order %s", got)
+	}
+
+	close(exit)
+	if _, ok := s.next(exit); ok {
+		t.Fatal("scheduler not exited")
+	}
+}
@@ -0,0 +1,300 @@
+package znet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	协议握手
+	连接建立后客户端先发送hello:
+		魔数"ZINX"(4字节) + 协议版本 uint16(2字节) + 支持的特性 uint16(2字节) + 压缩算法列表长度 uint8(1字节) + 逗号分隔的压缩算法列表
+		版本2起再加上 编码列表长度 uint8(1字节) + 逗号分隔的消息编码列表
+	服务端回复:
+		魔数"ZINX"(4字节) + 状态 uint8(1字节) + 协议版本 uint16(2字节) + 使用的特性 uint16(2字节) + 文本长度 uint8(1字节) + 文本
+		版本2起握手成功时再加上 编码长度 uint8(1字节) + 选择的消息编码
+	状态为ProtocolAccepted时文本为选择的压缩算法，否则为拒绝的原因，服务端发送拒绝回复之后关闭连接。
+	服务端开启会话加密时加密是必需的特性，客户端不支持时握手被拒绝；
+	校验和只在双方都支持时使用，压缩算法优先选择服务端配置的算法，否则选择客户端列表中第一个服务端也注册了的算法。
+	消息编码由业务使用，框架不解析消息内容，服务端按Codecs的顺序选择第一个客户端也支持的编码，
+	客户端没有提供编码列表时使用服务端的第一个编码，没有共同的编码时握手被拒绝。
+	连接之后按照协商的结果进行封包和拆包
+*/
+
+// 协议魔数
+var protocolMagic = [4]byte{'Z', 'I', 'N', 'X'}
+
+// 服务端支持的协议版本范围
+const (
+	ProtocolVersion    uint16 = 2
+	MinProtocolVersion uint16 = 1
+)
+
+// 开始在hello和回复中携带消息编码的协议版本
+const codecProtocolVersion uint16 = 2
+
+// 协议特性
+const (
+	FeatureCompression uint16 = 1 << iota // 消息压缩
+	FeatureEncryption                     // 会话加密
+	FeatureChecksum                       // 消息校验和
+	FeatureTrace                          // 能够解析链路追踪扩展头
+)
+
+// 握手回复的状态
+const (
+	ProtocolAccepted           uint8 = 0 // 握手成功
+	ProtocolBadMagic           uint8 = 1 // 魔数不匹配，不是zinx协议
+	ProtocolVersionUnsupported uint8 = 2 // 协议版本不支持
+	ProtocolFeatureMissing     uint8 = 3 // 客户端缺少服务端要求的特性
+)
+
+// 客户端发送的hello
+type ProtocolHello struct {
+	Version      uint16   // 客户端支持的最高协议版本
+	Features     uint16   // 客户端支持的特性
+	Compressions []string // 客户端支持的压缩算法
+	Codecs       []string // 客户端支持的消息编码，按优先级排列
+}
+
+// 握手被拒绝时返回的错误
+type ProtocolRejectError struct {
+	Status uint8
+	Reason string
+}
+
+func (e *ProtocolRejectError) Error() string {
+	return fmt.Sprintf("protocol handshake rejected, status = %d, reason = %s", e.Status, e.Reason)
+}
+
+// 服务端协议握手，根据配置和客户端支持的特性选择协议版本、特性和消息编码，握手被拒绝时返回*ProtocolRejectError
+func ServerProtocolHandshake(conn net.Conn, conf *utils.GlobalObj) (ziface.ProtocolInfo, error) {
+	var info ziface.ProtocolInfo
+
+	// 先只读取魔数，HTTP探测等其他协议的数据可以立即被拒绝
+	var magic [4]byte
+	if _, err := io.ReadFull(conn, magic[:]); err != nil {
+		return info, errors.Wrap(err, "read protocol magic")
+	}
+	if magic != protocolMagic {
+		return info, rejectProtocol(conn, ProtocolBadMagic, "bad protocol magic")
+	}
+	hello, err := readProtocolHello(conn)
+	if err != nil {
+		return info, err
+	}
+
+	// 选择双方都支持的最高版本
+	info.Version = hello.Version
+	if info.Version > ProtocolVersion {
+		info.Version = ProtocolVersion
+	}
+	if info.Version < MinProtocolVersion {
+		return info, rejectProtocol(conn, ProtocolVersionUnsupported,
+			fmt.Sprintf("protocol version %d is not supported, need %d-%d", hello.Version, MinProtocolVersion, ProtocolVersion))
+	}
+
+	// 会话加密是必需的特性，其他特性使用双方都支持的部分
+	var features uint16
+	if conf.SessionEncryption {
+		if hello.Features&FeatureEncryption == 0 {
+			return info, rejectProtocol(conn, ProtocolFeatureMissing, "encryption is required")
+		}
+		features |= FeatureEncryption
+		info.Encryption = true
+	}
+	if conf.FrameChecksum && hello.Features&FeatureChecksum != 0 {
+		features |= FeatureChecksum
+		info.Checksum = true
+	}
+	// 服务端总是能够解析链路追踪扩展头，客户端支持时才向客户端发送
+	if hello.Features&FeatureTrace != 0 {
+		features |= FeatureTrace
+		info.Trace = true
+	}
+	if conf.Compression != "" && hello.Features&FeatureCompression != 0 {
+		if info.Compression = selectCompression(conf.Compression, hello.Compressions); info.Compression != "" {
+			features |= FeatureCompression
+		}
+	}
+	if len(conf.Codecs) > 0 {
+		if info.Codec = selectCodec(conf.Codecs, hello.Codecs); info.Codec == "" {
+			return info, rejectProtocol(conn, ProtocolFeatureMissing,
+				"no common codec, server supports "+strings.Join(conf.Codecs, ","))
+		}
+	}
+
+	if err := writeProtocolReply(conn, ProtocolAccepted, info.Version, features, info.Compression, info.Codec); err != nil {
+		return info, errors.Wrap(err, "send protocol reply")
+	}
+	return info, nil
+}
+
+// 选择压缩算法，优先使用服务端配置的算法，否则使用客户端列表中第一个已经注册的算法
+func selectCompression(preferred string, offered []string) string {
+	if slices.Contains(offered, preferred) {
+		return preferred
+	}
+	for _, name := range offered {
+		if _, err := GetCompressor(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// 按服务端的顺序选择第一个客户端也支持的编码，客户端没有提供编码列表时使用服务端的第一个编码
+func selectCodec(supported, offered []string) string {
+	if len(offered) == 0 {
+		return supported[0]
+	}
+	for _, codec := range supported {
+		if slices.Contains(offered, codec) {
+			return codec
+		}
+	}
+	return ""
+}
+
+// 客户端协议握手，返回服务端选择的协议信息，握手被拒绝时返回*ProtocolRejectError
+func ClientProtocolHandshake(conn net.Conn, hello ProtocolHello) (ziface.ProtocolInfo, error) {
+	var info ziface.ProtocolInfo
+
+	compressions := strings.Join(hello.Compressions, ",")
+	if len(compressions) > 255 {
+		return info, errors.New("too many compressions in protocol hello")
+	}
+	codecs := strings.Join(hello.Codecs, ",")
+	if len(codecs) > 255 {
+		return info, errors.New("too many codecs in protocol hello")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 10+len(compressions)+len(codecs)))
+	buf.Write(protocolMagic[:])
+	binary.Write(buf, binary.LittleEndian, hello.Version)
+	binary.Write(buf, binary.LittleEndian, hello.Features)
+	buf.WriteByte(uint8(len(compressions)))
+	buf.WriteString(compressions)
+	if hello.Version >= codecProtocolVersion {
+		buf.WriteByte(uint8(len(codecs)))
+		buf.WriteString(codecs)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return info, errors.Wrap(err, "send protocol hello")
+	}
+
+	var head [10]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return info, errors.Wrap(err, "read protocol reply")
+	}
+	if !bytes.Equal(head[:4], protocolMagic[:]) {
+		return info, errors.New("bad protocol magic in reply")
+	}
+	text := make([]byte, head[9])
+	if _, err := io.ReadFull(conn, text); err != nil {
+		return info, errors.Wrap(err, "read protocol reply")
+	}
+	if status := head[4]; status != ProtocolAccepted {
+		return info, &ProtocolRejectError{Status: status, Reason: string(text)}
+	}
+
+	features := binary.LittleEndian.Uint16(head[7:9])
+	info.Version = binary.LittleEndian.Uint16(head[5:7])
+	info.Encryption = features&FeatureEncryption != 0
+	info.Checksum = features&FeatureChecksum != 0
+	info.Trace = features&FeatureTrace != 0
+	if features&FeatureCompression != 0 {
+		info.Compression = string(text)
+	}
+	if info.Version >= codecProtocolVersion {
+		codec, err := readShortString(conn)
+		if err != nil {
+			return info, errors.Wrap(err, "read protocol reply")
+		}
+		info.Codec = codec
+	}
+	return info, nil
+}
+
+// 读取 长度 uint8(1字节) + 文本
+func readShortString(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	text := make([]byte, size[0])
+	if _, err := io.ReadFull(r, text); err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// 解析逗号分隔的列表
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// 读取魔数之后的hello内容
+func readProtocolHello(conn net.Conn) (*ProtocolHello, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, errors.Wrap(err, "read protocol hello")
+	}
+	hello := &ProtocolHello{
+		Version:  binary.LittleEndian.Uint16(head[0:2]),
+		Features: binary.LittleEndian.Uint16(head[2:4]),
+	}
+	if head[4] > 0 {
+		compressions := make([]byte, head[4])
+		if _, err := io.ReadFull(conn, compressions); err != nil {
+			return nil, errors.Wrap(err, "read protocol hello")
+		}
+		hello.Compressions = strings.Split(string(compressions), ",")
+	}
+	if hello.Version >= codecProtocolVersion {
+		codecs, err := readShortString(conn)
+		if err != nil {
+			return nil, errors.Wrap(err, "read protocol hello")
+		}
+		hello.Codecs = splitList(codecs)
+	}
+	return hello, nil
+}
+
+// 发送握手回复，握手成功并且版本支持时携带选择的消息编码
+func writeProtocolReply(conn net.Conn, status uint8, version, features uint16, text, codec string) error {
+	if len(text) > 255 {
+		text = text[:255]
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 11+len(text)+len(codec)))
+	buf.Write(protocolMagic[:])
+	buf.WriteByte(status)
+	binary.Write(buf, binary.LittleEndian, version)
+	binary.Write(buf, binary.LittleEndian, features)
+	buf.WriteByte(uint8(len(text)))
+	buf.WriteString(text)
+	if status == ProtocolAccepted && version >= codecProtocolVersion {
+		buf.WriteByte(uint8(len(codec)))
+		buf.WriteString(codec)
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+// 发送拒绝回复，返回对应的错误
+func rejectProtocol(conn net.Conn, status uint8, reason string) error {
+	writeProtocolReply(conn, status, ProtocolVersion, 0, reason, "")
+	return &ProtocolRejectError{Status: status, Reason: reason}
+}
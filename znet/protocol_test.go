@@ -0,0 +1,95 @@
+package znet
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	协议握手的测试
+*/
+
+func TestProtocolHandshake(t *testing.T) {
+	conf := *utils.GlobalObject
+	conf.Compression = "gzip"
+	conf.FrameChecksum = true
+	conf.SessionEncryption = true
+	conf.Codecs = []string{"protobuf", "json"}
+
+	handshake := func(hello ProtocolHello) (ziface.ProtocolInfo, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go ServerProtocolHandshake(server, &conf)
+		return ClientProtocolHandshake(client, hello)
+	}
+
+	// 客户端支持服务端的所有特性
+	info, err := handshake(ProtocolHello{
+		Version:      ProtocolVersion + 1,
+		Features:     FeatureCompression | FeatureChecksum | FeatureEncryption,
+		Compressions: []string{"deflate", "gzip"},
+		Codecs:       []string{"json", "protobuf"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != ProtocolVersion || info.Compression != "gzip" || !info.Checksum || !info.Encryption || info.Codec != "protobuf" {
+		t.Fatalf("unexpected protocol info %+v", info)
+	}
+
+	// 客户端不支持校验和和服务端的压缩算法时使用双方都支持的部分
+	info, err = handshake(ProtocolHello{
+		Version:      ProtocolVersion,
+		Features:     FeatureCompression | FeatureEncryption,
+		Compressions: []string{"snappy", "deflate"},
+		Codecs:       []string{"json"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Compression != "deflate" || info.Checksum || info.Codec != "json" {
+		t.Fatalf("unexpected protocol info %+v", info)
+	}
+
+	// 旧版本的客户端不协商编码
+	info, err = handshake(ProtocolHello{Version: MinProtocolVersion, Features: FeatureEncryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != MinProtocolVersion || info.Compression != "" || info.Codec != "" {
+		t.Fatalf("unexpected protocol info %+v", info)
+	}
+
+	// 缺少必需的会话加密
+	_, err = handshake(ProtocolHello{Version: ProtocolVersion, Features: FeatureCompression | FeatureChecksum, Compressions: []string{"gzip"}})
+	if e, ok := err.(*ProtocolRejectError); !ok || e.Status != ProtocolFeatureMissing {
+		t.Fatalf("missing encryption not rejected: %v", err)
+	}
+
+	// 没有共同的编码
+	_, err = handshake(ProtocolHello{Version: ProtocolVersion, Features: FeatureEncryption, Codecs: []string{"msgpack"}})
+	if e, ok := err.(*ProtocolRejectError); !ok || e.Status != ProtocolFeatureMissing {
+		t.Fatalf("no common codec not rejected: %v", err)
+	}
+
+	// 不支持的协议版本
+	_, err = handshake(ProtocolHello{Version: 0})
+	if e, ok := err.(*ProtocolRejectError); !ok || e.Status != ProtocolVersionUnsupported {
+		t.Fatalf("bad version not rejected: %v", err)
+	}
+
+	// HTTP探测直接被拒绝
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	go io.Copy(io.Discard, client)
+	if _, err := ServerProtocolHandshake(server, &conf); err == nil {
+		t.Fatal("http probe not rejected")
+	}
+}
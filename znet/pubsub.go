@@ -0,0 +1,267 @@
+package znet
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	服务器内的主题发布订阅
+	连接通过Subscribe订阅主题或者通配符模式，服务端代码通过Publish向主题发布消息，
+	消息通过每个订阅连接自己的发送队列投递，一个连接匹配多个订阅时只收到一次。
+	连接停止时自动取消所有订阅
+*/
+
+// 最多保留统计的主题数量，超过时淘汰最久没有发布的主题
+const maxTopicStats = 10000
+
+// 使用通配符的订阅
+type wildcardSub struct {
+	segments []string
+	conns    map[uint32]ziface.IConnection
+}
+
+type PubSub struct {
+	// 不含通配符的订阅，主题 -> 连接ID -> 连接
+	exact map[string]map[uint32]ziface.IConnection
+	// 含通配符的订阅，模式 -> 订阅
+	wildcard map[string]*wildcardSub
+	// 每个连接订阅的主题和模式，用于连接停止时清理
+	connSubs map[uint32]map[string]bool
+	// 保护订阅关系的读写锁
+	lock sync.RWMutex
+	// 每个主题的统计
+	stats     map[string]*ziface.TopicStats
+	statsLock sync.Mutex
+}
+
+// 创建发布订阅管理器
+func NewPubSub() *PubSub {
+	return &PubSub{
+		exact:    make(map[string]map[uint32]ziface.IConnection),
+		wildcard: make(map[string]*wildcardSub),
+		connSubs: make(map[uint32]map[string]bool),
+		stats:    make(map[string]*ziface.TopicStats),
+	}
+}
+
+// 校验主题或者模式，返回是否包含通配符
+func parseTopic(pattern string, allowWildcard bool) ([]string, bool, error) {
+	if pattern == "" {
+		return nil, false, errors.New("empty topic")
+	}
+	segments := strings.Split(pattern, ".")
+	hasWildcard := false
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+			return nil, false, fmt.Errorf("topic %q has empty segment", pattern)
+		case segment == "*" || segment == "#":
+			if !allowWildcard {
+				return nil, false, fmt.Errorf("topic %q contains wildcard", pattern)
+			}
+			if segment == "#" && i != len(segments)-1 {
+				return nil, false, fmt.Errorf("topic %q: # must be the last segment", pattern)
+			}
+			hasWildcard = true
+		case strings.ContainsAny(segment, "*#"):
+			return nil, false, fmt.Errorf("topic %q: wildcard must be a whole segment", pattern)
+		}
+	}
+	return segments, hasWildcard, nil
+}
+
+// 主题是否匹配通配符模式
+func matchTopic(pattern, topic []string) bool {
+	for i, segment := range pattern {
+		if segment == "#" {
+			return true
+		}
+		if i >= len(topic) || (segment != "*" && segment != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// 连接订阅一个主题或者通配符模式，已经停止的连接返回ErrConnClosed
+func (ps *PubSub) Subscribe(conn ziface.IConnection, pattern string) error {
+	segments, hasWildcard, err := parseTopic(pattern, true)
+	if err != nil {
+		return err
+	}
+	connID := conn.GetConnID()
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	// 连接停止时先取消上下文再取消所有订阅，持有锁检查可以保证停止的连接不会留在订阅中
+	if conn.Context().Err() != nil {
+		return ErrConnClosed
+	}
+	if hasWildcard {
+		sub, ok := ps.wildcard[pattern]
+		if !ok {
+			sub = &wildcardSub{segments: segments, conns: make(map[uint32]ziface.IConnection)}
+			ps.wildcard[pattern] = sub
+		}
+		sub.conns[connID] = conn
+	} else {
+		conns, ok := ps.exact[pattern]
+		if !ok {
+			conns = make(map[uint32]ziface.IConnection)
+			ps.exact[pattern] = conns
+		}
+		conns[connID] = conn
+	}
+	subs, ok := ps.connSubs[connID]
+	if !ok {
+		subs = make(map[string]bool)
+		ps.connSubs[connID] = subs
+	}
+	subs[pattern] = true
+	return nil
+}
+
+// 连接取消订阅一个主题或者通配符模式
+func (ps *PubSub) Unsubscribe(conn ziface.IConnection, pattern string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.unsubscribe(conn.GetConnID(), pattern)
+}
+
+// 取消连接的所有订阅
+func (ps *PubSub) UnsubscribeAll(conn ziface.IConnection) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	connID := conn.GetConnID()
+	for pattern := range ps.connSubs[connID] {
+		ps.unsubscribe(connID, pattern)
+	}
+}
+
+// 取消订阅，调用时需要持有写锁
+func (ps *PubSub) unsubscribe(connID uint32, pattern string) {
+	if conns, ok := ps.exact[pattern]; ok {
+		delete(conns, connID)
+		if len(conns) == 0 {
+			delete(ps.exact, pattern)
+		}
+	}
+	if sub, ok := ps.wildcard[pattern]; ok {
+		delete(sub.conns, connID)
+		if len(sub.conns) == 0 {
+			delete(ps.wildcard, pattern)
+		}
+	}
+	if subs, ok := ps.connSubs[connID]; ok {
+		delete(subs, pattern)
+		if len(subs) == 0 {
+			delete(ps.connSubs, connID)
+		}
+	}
+}
+
+// 获取连接的所有订阅
+func (ps *PubSub) GetSubscriptions(conn ziface.IConnection) []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	patterns := make([]string, 0, len(ps.connSubs[conn.GetConnID()]))
+	for pattern := range ps.connSubs[conn.GetConnID()] {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// 向主题发布消息，返回投递成功的连接数量
+func (ps *PubSub) Publish(topic string, msgID uint32, data []byte) int {
+	return ps.PublishWithPriority(topic, ziface.PriorityNormal, msgID, data)
+}
+
+// 按优先级向主题发布消息，返回投递成功的连接数量
+func (ps *PubSub) PublishWithPriority(topic string, priority ziface.MsgPriority, msgID uint32, data []byte) int {
+	segments, _, err := parseTopic(topic, false)
+	if err != nil {
+		fmt.Println("[zinx] publish err:", err)
+		return 0
+	}
+
+	// 找到所有匹配的连接，一个连接只投递一次
+	ps.lock.RLock()
+	targets := make(map[uint32]ziface.IConnection, len(ps.exact[topic]))
+	for connID, conn := range ps.exact[topic] {
+		targets[connID] = conn
+	}
+	for _, sub := range ps.wildcard {
+		if matchTopic(sub.segments, segments) {
+			for connID, conn := range sub.conns {
+				targets[connID] = conn
+			}
+		}
+	}
+	ps.lock.RUnlock()
+
+	// 在锁外非阻塞地放入每个连接的发送队列，慢的连接不会阻塞发布者和其他订阅者，
+	// 发送队列已满或者已经停止的连接计入投递失败
+	delivered := 0
+	for _, conn := range targets {
+		if err := conn.TrySendMsg(priority, msgID, data); err != nil {
+			fmt.Println("[zinx] publish to ConnID = ", conn.GetConnID(), " err:", err)
+			continue
+		}
+		delivered++
+	}
+	ps.record(topic, len(targets), delivered)
+	return delivered
+}
+
+// 记录一次发布的统计
+func (ps *PubSub) record(topic string, subscribers, delivered int) {
+	ps.statsLock.Lock()
+	defer ps.statsLock.Unlock()
+	stats, ok := ps.stats[topic]
+	if !ok {
+		if len(ps.stats) >= maxTopicStats {
+			ps.evictStats()
+		}
+		stats = &ziface.TopicStats{Topic: topic}
+		ps.stats[topic] = stats
+	}
+	stats.Subscribers = subscribers
+	stats.Published++
+	stats.Delivered += uint64(delivered)
+	stats.Failed += uint64(subscribers - delivered)
+	stats.LastPublish = time.Now()
+}
+
+// 淘汰最久没有发布的主题统计，调用时需要持有statsLock
+func (ps *PubSub) evictStats() {
+	var oldest *ziface.TopicStats
+	for _, stats := range ps.stats {
+		if oldest == nil || stats.LastPublish.Before(oldest.LastPublish) {
+			oldest = stats
+		}
+	}
+	if oldest != nil {
+		delete(ps.stats, oldest.Topic)
+	}
+}
+
+// 获取所有发布过消息的主题的统计，按主题排序
+func (ps *PubSub) GetTopicStats() []ziface.TopicStats {
+	ps.statsLock.Lock()
+	defer ps.statsLock.Unlock()
+	all := make([]ziface.TopicStats, 0, len(ps.stats))
+	for _, stats := range ps.stats {
+		all = append(all, *stats)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Topic < all[j].Topic })
+	return all
+}
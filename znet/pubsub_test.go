@@ -0,0 +1,67 @@
+package znet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	发布订阅扇出的测试
+*/
+
+// 发送队列已满或者已经停止的订阅连接不阻塞发布者，计入投递失败
+func TestPublishDropsSlowSubscriber(t *testing.T) {
+	s := NewServer("pubsub", WithPriorityLanes(1, nil, 0))
+	raw, peer := net.Pipe()
+	defer raw.Close()
+	defer peer.Close()
+	// 连接没有启动，写goroutine不会取出发送队列中的消息
+	conn := NewConnection(s, raw, 1, s.MsgHandler)
+	if err := s.PubSub.Subscribe(conn, "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.PubSub.Publish("room", 30, nil); n != 1 {
+		t.Fatalf("first publish delivered to %d conns", n)
+	}
+	if n := s.PubSub.Publish("room", 30, nil); n != 0 {
+		t.Fatalf("publish to full queue delivered to %d conns", n)
+	}
+	if err := conn.TrySendMsg(ziface.PriorityNormal, 30, nil); err != ErrSendQueueFull {
+		t.Fatalf("TrySendMsg on full queue = %v", err)
+	}
+
+	conn.cancel()
+	if n := s.PubSub.PublishWithPriority("room", ziface.PriorityHigh, 30, nil); n != 0 {
+		t.Fatalf("publish to closed conn delivered to %d conns", n)
+	}
+	if err := conn.SendMsg(30, nil); err != ErrConnClosed {
+		t.Fatalf("SendMsg on closed conn = %v", err)
+	}
+
+	stats := s.PubSub.GetTopicStats()
+	if len(stats) != 1 || stats[0].Published != 3 || stats[0].Delivered != 1 || stats[0].Failed != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// 停止之后的连接不能再订阅，不会留在订阅中
+func TestSubscribeStoppedConn(t *testing.T) {
+	s := NewServer("pubsub")
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	conn := NewConnection(s, raw, 1, s.MsgHandler)
+	conn.Stop()
+
+	if err := s.PubSub.Subscribe(conn, "room"); err != ErrConnClosed {
+		t.Fatalf("Subscribe on stopped conn = %v", err)
+	}
+	if n := s.PubSub.Publish("room", 30, nil); n != 0 {
+		t.Fatalf("publish delivered to %d conns", n)
+	}
+	if stats := s.PubSub.GetTopicStats(); len(stats) != 1 || stats[0].Failed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,302 @@
+package znet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	可靠投递
+	通过SetReliable为msgID开启可靠投递，发送时在连接上分配递增的序号，
+	消息带MsgFlagReliable标志，消息体前携带序号 uint64(8字节)。
+	对端收到后回复RELIABLE_ACK_MSG_ID，消息体为一个或多个序号。
+	没有确认的消息保留在连接上，开启会话恢复时随会话保留，客户端恢复会话后重新发送；
+	没有开启会话恢复或者会话过期时，这些消息被报告为投递失败。
+	接收方按序号丢弃重复的可靠消息，服务端收到客户端的可靠消息时同样回复确认并去重；
+	服务端没有开启可靠投递，或者序号超出接收窗口时，客户端的可靠消息计为协议违规
+*/
+
+// 可靠投递序号的长度
+const seqExtLen = 8
+
+// 接收对端可靠消息的窗口，序号超过recvSeq+reliableRecvWindow的消息被拒绝，
+// 乱序到达的序号最多保留这么多个
+const reliableRecvWindow = 4096
+
+// 在buf后追加可靠投递的序号
+func appendSeq(buf []byte, seq uint64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, seq)
+}
+
+// 从消息体中取出可靠投递的序号
+func decodeSeq(msg ziface.IMessage) error {
+	data := msg.GetData()
+	if len(data) < seqExtLen {
+		return errors.New("reliable seq too short")
+	}
+	seq := binary.LittleEndian.Uint64(data)
+	if seq == 0 {
+		return errors.New("invalid reliable seq 0")
+	}
+	msg.SetSeq(seq)
+	msg.SetData(data[seqExtLen:])
+	msg.SetMsgLen(uint32(len(data) - seqExtLen))
+	msg.SetFlags(msg.GetFlags() &^ MsgFlagReliable)
+	return nil
+}
+
+// 编码确认消息的内容
+func EncodeAck(seqs ...uint64) []byte {
+	data := make([]byte, 0, len(seqs)*seqExtLen)
+	for _, seq := range seqs {
+		data = appendSeq(data, seq)
+	}
+	return data
+}
+
+// 解码确认消息的内容
+func DecodeAck(data []byte) ([]uint64, error) {
+	if len(data) == 0 || len(data)%seqExtLen != 0 {
+		return nil, errors.New("malformed ack")
+	}
+	seqs := make([]uint64, 0, len(data)/seqExtLen)
+	for i := 0; i < len(data); i += seqExtLen {
+		seqs = append(seqs, binary.LittleEndian.Uint64(data[i:]))
+	}
+	return seqs, nil
+}
+
+// 一条还没有被确认的可靠消息
+type reliableMsg struct {
+	seq   uint64
+	msgID uint32
+	data  []byte
+	// 发送时的优先级，重新发送时保持不变
+	priority ziface.MsgPriority
+}
+
+// 连接的可靠投递状态，开启会话恢复时随会话在连接之间传递
+type reliableState struct {
+	// 最后分配的发送序号
+	sendSeq uint64
+	// 没有确认的消息，按序号排列
+	pending []reliableMsg
+	// 该序号及之前的对端可靠消息都已经收到
+	recvSeq uint64
+	// 收到的大于recvSeq的序号，不同优先级的消息可能乱序到达
+	recvAhead map[uint64]bool
+	lock      sync.Mutex
+}
+
+// 为要发送的消息分配序号
+func (rs *reliableState) add(msgID uint32, data []byte, priority ziface.MsgPriority, maxPending int) (uint64, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if maxPending > 0 && len(rs.pending) >= maxPending {
+		return 0, errors.New("too many unacknowledged reliable msgs")
+	}
+	rs.sendSeq++
+	rs.pending = append(rs.pending, reliableMsg{seq: rs.sendSeq, msgID: msgID, data: data, priority: priority})
+	return rs.sendSeq, nil
+}
+
+// 确认一条消息，返回被确认的消息
+func (rs *reliableState) ack(seq uint64) (reliableMsg, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	i := sort.Search(len(rs.pending), func(i int) bool { return rs.pending[i].seq >= seq })
+	if i == len(rs.pending) || rs.pending[i].seq != seq {
+		return reliableMsg{}, false
+	}
+	msg := rs.pending[i]
+	rs.pending = append(rs.pending[:i], rs.pending[i+1:]...)
+	return msg, true
+}
+
+// 获取所有没有确认的消息
+func (rs *reliableState) unacked() []reliableMsg {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return append([]reliableMsg(nil), rs.pending...)
+}
+
+// 取出所有没有确认的消息，之后不再等待确认
+func (rs *reliableState) takeUnacked() []reliableMsg {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	pending := rs.pending
+	rs.pending = nil
+	return pending
+}
+
+// 收到对端的可靠消息，返回是否是第一次收到，序号超出接收窗口时返回错误
+func (rs *reliableState) receive(seq uint64) (bool, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if seq <= rs.recvSeq || rs.recvAhead[seq] {
+		return false, nil
+	}
+	if seq-rs.recvSeq > reliableRecvWindow {
+		return false, errors.Errorf("reliable seq %d out of window, received up to %d", seq, rs.recvSeq)
+	}
+	if seq != rs.recvSeq+1 {
+		if len(rs.recvAhead) >= reliableRecvWindow {
+			return false, errors.New("too many out of order reliable msgs")
+		}
+		if rs.recvAhead == nil {
+			rs.recvAhead = make(map[uint64]bool)
+		}
+		rs.recvAhead[seq] = true
+		return true, nil
+	}
+	// 连续收到之后推进recvSeq
+	rs.recvSeq = seq
+	for rs.recvAhead[rs.recvSeq+1] {
+		delete(rs.recvAhead, rs.recvSeq+1)
+		rs.recvSeq++
+	}
+	return true, nil
+}
+
+type ReliableManager struct {
+	// 开启可靠投递的msgID
+	msgIDs map[uint32]bool
+	// 每个连接最多保留的没有确认的消息数量，0表示不限制
+	maxPending int
+	// 投递状态变化时的回调
+	onDelivery ziface.DeliveryCallback
+	lock       sync.RWMutex
+}
+
+// 创建可靠投递管理器
+func NewReliableManager(maxPending int) *ReliableManager {
+	return &ReliableManager{
+		msgIDs:     make(map[uint32]bool),
+		maxPending: maxPending,
+	}
+}
+
+// 为msgID开启可靠投递
+func (rm *ReliableManager) SetReliable(msgIDs ...uint32) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	for _, msgID := range msgIDs {
+		rm.msgIDs[msgID] = true
+	}
+}
+
+// msgID是否开启了可靠投递
+func (rm *ReliableManager) IsReliable(msgID uint32) bool {
+	rm.lock.RLock()
+	defer rm.lock.RUnlock()
+	return rm.msgIDs[msgID]
+}
+
+// 是否有msgID开启了可靠投递
+func (rm *ReliableManager) enabled() bool {
+	rm.lock.RLock()
+	defer rm.lock.RUnlock()
+	return len(rm.msgIDs) > 0
+}
+
+// 设置投递状态变化时的回调
+func (rm *ReliableManager) SetOnDelivery(callback ziface.DeliveryCallback) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	rm.onDelivery = callback
+}
+
+// 报告消息的投递状态
+func (rm *ReliableManager) report(conn ziface.IConnection, msgID uint32, seq uint64, status ziface.DeliveryStatus) {
+	rm.lock.RLock()
+	callback := rm.onDelivery
+	rm.lock.RUnlock()
+	if callback != nil {
+		callback(conn, msgID, seq, status)
+	}
+}
+
+// 为可靠投递的消息分配序号
+func (c *Connection) prepareReliable(msg ziface.IMessage, priority ziface.MsgPriority) error {
+	if c.reliableMgr == nil || msg.GetSeq() != 0 || !c.reliableMgr.IsReliable(msg.GetMsgId()) {
+		return nil
+	}
+	seq, err := c.reliable.Load().add(msg.GetMsgId(), msg.GetData(), priority, c.reliableMgr.maxPending)
+	if err != nil {
+		return err
+	}
+	msg.SetSeq(seq)
+	return nil
+}
+
+// 消息没有进入发送队列时取消等待确认，并报告投递失败
+func (c *Connection) cancelReliable(msg ziface.IMessage) {
+	if c.reliableMgr == nil || msg.GetSeq() == 0 {
+		return
+	}
+	if pending, ok := c.reliable.Load().ack(msg.GetSeq()); ok {
+		c.reliableMgr.report(c, pending.msgID, pending.seq, ziface.DeliveryFailed)
+	}
+}
+
+// 收到对端的可靠消息时回复确认，返回消息是否需要处理，重复的消息不再处理
+// 没有开启可靠投递或者序号超出接收窗口的消息计为协议违规，不回复确认也不处理
+func (c *Connection) receiveReliable(seq uint64) bool {
+	if c.reliableMgr == nil || !c.reliableMgr.enabled() {
+		fmt.Println("ConnID = ", c.ConnID, " drop reliable msg, reliable delivery is not enabled")
+		c.AddProtocolViolation(1)
+		return false
+	}
+	fresh, err := c.reliable.Load().receive(seq)
+	if err != nil {
+		fmt.Println("ConnID = ", c.ConnID, " drop reliable msg: ", err)
+		c.AddProtocolViolation(1)
+		return false
+	}
+	c.writeMsg(NewMsgPackage(utils.RELIABLE_ACK_MSG_ID, EncodeAck(seq)), ziface.PriorityHigh)
+	if !fresh {
+		fmt.Println("ConnID = ", c.ConnID, " drop duplicate reliable msg seq = ", seq)
+		return false
+	}
+	return true
+}
+
+// 连接断开并且无法恢复时，所有没有确认的消息投递失败
+func (c *Connection) failUnacked() {
+	if c.reliableMgr == nil {
+		return
+	}
+	for _, msg := range c.reliable.Load().takeUnacked() {
+		c.reliableMgr.report(c, msg.msgID, msg.seq, ziface.DeliveryFailed)
+	}
+}
+
+// 处理对端的可靠消息确认
+type ReliableAckRouter struct {
+	BaseRouter
+}
+
+func (r *ReliableAckRouter) Handle(request ziface.IRequest) {
+	c, ok := request.GetConnection().(*Connection)
+	if !ok || c.reliableMgr == nil {
+		return
+	}
+	seqs, err := DecodeAck(request.GetData())
+	if err != nil {
+		c.AddProtocolViolation(1)
+		return
+	}
+	state := c.reliable.Load()
+	for _, seq := range seqs {
+		if msg, ok := state.ack(seq); ok {
+			c.reliableMgr.report(c, msg.msgID, seq, ziface.DeliveryAcked)
+		}
+	}
+}
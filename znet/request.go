@@ -1,10 +1,21 @@
 package znet
 
-import "github.com/Xaytick/zinx/ziface"
+import (
+	"context"
+
+	"github.com/Xaytick/zinx/ziface"
+)
 
 type Request struct {
 	conn ziface.IConnection
 	msg  ziface.IMessage
+	// 请求的上下文，派生自连接的上下文
+	ctx context.Context
+}
+
+// 创建一个请求，上下文为连接的上下文，用于在读goroutine之外把消息交给MsgHandler处理
+func NewRequest(conn ziface.IConnection, msg ziface.IMessage) *Request {
+	return &Request{conn: conn, msg: msg, ctx: conn.Context()}
 }
 
 func (r *Request) GetConnection() ziface.IConnection {
@@ -18,3 +29,21 @@ func (r *Request) GetData() []byte {
 func (r *Request) GetMsgID() uint32 {
 	return r.msg.GetMsgId()
 }
+
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+func (r *Request) GetTrace() ziface.TraceContext {
+	if trace, ok := TraceFromContext(r.Context()); ok {
+		return trace
+	}
+	return r.msg.GetTrace()
+}
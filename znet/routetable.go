@@ -0,0 +1,155 @@
+package znet
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	写时复制的路由表
+	worker读取路由时不加锁，直接使用当前的路由表；
+	注册、删除和替换路由时复制一份新的路由表修改，再整体替换，
+	因此可以在Server运行期间安全地修改路由
+*/
+
+type routeTable struct {
+	// 每个MsgID所对应的处理方法
+	apis map[uint32]ziface.IRouter
+	// 按区间或掩码匹配的路由，匹配范围更小的在前
+	patterns []patternRoute
+	// 默认路由，为nil时没有匹配的消息作为未知消息处理
+	defaultRouter ziface.IRouter
+	// 每个MsgID的处理超时时间
+	timeouts map[uint32]time.Duration
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		apis:     make(map[uint32]ziface.IRouter),
+		timeouts: make(map[uint32]time.Duration),
+	}
+}
+
+// 复制一份路由表
+func (rt *routeTable) clone() *routeTable {
+	nrt := &routeTable{
+		apis:          make(map[uint32]ziface.IRouter, len(rt.apis)),
+		patterns:      append([]patternRoute(nil), rt.patterns...),
+		defaultRouter: rt.defaultRouter,
+		timeouts:      make(map[uint32]time.Duration, len(rt.timeouts)),
+	}
+	for msgID, router := range rt.apis {
+		nrt.apis[msgID] = router
+	}
+	for msgID, timeout := range rt.timeouts {
+		nrt.timeouts[msgID] = timeout
+	}
+	return nrt
+}
+
+// 获取当前的路由表
+func (mh *MsgHandler) getRoutes() *routeTable {
+	return mh.routes.Load()
+}
+
+// 复制当前的路由表进行修改，modify返回错误时不替换
+func (mh *MsgHandler) updateRoutes(modify func(rt *routeTable) error) error {
+	mh.routeLock.Lock()
+	defer mh.routeLock.Unlock()
+	rt := mh.routes.Load().clone()
+	if err := modify(rt); err != nil {
+		return err
+	}
+	mh.routes.Store(rt)
+	return nil
+}
+
+// 为消息添加具体的处理逻辑，msgID已经注册时返回错误
+func (mh *MsgHandler) AddRouter(msgID uint32, router ziface.IRouter) error {
+	err := mh.updateRoutes(func(rt *routeTable) error {
+		if _, ok := rt.apis[msgID]; ok {
+			return fmt.Errorf("repeat api, msgID = %d", msgID)
+		}
+		rt.apis[msgID] = router
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Add api msgID = ", msgID)
+	return nil
+}
+
+// 删除消息的处理逻辑，msgID没有注册时返回错误
+func (mh *MsgHandler) RemoveRouter(msgID uint32) error {
+	err := mh.updateRoutes(func(rt *routeTable) error {
+		if _, ok := rt.apis[msgID]; !ok {
+			return fmt.Errorf("api msgID = %d is not found", msgID)
+		}
+		delete(rt.apis, msgID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Remove api msgID = ", msgID)
+	return nil
+}
+
+// 替换消息的处理逻辑，msgID没有注册时直接添加，返回被替换的路由
+func (mh *MsgHandler) ReplaceRouter(msgID uint32, router ziface.IRouter) ziface.IRouter {
+	var old ziface.IRouter
+	mh.updateRoutes(func(rt *routeTable) error {
+		old = rt.apis[msgID]
+		rt.apis[msgID] = router
+		return nil
+	})
+	fmt.Println("Replace api msgID = ", msgID)
+	return old
+}
+
+// 获取某个msgID精确注册的路由
+func (mh *MsgHandler) GetRouter(msgID uint32) (ziface.IRouter, bool) {
+	router, ok := mh.getRoutes().apis[msgID]
+	return router, ok
+}
+
+// 设置msgID的处理超时时间，超时后请求的上下文被取消，timeout不大于0时取消限制
+func (mh *MsgHandler) SetHandlerTimeout(msgID uint32, timeout time.Duration) {
+	mh.updateRoutes(func(rt *routeTable) error {
+		if timeout > 0 {
+			rt.timeouts[msgID] = timeout
+		} else {
+			delete(rt.timeouts, msgID)
+		}
+		return nil
+	})
+}
+
+// 一个已注册路由的描述
+type RouteInfo struct {
+	Kind    string `json:"kind"`              // exact、pattern或default
+	MsgID   uint32 `json:"msgId,omitempty"`   // 精确路由的msgID
+	Pattern string `json:"pattern,omitempty"` // 区间或掩码路由的匹配规则
+	Router  string `json:"router"`            // 路由的类型名称
+}
+
+// 获取所有已注册的路由，精确路由按msgID排序，区间和掩码路由按匹配顺序排列
+func (mh *MsgHandler) GetRoutes() []RouteInfo {
+	rt := mh.getRoutes()
+	routes := make([]RouteInfo, 0, len(rt.apis)+len(rt.patterns)+1)
+	for msgID, router := range rt.apis {
+		routes = append(routes, RouteInfo{Kind: "exact", MsgID: msgID, Router: fmt.Sprintf("%T", router)})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].MsgID < routes[j].MsgID })
+	for _, route := range rt.patterns {
+		routes = append(routes, RouteInfo{Kind: "pattern", Pattern: route.desc, Router: fmt.Sprintf("%T", route.router)})
+	}
+	if rt.defaultRouter != nil {
+		routes = append(routes, RouteInfo{Kind: "default", Router: fmt.Sprintf("%T", rt.defaultRouter)})
+	}
+	return routes
+}
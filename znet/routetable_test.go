@@ -0,0 +1,91 @@
+package znet
+
+import (
+	"sync"
+	"testing"
+)
+
+/*
+	路由表的测试
+*/
+
+// 带名字的路由，避免空结构体的指针相等
+type namedRouter struct {
+	BaseRouter
+	name string
+}
+
+func TestRouteTable(t *testing.T) {
+	mh := NewMsgHandlerWithPool(0, 0)
+	exact, ranged := &namedRouter{name: "exact"}, &namedRouter{name: "range"}
+	masked, fallback := &namedRouter{name: "mask"}, &namedRouter{name: "default"}
+
+	if err := mh.AddRouter(1, exact); err != nil {
+		t.Fatal(err)
+	}
+	if err := mh.AddRouter(1, exact); err == nil {
+		t.Fatal("duplicate router accepted")
+	}
+	if err := mh.AddRangeRouter(100, 199, ranged); err != nil {
+		t.Fatal(err)
+	}
+	if err := mh.AddRangeRouter(100, 199, ranged); err == nil {
+		t.Fatal("duplicate range router accepted")
+	}
+	if err := mh.AddRangeRouter(300, 200, ranged); err == nil {
+		t.Fatal("reversed range router accepted")
+	}
+	if err := mh.AddMaskRouter(0xFFFFFFF0, 0x110, masked); err != nil {
+		t.Fatal(err)
+	}
+	if err := mh.AddMaskRouter(0xFFFFFFF0, 0x11F, masked); err == nil {
+		t.Fatal("duplicate mask router accepted")
+	}
+
+	// 精确路由优先，区间重叠时范围更小的优先
+	if r, _ := mh.findRouter(1); r != exact {
+		t.Fatal("exact router not matched")
+	}
+	if r, _ := mh.findRouter(150); r != ranged {
+		t.Fatal("range router not matched")
+	}
+	if r, _ := mh.findRouter(0x115); r != masked {
+		t.Fatal("mask router not matched")
+	}
+	if _, ok := mh.findRouter(500); ok {
+		t.Fatal("unknown msgID matched")
+	}
+	mh.SetDefaultRouter(fallback)
+	if r, _ := mh.findRouter(500); r != fallback {
+		t.Fatal("default router not matched")
+	}
+
+	// 运行期间并发修改和读取路由
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := uint32(1000); i < 2000; i++ {
+			mh.AddRouter(i, exact)
+			mh.ReplaceRouter(i, ranged)
+			mh.RemoveRouter(i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := uint32(1000); i < 2000; i++ {
+			mh.findRouter(i)
+		}
+	}()
+	wg.Wait()
+
+	if err := mh.RemoveRouter(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := mh.RemoveRouter(1); err == nil {
+		t.Fatal("remove missing router succeeded")
+	}
+	if old := mh.ReplaceRouter(2, exact); old != nil {
+		t.Fatal("replace missing router returned old router")
+	}
+}
@@ -0,0 +1,214 @@
+package znet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	会话加密
+	连接建立时客户端先发送SESSION_KEY_MSG_ID消息携带X25519公钥，服务端回复自己的公钥，
+	双方使用HKDF从共享密钥中为两个方向分别派生AES-256密钥，
+	之后所有数据以记录的形式传输：uint32长度(4字节) + AES-GCM密文，
+	一个记录的明文不超过一个完整的数据包，即消息头加上最大包长度。
+	每个方向各自维护一个递增的序号作为nonce，序号不在报文中传输，重放、乱序或者丢失的记录都会导致解密失败
+*/
+
+// 派生的密钥长度，使用AES-256
+const sessionKeyLen = 32
+
+type secureConn struct {
+	net.Conn
+	// 解密收到的数据
+	readAEAD cipher.AEAD
+	// 加密发送的数据
+	writeAEAD cipher.AEAD
+	// 两个方向各自的记录序号，作为nonce使用
+	readSeq  uint64
+	writeSeq uint64
+	// 单个记录的最大明文长度
+	maxPlain int
+	// 已经解密但还没有被读取的数据
+	readBuf []byte
+	// 保护写入的锁
+	writeLock sync.Mutex
+}
+
+// 服务端加密握手，返回加密后的连接
+func SecureServerHandshake(conn net.Conn, dp ziface.IDataPack) (net.Conn, error) {
+	return secureHandshake(conn, dp, false)
+}
+
+// 客户端加密握手，返回加密后的连接
+func SecureClientHandshake(conn net.Conn, dp ziface.IDataPack) (net.Conn, error) {
+	return secureHandshake(conn, dp, true)
+}
+
+func secureHandshake(conn net.Conn, dp ziface.IDataPack, isClient bool) (net.Conn, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	localPub := priv.PublicKey().Bytes()
+
+	// 客户端先发送公钥，服务端收到后回复自己的公钥
+	if isClient {
+		if err := WriteMsg(conn, dp, utils.SESSION_KEY_MSG_ID, localPub); err != nil {
+			return nil, errors.Wrap(err, "send session key")
+		}
+	}
+	msg, err := ReadMsg(conn, dp)
+	if err != nil {
+		return nil, errors.Wrap(err, "read session key")
+	}
+	if msg.GetMsgId() != utils.SESSION_KEY_MSG_ID {
+		return nil, fmt.Errorf("expect session key msg, got msgID = %d", msg.GetMsgId())
+	}
+	if !isClient {
+		if err := WriteMsg(conn, dp, utils.SESSION_KEY_MSG_ID, localPub); err != nil {
+			return nil, errors.Wrap(err, "send session key")
+		}
+	}
+	remotePub, err := ecdh.X25519().NewPublicKey(msg.GetData())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid session key")
+	}
+	secret, err := priv.ECDH(remotePub)
+	if err != nil {
+		return nil, err
+	}
+
+	// 使用双方的公钥作为salt，为两个方向分别派生密钥
+	clientPub, serverPub := localPub, remotePub.Bytes()
+	if !isClient {
+		clientPub, serverPub = serverPub, clientPub
+	}
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+	c2s, err := newSessionAEAD(secret, salt, "zinx session c2s")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newSessionAEAD(secret, salt, "zinx session s2c")
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &secureConn{Conn: conn, readAEAD: c2s, writeAEAD: s2c, maxPlain: maxRecordPlain(dp)}
+	if isClient {
+		sc.readAEAD, sc.writeAEAD = s2c, c2s
+	}
+	return sc, nil
+}
+
+// 单个记录的最大明文长度，连接上每次写入的是一个数据包，包括消息头和不超过最大包长度的消息体
+func maxRecordPlain(dp ziface.IDataPack) int {
+	limit := msgLenMask
+	if maxSize := dp.GetMaxPackageSize(); maxSize > 0 && maxSize < limit {
+		limit = maxSize
+	}
+	return int(dp.GetHeadLen() + limit)
+}
+
+// 从共享密钥派生一个方向的AES-GCM
+func newSessionAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, sessionKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 根据记录序号生成nonce
+func sessionNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// 读取解密后的数据
+func (sc *secureConn) Read(p []byte) (int, error) {
+	if len(sc.readBuf) == 0 {
+		if err := sc.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sc.readBuf)
+	sc.readBuf = sc.readBuf[n:]
+	return n, nil
+}
+
+// 读取并解密一个记录
+func (sc *secureConn) readRecord() error {
+	var head [4]byte
+	if _, err := io.ReadFull(sc.Conn, head[:]); err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(head[:])
+	if size < uint32(sc.readAEAD.Overhead()) || size > uint32(sc.maxPlain+sc.readAEAD.Overhead()) {
+		return fmt.Errorf("invalid secure record size %d", size)
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(sc.Conn, record); err != nil {
+		return err
+	}
+	if sc.readSeq == math.MaxUint64 {
+		return errors.New("secure record sequence exhausted")
+	}
+	// 记录长度作为附加数据参与认证
+	plain, err := sc.readAEAD.Open(record[:0], sessionNonce(sc.readAEAD, sc.readSeq), record, head[:])
+	if err != nil {
+		return errors.New("secure record authentication failed")
+	}
+	sc.readSeq++
+	sc.readBuf = plain
+	return nil
+}
+
+// 加密并写入数据，每次写入作为一个记录
+func (sc *secureConn) Write(p []byte) (int, error) {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > sc.maxPlain {
+			chunk = chunk[:sc.maxPlain]
+		}
+		if sc.writeSeq == math.MaxUint64 {
+			return written, errors.New("secure record sequence exhausted")
+		}
+		// 记录长度作为附加数据参与认证
+		var head [4]byte
+		binary.LittleEndian.PutUint32(head[:], uint32(len(chunk)+sc.writeAEAD.Overhead()))
+		record := make([]byte, 4, 4+len(chunk)+sc.writeAEAD.Overhead())
+		copy(record, head[:])
+		sealed := sc.writeAEAD.Seal(record, sessionNonce(sc.writeAEAD, sc.writeSeq), chunk, head[:])
+		sc.writeSeq++
+		if _, err := sc.Conn.Write(sealed); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
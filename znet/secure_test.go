@@ -0,0 +1,84 @@
+package znet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+/*
+	会话加密的测试
+*/
+
+func TestSecureSession(t *testing.T) {
+	dp := NewDataPack()
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	// 握手
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	serverDone := make(chan result, 1)
+	go func() {
+		conn, err := SecureServerHandshake(serverRaw, dp)
+		serverDone <- result{conn, err}
+	}()
+	client, err := SecureClientHandshake(clientRaw, dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-serverDone
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	server := res.conn
+
+	// 加密后的消息可以正常收发
+	go WriteMsg(client, dp, 10, []byte("hello"))
+	msg, err := ReadMsg(server, dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetMsgId() != 10 || string(msg.GetData()) != "hello" {
+		t.Fatalf("unexpected msg %d %s", msg.GetMsgId(), msg.GetData())
+	}
+
+	// 截获一个加密记录，确认其中没有明文
+	recordConn, peer := net.Pipe()
+	client.(*secureConn).Conn = recordConn
+	go WriteMsg(client, dp, 11, []byte("secret"))
+	record := make([]byte, 4+8+len("secret")+16)
+	if _, err := io.ReadFull(peer, record); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(record, []byte("secret")) {
+		t.Fatal("record is not encrypted")
+	}
+
+	// 重放同一个记录会被拒绝
+	replayConn, replayPeer := net.Pipe()
+	server.(*secureConn).Conn = replayConn
+	go func() {
+		replayPeer.Write(record)
+		replayPeer.Write(record)
+	}()
+	msg, err = ReadMsg(server, dp)
+	if err != nil || string(msg.GetData()) != "secret" {
+		t.Fatalf("read record failed: %v", err)
+	}
+	if _, err := ReadMsg(server, dp); err == nil {
+		t.Fatal("replayed record accepted")
+	}
+
+	// 超过一个数据包长度的记录在读取之前被拒绝
+	oversizedConn, oversizedPeer := net.Pipe()
+	server.(*secureConn).Conn = oversizedConn
+	go oversizedPeer.Write([]byte{0xFF, 0xFF, 0xFF, 0x00})
+	if _, err := ReadMsg(server, dp); err == nil {
+		t.Fatal("oversized record accepted")
+	}
+}
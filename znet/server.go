@@ -2,10 +2,16 @@ package znet
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Xaytick/zinx/utils"
 	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
 )
 
 type Server struct {
@@ -27,45 +33,140 @@ type Server struct {
 	OnConnStop func(conn ziface.IConnection)
 	// 心跳检测是否开启
 	HeartbeatEnabled bool
+	// 心跳检测间隔，单位纳秒，支持运行时修改
+	heartbeatInterval int64
+	// 心跳超时时间，单位纳秒，支持运行时修改
+	heartbeatTimeout int64
+	// 是否由服务端主动发送心跳
+	activeHeartbeat bool
+	// 主动心跳允许连续丢失的次数
+	heartbeatMaxMissed int
+	// PONG路由是否已经注册
+	pongRouterAdded bool
+	// 当前Server所有连接共用的封包拆包工具
+	Packet ziface.IDataPack
+	// 当前Server所有连接共用的时间轮，用于心跳检测和连接定时器
+	TimeWheel ziface.ITimeWheel
+	// 配置文件热加载监听器，热加载之后的配置通过ConfigWatcher.Current获取
+	ConfigWatcher *utils.ConfigWatcher
+	// 当前Server独立的配置，默认从utils.GlobalObject复制，启动之后只读，热加载不会修改它
+	Config *utils.GlobalObj
+	// 当前Server的运行指标
+	Metrics *Metrics
+	// 会话管理器，没有开启会话恢复时为nil
+	Sessions *SessionManager
+	// 主题发布订阅管理器
+	PubSub *PubSub
+	// 可靠投递管理器
+	Reliable *ReliableManager
+	// 可靠消息确认路由是否已经注册
+	ackRouterAdded bool
+	// 链路追踪的Span导出器
+	spanExporter atomic.Pointer[ziface.ISpanExporter]
+	// 分配连接ID的计数
+	cid uint32
+	// 管理HTTP接口，没有开启时为nil
+	admin *AdminServer
+	// 正在接受连接的监听器，Server停止时关闭
+	listeners    []net.Listener
+	listenerLock sync.Mutex
+	// 热加载的配置文件路径
+	confFile string
+	// 是否通过WithName指定了名称
+	nameSet bool
 }
 
-func NewServer(name string) *Server {
+// 创建一个Server，默认使用utils.GlobalObject中的配置，可以通过Option覆盖
+func NewServer(name string, opts ...Option) *Server {
+	conf := *utils.GlobalObject
 	s := &Server{
-		Name:             utils.GlobalObject.Name,
 		IPVersion:        "tcp4",
-		IP:               utils.GlobalObject.Host,
-		Port:             utils.GlobalObject.TcpPort,
-		MsgHandler:       NewMsgHandler(),
-		ConnManager:      NewConnManager(),
 		HeartbeatEnabled: true, // 默认开启心跳检测
+		Config:           &conf,
+		Metrics:          &Metrics{},
+		confFile:         utils.ConfFilePath,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// WithName优先，其次是name参数，都没有时使用配置中的名称
+	if name != "" && !s.nameSet {
+		s.Config.Name = name
 	}
+	s.Config.TCPServer = s
+
+	s.Name = s.Config.Name
+	s.IP = s.Config.Host
+	s.Port = s.Config.TcpPort
+	s.MsgHandler = NewMsgHandlerWithPool(s.Config.WorkerPoolSize, s.Config.MaxTaskLen)
+	connManager := NewConnManager()
+	connManager.SetMaxConn(s.Config.MaxConn)
+	s.ConnManager = connManager
+	s.Packet = NewDataPackWithConfig(s.Config)
+	s.TimeWheel = NewTimeWheel(DefaultTimeWheelTick)
+	s.SetHeartbeatConfig(
+		time.Duration(s.Config.HeartbeatInterval)*time.Second,
+		time.Duration(s.Config.HeartbeatTimeout)*time.Second)
+
+	// 配置热加载，可以安全修改的配置项直接应用到当前Server
+	s.ConfigWatcher = utils.NewConfigWatcher(s.confFile, s.Config,
+		time.Duration(s.Config.ConfigReloadInterval)*time.Second)
+	s.ConfigWatcher.Subscribe(s.applyConfigChange)
 
 	// 注册心跳路由
 	if s.HeartbeatEnabled {
 		s.AddRouter(utils.PING_MSG_ID, &HeartbeatRouter{})
 	}
+	s.SetActiveHeartbeat(s.Config.HeartbeatActive, s.Config.HeartbeatMaxMissed)
+
+	s.PubSub = NewPubSub()
+
+	// 开启可靠投递
+	s.Reliable = NewReliableManager(s.Config.ReliableMaxPending)
+	if len(s.Config.ReliableMsgIDs) > 0 {
+		s.SetReliable(s.Config.ReliableMsgIDs...)
+	}
+
+	// 开启会话恢复
+	if s.Config.SessionGracePeriod > 0 {
+		s.Sessions = NewSessionManager(time.Duration(s.Config.SessionGracePeriod)*time.Second,
+			s.Config.SessionReplaySize, s.TimeWheel)
+		s.AddRouter(utils.RESUME_MSG_ID, &ResumeRouter{})
+	}
+
+	// 配置了追踪文件时，使用文件导出器开启链路追踪
+	if s.Config.TraceFile != "" {
+		exporter, err := NewFileSpanExporter(s.Config.TraceFile)
+		if err != nil {
+			fmt.Println("[zinx] tracing disabled:", err)
+		} else {
+			s.SetSpanExporter(exporter)
+		}
+	}
 
 	return s
 }
 
 func (s *Server) Start() {
-	fmt.Println("[zinx] Server name:", utils.GlobalObject.Name,
-		". Server Listener at IP: ", utils.GlobalObject.Host,
-		", Port ", utils.GlobalObject.TcpPort)
+	fmt.Println("[zinx] Server name:", s.Name,
+		". Server Listener at IP: ", s.IP,
+		", Port ", s.Port)
 
-	fmt.Println("[zinx] Version:", utils.GlobalObject.Version,
-		". MaxConn:", utils.GlobalObject.MaxConn,
-		". MaxPackageSize:", utils.GlobalObject.MaxPackageSize)
+	fmt.Println("[zinx] Version:", s.Config.Version,
+		". MaxConn:", s.ConnManager.GetMaxConn(),
+		". MaxPackageSize:", s.Packet.GetMaxPackageSize())
 
 	if s.HeartbeatEnabled {
-		fmt.Printf("[zinx] Heartbeat: Enabled (Interval: %ds, Timeout: %ds)\n",
-			utils.GlobalObject.HeartbeatInterval,
-			utils.GlobalObject.HeartbeatTimeout)
+		interval, timeout := s.GetHeartbeatConfig()
+		fmt.Printf("[zinx] Heartbeat: Enabled (Interval: %s, Timeout: %s)\n", interval, timeout)
+	}
+	if s.activeHeartbeat {
+		fmt.Printf("[zinx] Active Heartbeat: Enabled (MaxMissed: %d)\n", s.heartbeatMaxMissed)
 	}
 
+	s.startComponents()
+
 	go func() {
-		// 0.启动worker工作池
-		s.MsgHandler.StartWorkerPool()
 		// 1.获取一个TCP的Addr
 		addr, err := net.ResolveTCPAddr(s.IPVersion, fmt.Sprintf("%s:%d", s.IP, s.Port))
 		if err != nil {
@@ -81,29 +182,61 @@ func (s *Server) Start() {
 		}
 		fmt.Println("start zinx server success, ", s.Name, "listening...")
 
-		var cid uint32 = 0
-
 		// 3.阻塞的等待客户端链接，处理客户端链接业务（读写）
-		for {
-			// 如果有客户端链接过来，阻塞会返回
-			conn, err := listener.AcceptTCP()
-			if err != nil {
-				fmt.Println("Accept err:", err)
-				continue
-			}
+		s.acceptLoop(listener)
+	}()
+}
+
+// 使用已有的监听器启动服务器，例如测试使用的内存监听器
+func (s *Server) StartListener(listener net.Listener) {
+	s.startComponents()
+	go s.acceptLoop(listener)
+}
 
-			// 设置服务器最大连接控制，如果超过最大连接，那么则关闭此新的连接
-			if s.ConnManager.Size() > utils.GlobalObject.MaxConn {
-				fmt.Println("Too many Connections, MaxConn = ", utils.GlobalObject.MaxConn)
-				conn.Close()
-				continue
+// 启动配置热加载、时间轮和worker工作池
+func (s *Server) startComponents() {
+	// 开始监听配置文件变更
+	s.ConfigWatcher.Start()
+	// 启动时间轮
+	s.TimeWheel.Start()
+	// 启动worker工作池
+	s.MsgHandler.StartWorkerPool()
+	// 配置了监听地址时开启管理接口
+	if s.Config.AdminAddr != "" {
+		s.admin = NewAdminServer(s, s.Config.AdminToken)
+		if err := s.admin.Start(s.Config.AdminAddr); err != nil {
+			fmt.Println("[zinx] start admin api err:", err)
+		}
+	}
+}
+
+// 阻塞的等待客户端链接，监听器关闭时返回
+func (s *Server) acceptLoop(listener net.Listener) {
+	s.listenerLock.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.listenerLock.Unlock()
+
+	for {
+		// 如果有客户端链接过来，阻塞会返回
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
-			dealConn := NewConnection(s, conn, cid, s.MsgHandler)
-			cid++
+			fmt.Println("Accept err:", err)
+			continue
+		}
 
-			go dealConn.Start()
+		// 设置服务器最大连接控制，如果超过最大连接，那么则关闭此新的连接
+		if maxConn := s.ConnManager.GetMaxConn(); s.ConnManager.Size() > maxConn {
+			fmt.Println("Too many Connections, MaxConn = ", maxConn)
+			conn.Close()
+			continue
 		}
-	}()
+		dealConn := NewConnection(s, conn, atomic.AddUint32(&s.cid, 1)-1, s.MsgHandler)
+
+		go dealConn.Start()
+	}
 }
 
 // 设置是否开启心跳检测
@@ -111,14 +244,144 @@ func (s *Server) SetHeartbeat(enabled bool) {
 	s.HeartbeatEnabled = enabled
 }
 
-func (s *Server) AddRouter(msgID uint32, router ziface.IRouter) {
-	s.MsgHandler.AddRouter(msgID, router)
+// 设置心跳检测间隔和超时时间，正在运行的连接会在下一次检测时使用新的配置
+func (s *Server) SetHeartbeatConfig(interval, timeout time.Duration) {
+	atomic.StoreInt64(&s.heartbeatInterval, int64(interval))
+	atomic.StoreInt64(&s.heartbeatTimeout, int64(timeout))
+}
+
+// 获取心跳检测间隔和超时时间
+func (s *Server) GetHeartbeatConfig() (interval, timeout time.Duration) {
+	return time.Duration(atomic.LoadInt64(&s.heartbeatInterval)),
+		time.Duration(atomic.LoadInt64(&s.heartbeatTimeout))
+}
+
+// 设置服务端主动心跳，开启后服务端按心跳间隔发送PING并根据PONG计算RTT
+// 需要在Start之前调用
+func (s *Server) SetActiveHeartbeat(enabled bool, maxMissed int) {
+	s.activeHeartbeat = enabled
+	s.heartbeatMaxMissed = maxMissed
+	if enabled && !s.pongRouterAdded {
+		s.AddRouter(utils.PONG_MSG_ID, &HeartbeatPongRouter{})
+		s.pongRouterAdded = true
+	}
+}
+
+// 获取服务端主动心跳的配置
+func (s *Server) GetActiveHeartbeat() (enabled bool, maxMissed int) {
+	return s.activeHeartbeat, s.heartbeatMaxMissed
+}
+
+// 获取封包拆包工具
+func (s *Server) GetPacket() ziface.IDataPack {
+	return s.Packet
+}
+
+// 获取Server共用的时间轮
+func (s *Server) GetTimeWheel() ziface.ITimeWheel {
+	return s.TimeWheel
+}
+
+// 将热加载的配置项应用到正在运行的Server上
+func (s *Server) applyConfigChange(change utils.ConfigFieldChange) {
+	switch change.Field {
+	case "MaxConn":
+		s.ConnManager.SetMaxConn(change.New.(int))
+	case "MaxPackageSize":
+		s.Packet.SetMaxPackageSize(change.New.(uint32))
+	case "HeartbeatInterval":
+		_, timeout := s.GetHeartbeatConfig()
+		s.SetHeartbeatConfig(time.Duration(change.New.(int))*time.Second, timeout)
+	case "HeartbeatTimeout":
+		interval, _ := s.GetHeartbeatConfig()
+		s.SetHeartbeatConfig(interval, time.Duration(change.New.(int))*time.Second)
+	}
+}
+
+// 设置认证器，连接需要在AuthTimeout内通过登录消息完成认证
+func (s *Server) SetAuthenticator(auth ziface.IAuthenticator, loginMsgID uint32, whitelist ...uint32) {
+	s.MsgHandler.SetAuthenticator(auth, loginMsgID, whitelist...)
+}
+
+// 设置消息权限校验，可以使用PermissionTable按msgID配置需要的角色
+func (s *Server) SetAuthorizer(authorizer ziface.IAuthorizer) {
+	s.MsgHandler.SetAuthorizer(authorizer)
+}
+
+// 将msgID设置为可靠投递，发送的消息需要对端回复确认
+// 没有确认的消息在客户端恢复会话后重新发送，需要配合会话恢复使用
+func (s *Server) SetReliable(msgIDs ...uint32) {
+	s.Reliable.SetReliable(msgIDs...)
+	if !s.ackRouterAdded {
+		s.AddRouter(utils.RELIABLE_ACK_MSG_ID, &ReliableAckRouter{})
+		s.ackRouterAdded = true
+	}
+}
+
+// 设置可靠消息投递状态变化时的回调
+func (s *Server) SetOnDelivery(callback ziface.DeliveryCallback) {
+	s.Reliable.SetOnDelivery(callback)
+}
+
+// 获取主题发布订阅管理器
+func (s *Server) GetPubSub() ziface.IPubSub {
+	return s.PubSub
+}
+
+// 设置Span导出器开启链路追踪，为nil时关闭，导出器实现io.Closer时在Server停止时关闭
+func (s *Server) SetSpanExporter(exporter ziface.ISpanExporter) {
+	s.spanExporter.Store(&exporter)
+	s.MsgHandler.SetSpanExporter(exporter)
+}
+
+// 设置默认路由，处理没有其他路由匹配的消息
+func (s *Server) SetDefaultRouter(router ziface.IRouter) {
+	s.MsgHandler.SetDefaultRouter(router)
+}
+
+func (s *Server) AddRouter(msgID uint32, router ziface.IRouter) error {
+	if err := s.MsgHandler.AddRouter(msgID, router); err != nil {
+		fmt.Println("Add Router err: ", err)
+		return err
+	}
 	fmt.Println("Added Router successfully!")
+	return nil
+}
+
+// 设置消息的处理超时时间，超时后请求的上下文被取消
+func (s *Server) SetHandlerTimeout(msgID uint32, timeout time.Duration) {
+	s.MsgHandler.SetHandlerTimeout(msgID, timeout)
+}
+
+// 删除一个路由，运行期间也可以调用
+func (s *Server) RemoveRouter(msgID uint32) error {
+	return s.MsgHandler.RemoveRouter(msgID)
+}
+
+// 替换一个路由，msgID没有注册时直接添加，返回被替换的路由
+func (s *Server) ReplaceRouter(msgID uint32, router ziface.IRouter) ziface.IRouter {
+	return s.MsgHandler.ReplaceRouter(msgID, router)
 }
 
 func (s *Server) Stop() {
 	// 将一些服务器的资源、状态或者一些已经开辟的链接信息进行停止或者回收
+	s.ConfigWatcher.Stop()
+	if s.admin != nil {
+		s.admin.Stop()
+	}
+	s.listenerLock.Lock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+	s.listenerLock.Unlock()
 	s.ConnManager.ClearConns()
+	s.TimeWheel.Stop()
+	if exporter := s.spanExporter.Load(); exporter != nil {
+		if closer, ok := (*exporter).(io.Closer); ok {
+			closer.Close()
+		}
+	}
 	fmt.Println("[STOP] Zinx server name ", s.Name)
 }
 
@@ -0,0 +1,375 @@
+package znet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	会话恢复
+	开启后，连接建立时服务端通过RESUME_TOKEN_MSG_ID下发恢复token，
+	之后发送的业务消息(不包括心跳和系统消息)按照实际写入连接的顺序编号，并保留最近的若干条，
+	不同优先级的消息在发送队列中可能乱序，编号和客户端收到消息的顺序保持一致。
+	连接断开后会话的属性、userID绑定、主题订阅、最近的消息和发送队列中没有写入的消息保留一段时间，
+	客户端在这段时间内重新连接并发送RESUME_MSG_ID: {"token": "...", "lastSeq": 收到的业务消息数量}，
+	即可恢复原来的会话，服务端回复RESUME_OK_MSG_ID之后按原来的优先级重放编号大于lastSeq的消息和没有写入的消息，
+	并重新发送没有确认的可靠消息。重放和重新发送的消息重新编号，客户端收到的业务消息都要计数，包括重复的可靠消息
+*/
+
+// 会话中保留的一条发送过的消息
+type sessionMsg struct {
+	seq   uint64
+	msgID uint32
+	data  []byte
+	// 可靠消息的序号，重放时保持不变
+	reliableSeq uint64
+	// 发送时的优先级，重放时保持不变
+	priority ziface.MsgPriority
+}
+
+// 发送队列中的一条会话消息，写入连接之后编号并记录到会话中
+type sessionEntry struct {
+	session *session
+	msg     sessionMsg
+}
+
+type session struct {
+	token string
+	// 当前绑定的连接，断线期间为nil
+	conn *Connection
+	// 断线时保存的连接属性
+	properties map[string]interface{}
+	// 断线时连接的认证信息，没有认证时为nil
+	authInfo *ziface.AuthInfo
+	// 断线时连接订阅的主题
+	subscriptions []string
+	// 最后一条写入连接的业务消息的编号
+	seq uint64
+	// 最近写入连接的业务消息
+	outbox []sessionMsg
+	// 连接断开时发送队列中没有写入的业务消息
+	pending []sessionMsg
+	// 最近绑定的连接的写goroutine退出时关闭，之后pending不再变化
+	writerDone chan struct{}
+	// 可靠投递状态，断线期间没有确认的消息在恢复后重新发送
+	reliable *reliableState
+	// 断线后会话过期的定时器
+	expire ziface.ITimer
+}
+
+// 会话恢复请求
+type resumeRequest struct {
+	Token   string `json:"token"`
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+// 会话恢复成功的回复
+type resumeReply struct {
+	Replayed int    `json:"replayed"` // 重放的消息数量
+	Lost     uint64 `json:"lost"`     // 已经不在保留范围内、无法重放的消息数量
+}
+
+type SessionManager struct {
+	sessions map[string]*session
+	// 断线后会话保留的时间
+	grace time.Duration
+	// 每个会话保留的最近消息数量
+	replaySize int
+	// 用于会话过期的时间轮
+	timeWheel ziface.ITimeWheel
+	// 保护sessions以及连接和会话的绑定关系
+	lock sync.Mutex
+}
+
+// 创建会话管理器
+func NewSessionManager(grace time.Duration, replaySize int, timeWheel ziface.ITimeWheel) *SessionManager {
+	return &SessionManager{
+		sessions:   make(map[string]*session),
+		grace:      grace,
+		replaySize: replaySize,
+		timeWheel:  timeWheel,
+	}
+}
+
+// 当前保留的会话数量，包括断线等待恢复的会话
+func (sm *SessionManager) Size() int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return len(sm.sessions)
+}
+
+// 是否需要在会话中保留的业务消息
+func isSessionMsg(msgID uint32) bool {
+	return msgID < utils.SESSION_KEY_MSG_ID && msgID != utils.PING_MSG_ID && msgID != utils.PONG_MSG_ID
+}
+
+// 为新连接创建会话，并下发恢复token
+func (sm *SessionManager) issue(c *Connection) error {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	s := &session{token: hex.EncodeToString(raw[:]), conn: c, writerDone: c.writerDone}
+
+	sm.lock.Lock()
+	sm.sessions[s.token] = s
+	c.session = s
+	sm.lock.Unlock()
+	return c.writeMsg(NewMsgPackage(utils.RESUME_TOKEN_MSG_ID, []byte(s.token)), ziface.PriorityHigh)
+}
+
+// 为连接发送的业务消息创建会话记录，不需要记录时返回nil
+func (sm *SessionManager) track(c *Connection, msg ziface.IMessage, priority ziface.MsgPriority) *sessionEntry {
+	if !isSessionMsg(msg.GetMsgId()) {
+		return nil
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if c.session == nil {
+		return nil
+	}
+	return &sessionEntry{
+		session: c.session,
+		msg:     sessionMsg{msgID: msg.GetMsgId(), data: msg.GetData(), reliableSeq: msg.GetSeq(), priority: priority},
+	}
+}
+
+// 会话消息写入了连接，按写入的顺序编号，由写goroutine调用
+func (sm *SessionManager) written(entry *sessionEntry) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	s := entry.session
+	s.seq++
+	entry.msg.seq = s.seq
+	s.outbox = append(s.outbox, entry.msg)
+	if len(s.outbox) > sm.replaySize {
+		s.outbox = s.outbox[len(s.outbox)-sm.replaySize:]
+	}
+}
+
+// 连接停止时没有写入的会话消息，恢复会话后重放
+func (sm *SessionManager) unsent(entries []*sessionEntry) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	for _, entry := range entries {
+		entry.session.pending = append(entry.session.pending, entry.msg)
+	}
+}
+
+// 丢弃连接绑定的会话，之后不能再恢复
+func (sm *SessionManager) discard(c *Connection) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if s := c.session; s != nil {
+		delete(sm.sessions, s.token)
+		c.session = nil
+	}
+}
+
+// 连接停止时保存会话状态，会话在保留时间之后过期，返回连接是否绑定了会话
+func (sm *SessionManager) detach(c *Connection) bool {
+	properties := c.GetProperties()
+	var authInfo *ziface.AuthInfo
+	if c.IsAuthenticated() {
+		authInfo = &ziface.AuthInfo{}
+		authInfo.UserID, _ = properties["userID"].(uint)
+		authInfo.Roles, _ = properties[RolesProperty].([]string)
+	}
+	var subscriptions []string
+	if c.pubsub != nil {
+		subscriptions = c.pubsub.GetSubscriptions(c)
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	s := c.session
+	if s == nil {
+		return false
+	}
+	c.session = nil
+	s.conn = nil
+	s.properties = properties
+	s.authInfo = authInfo
+	s.subscriptions = subscriptions
+	s.reliable = c.reliable.Load()
+	s.expire = sm.timeWheel.AfterFunc(sm.grace, func() {
+		sm.lock.Lock()
+		expired := sm.sessions[s.token] == s && s.conn == nil
+		if expired {
+			delete(sm.sessions, s.token)
+		}
+		sm.lock.Unlock()
+		if expired {
+			fmt.Println("session expired, token = ", s.token)
+			// 会话没有被恢复，没有确认的可靠消息投递失败
+			c.failUnacked()
+		}
+	})
+	return true
+}
+
+// 恢复会话的结果
+type resumeResult struct {
+	session *session
+	// 需要重放的消息
+	replay []sessionMsg
+	// 无法重放的消息数量
+	lost uint64
+	// 没有确认、需要重新发送的可靠消息
+	unacked []reliableMsg
+	// 新连接在恢复会话之前发送的可靠消息，序号和会话中的冲突，只能作为投递失败
+	discarded []reliableMsg
+}
+
+// 将连接绑定到token对应的会话
+func (sm *SessionManager) resume(c *Connection, token string, lastSeq uint64) (*resumeResult, error) {
+	// 客户端重连时旧连接可能还没有被发现断开，先停止旧连接
+	sm.lock.Lock()
+	s, ok := sm.sessions[token]
+	var old *Connection
+	if ok {
+		old = s.conn
+	}
+	sm.lock.Unlock()
+	if !ok {
+		return nil, errors.New("session not found or expired")
+	}
+	if old == c {
+		return nil, errors.New("session already bound to this connection")
+	}
+	if old != nil {
+		old.Stop()
+	}
+	// 等待旧连接的写goroutine交回发送队列中没有写入的消息
+	sm.lock.Lock()
+	writerDone := s.writerDone
+	sm.lock.Unlock()
+	if writerDone != nil {
+		<-writerDone
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.sessions[token] != s || s.conn != nil {
+		return nil, errors.New("session is in use")
+	}
+	if lastSeq > s.seq {
+		return nil, fmt.Errorf("lastSeq %d is ahead of session seq %d", lastSeq, s.seq)
+	}
+	// 丢弃新连接自己的会话
+	if own := c.session; own != nil {
+		delete(sm.sessions, own.token)
+	}
+	if s.expire != nil {
+		s.expire.Stop()
+		s.expire = nil
+	}
+	s.conn = c
+	s.writerDone = c.writerDone
+	c.session = s
+
+	result := &resumeResult{session: s}
+	if s.reliable != nil {
+		result.unacked = s.reliable.unacked()
+		result.discarded = c.reliable.Swap(s.reliable).takeUnacked()
+	}
+	// 客户端没有收到的消息重新编号，之后写入的消息从lastSeq继续编号
+	kept := s.outbox[:0]
+	for _, msg := range s.outbox {
+		if msg.seq > lastSeq {
+			result.replay = append(result.replay, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	if len(result.replay) > 0 {
+		result.lost = result.replay[0].seq - lastSeq - 1
+	} else {
+		result.lost = s.seq - lastSeq
+	}
+	result.replay = append(result.replay, s.pending...)
+	s.outbox = kept
+	s.pending = nil
+	s.seq = lastSeq
+	return result, nil
+}
+
+// 处理客户端的会话恢复请求
+type ResumeRouter struct {
+	BaseRouter
+}
+
+func (rr *ResumeRouter) Handle(request ziface.IRequest) {
+	c, ok := request.GetConnection().(*Connection)
+	if !ok || c.sessions == nil {
+		return
+	}
+	var req resumeRequest
+	if err := json.Unmarshal(request.GetData(), &req); err != nil {
+		SendErrorReply(c, ErrCodeResumeFailed, request.GetMsgID(), "invalid resume request")
+		return
+	}
+	result, err := c.sessions.resume(c, req.Token, req.LastSeq)
+	if err != nil {
+		fmt.Println("ConnID = ", c.ConnID, " resume session failed: ", err)
+		SendErrorReply(c, ErrCodeResumeFailed, request.GetMsgID(), err.Error())
+		return
+	}
+
+	// 恢复连接属性、userID绑定、认证状态和主题订阅，没有认证的连接同样恢复通过属性绑定的userID
+	for key, value := range result.session.properties {
+		c.SetProperty(key, value)
+	}
+	if s := result.session; s.authInfo != nil {
+		c.SetAuthenticated(s.authInfo)
+	} else if userID, ok := s.properties["userID"].(uint); ok {
+		c.TCPServer.GetConnManager().SetConnByUserID(c.ConnID, userID)
+	}
+	for _, pattern := range result.session.subscriptions {
+		c.pubsub.Subscribe(c, pattern)
+	}
+	for _, msg := range result.discarded {
+		c.reliableMgr.report(c, msg.msgID, msg.seq, ziface.DeliveryFailed)
+	}
+	fmt.Printf("ConnID = %d resumed session, replay %d msgs, lost %d msgs, unacked %d reliable msgs\n",
+		c.ConnID, len(result.replay), result.lost, len(result.unacked))
+
+	data, _ := json.Marshal(&resumeReply{Replayed: len(result.replay), Lost: result.lost})
+	c.writeMsg(NewMsgPackage(utils.RESUME_OK_MSG_ID, data), ziface.PriorityHigh)
+
+	// 在发送之前报告重新发送，避免确认先于重新发送被报告
+	for _, msg := range result.unacked {
+		c.reliableMgr.report(c, msg.msgID, msg.seq, ziface.DeliveryRetransmitted)
+	}
+	// 先按序号重新发送不在重放范围内的可靠消息，它们比重放的消息更早
+	replayed := make(map[uint64]bool)
+	for _, msg := range result.replay {
+		if msg.reliableSeq != 0 {
+			replayed[msg.reliableSeq] = true
+		}
+	}
+	// 重放和重新发送的消息按原来的优先级发送，写入连接之后重新编号
+	s := result.session
+	for _, msg := range result.unacked {
+		if !replayed[msg.seq] {
+			resend := NewMsgPackage(msg.msgID, msg.data)
+			resend.SetSeq(msg.seq)
+			entry := &sessionEntry{session: s, msg: sessionMsg{msgID: msg.msgID, data: msg.data, reliableSeq: msg.seq, priority: msg.priority}}
+			c.enqueueMsg(resend, entry, msg.priority, true)
+		}
+	}
+	for _, msg := range result.replay {
+		resend := NewMsgPackage(msg.msgID, msg.data)
+		resend.SetSeq(msg.reliableSeq)
+		c.enqueueMsg(resend, &sessionEntry{session: s, msg: msg}, msg.priority, true)
+	}
+}
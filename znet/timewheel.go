@@ -0,0 +1,296 @@
+package znet
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	分层时间轮
+	整个Server共用一个时间轮和一个驱动goroutine，用来代替每个连接各自的goroutine和Ticker。
+	第0层有256个槽，每个槽代表一个tick；之后的每一层有64个槽，每个槽代表下一层转一圈的时间，
+	高层的定时器在低层转完一圈时被重新分配到低层，最终在第0层到期执行。
+	到期的函数交给固定数量的执行goroutine执行，定时器函数不应该长时间阻塞，
+	所有执行goroutine都被阻塞时到期的定时器会被推迟执行
+*/
+
+const (
+	twRootBits  = 8
+	twLevelBits = 6
+	twRootSize  = 1 << twRootBits
+	twLevelSize = 1 << twLevelBits
+	twRootMask  = twRootSize - 1
+	twLevelMask = twLevelSize - 1
+	twLevels    = 4
+	// 时间轮能表示的最大tick数，超过的定时器会被放在最高层的最远位置
+	twMaxTicks = 1<<(twRootBits+twLevelBits*(twLevels-1)) - 1
+)
+
+// 时间轮默认的精度
+const DefaultTimeWheelTick = 100 * time.Millisecond
+
+// 时间轮默认的执行goroutine数量
+const DefaultTimeWheelWorkers = 8
+
+type TimeWheel struct {
+	// 每个tick代表的时间
+	tick time.Duration
+	// 每一层的槽，每个槽是一个定时器链表
+	levels [twLevels][]*list.List
+	// 下一个需要处理的tick
+	current uint64
+	// current为0时对应的时间
+	startTime time.Time
+	// 保护时间轮状态的锁
+	lock sync.Mutex
+	// 通知驱动goroutine和执行goroutine退出的channel
+	exitChan chan struct{}
+	// 执行到期函数的goroutine数量
+	workers int
+}
+
+type wheelTimer struct {
+	wheel *TimeWheel
+	// 到期的tick
+	expires uint64
+	// 周期定时器的间隔tick数，0表示一次性定时器
+	period uint64
+	// 到期执行的函数
+	fn func()
+	// 定时器当前所在的槽和链表节点
+	slot *list.List
+	elem *list.Element
+	// 定时器是否已经停止
+	stopped bool
+}
+
+// 创建一个时间轮，tick为时间轮的精度
+func NewTimeWheel(tick time.Duration) *TimeWheel {
+	return NewTimeWheelWithWorkers(tick, DefaultTimeWheelWorkers)
+}
+
+// 创建一个时间轮，到期的函数由workers个goroutine执行
+func NewTimeWheelWithWorkers(tick time.Duration, workers int) *TimeWheel {
+	if tick <= 0 {
+		tick = DefaultTimeWheelTick
+	}
+	if workers <= 0 {
+		workers = DefaultTimeWheelWorkers
+	}
+	tw := &TimeWheel{
+		tick:      tick,
+		startTime: time.Now(),
+		workers:   workers,
+	}
+	for i := range tw.levels {
+		size := twLevelSize
+		if i == 0 {
+			size = twRootSize
+		}
+		tw.levels[i] = make([]*list.List, size)
+		for j := range tw.levels[i] {
+			tw.levels[i][j] = list.New()
+		}
+	}
+	return tw
+}
+
+// 启动时间轮的驱动goroutine
+func (tw *TimeWheel) Start() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.exitChan != nil {
+		return
+	}
+	tw.exitChan = make(chan struct{})
+	// 启动之前添加的定时器从现在开始计时
+	tw.startTime = time.Now().Add(-time.Duration(tw.current) * tw.tick)
+	tasks := make(chan func(), tw.workers*64)
+	for i := 0; i < tw.workers; i++ {
+		go tw.work(tasks, tw.exitChan)
+	}
+	go tw.run(tasks, tw.exitChan)
+}
+
+// 停止时间轮，未到期的定时器不会再被执行
+func (tw *TimeWheel) Stop() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.exitChan != nil {
+		close(tw.exitChan)
+		tw.exitChan = nil
+	}
+}
+
+// 在d时间之后执行一次f，f在时间轮的执行goroutine中执行，不应该长时间阻塞
+func (tw *TimeWheel) AfterFunc(d time.Duration, f func()) ziface.ITimer {
+	return tw.addTimer(d, 0, f)
+}
+
+// 每隔d时间执行一次f，f在时间轮的执行goroutine中执行，不应该长时间阻塞
+func (tw *TimeWheel) Every(d time.Duration, f func()) ziface.ITimer {
+	period := tw.durationToTicks(d)
+	if period == 0 {
+		period = 1
+	}
+	return tw.addTimer(d, period, f)
+}
+
+func (tw *TimeWheel) addTimer(d time.Duration, period uint64, f func()) *wheelTimer {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	t := &wheelTimer{
+		wheel:   tw,
+		expires: tw.current + tw.durationToTicks(d),
+		period:  period,
+		fn:      f,
+	}
+	tw.place(t)
+	return t
+}
+
+// 将时间转换为tick数，不足一个tick的部分向上取整
+func (tw *TimeWheel) durationToTicks(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + tw.tick - 1) / tw.tick)
+}
+
+// 根据到期时间将定时器放入对应层的槽中，调用时需要持有锁
+func (tw *TimeWheel) place(t *wheelTimer) {
+	if t.expires < tw.current {
+		t.expires = tw.current
+	}
+	idx := t.expires - tw.current
+	if idx > twMaxTicks {
+		t.expires = tw.current + twMaxTicks
+		idx = twMaxTicks
+	}
+
+	var slot *list.List
+	switch {
+	case idx < twRootSize:
+		slot = tw.levels[0][t.expires&twRootMask]
+	default:
+		for level := 1; level < twLevels; level++ {
+			shift := uint(twRootBits + twLevelBits*(level-1))
+			if idx < 1<<(shift+twLevelBits) || level == twLevels-1 {
+				slot = tw.levels[level][(t.expires>>shift)&twLevelMask]
+				break
+			}
+		}
+	}
+	t.slot = slot
+	t.elem = slot.PushBack(t)
+}
+
+// 将高层某个槽中的定时器重新分配到低层，返回槽的下标，调用时需要持有锁
+func (tw *TimeWheel) cascade(level int) uint64 {
+	shift := uint(twRootBits + twLevelBits*(level-1))
+	index := (tw.current >> shift) & twLevelMask
+	slot := tw.levels[level][index]
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*wheelTimer)
+		slot.Remove(e)
+		tw.place(t)
+		e = next
+	}
+	return index
+}
+
+// 处理所有到target为止的tick，返回到期需要执行的函数，调用时需要持有锁
+func (tw *TimeWheel) advance(target uint64) []func() {
+	var expired []func()
+	for tw.current <= target {
+		index := tw.current & twRootMask
+		// 第0层转完一圈，从上一层取出下一批定时器，依次类推
+		if index == 0 {
+			for level := 1; level < twLevels; level++ {
+				if tw.cascade(level) != 0 {
+					break
+				}
+			}
+		}
+
+		slot := tw.levels[0][index]
+		for e := slot.Front(); e != nil; {
+			next := e.Next()
+			t := e.Value.(*wheelTimer)
+			slot.Remove(e)
+			t.slot, t.elem = nil, nil
+			expired = append(expired, t.fn)
+			if t.period > 0 {
+				t.expires = tw.current + t.period
+				tw.place(t)
+			} else {
+				t.stopped = true
+			}
+			e = next
+		}
+		tw.current++
+	}
+	return expired
+}
+
+// 时间轮的执行goroutine，依次执行到期的函数
+func (tw *TimeWheel) work(tasks chan func(), exitChan chan struct{}) {
+	for {
+		select {
+		case fn := <-tasks:
+			fn()
+		case <-exitChan:
+			return
+		}
+	}
+}
+
+// 时间轮的驱动goroutine
+func (tw *TimeWheel) run(tasks chan func(), exitChan chan struct{}) {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			tw.lock.Lock()
+			// 按照真实经过的时间推进，驱动goroutine被延迟时可以追上错过的tick
+			target := uint64(now.Sub(tw.startTime) / tw.tick)
+			var expired []func()
+			if target >= tw.current {
+				expired = tw.advance(target)
+			}
+			tw.lock.Unlock()
+
+			// 执行goroutine都在忙时等待，不创建新的goroutine
+			for _, fn := range expired {
+				select {
+				case tasks <- fn:
+				case <-exitChan:
+					return
+				}
+			}
+		case <-exitChan:
+			return
+		}
+	}
+}
+
+// 取消定时器
+func (t *wheelTimer) Stop() bool {
+	tw := t.wheel
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	if t.slot != nil {
+		t.slot.Remove(t.elem)
+		t.slot, t.elem = nil, nil
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package znet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+)
+
+/*
+	时间轮的测试
+*/
+
+func TestTimeWheel(t *testing.T) {
+	tw := NewTimeWheel(time.Millisecond)
+	tw.Start()
+	defer tw.Stop()
+
+	// 一次性定时器，到期时间跨越第0层
+	fired := make(chan time.Duration, 1)
+	start := time.Now()
+	tw.AfterFunc(300*time.Millisecond, func() {
+		fired <- time.Since(start)
+	})
+
+	// 被取消的定时器不会执行
+	var cancelled int32
+	timer := tw.AfterFunc(50*time.Millisecond, func() {
+		atomic.StoreInt32(&cancelled, 1)
+	})
+	if !timer.Stop() {
+		t.Fatal("stop timer failed")
+	}
+	if timer.Stop() {
+		t.Fatal("timer stopped twice")
+	}
+
+	// 周期定时器
+	var count int32
+	every := tw.Every(10*time.Millisecond, func() {
+		atomic.AddInt32(&count, 1)
+	})
+
+	select {
+	case elapsed := <-fired:
+		if elapsed < 300*time.Millisecond {
+			t.Fatalf("timer fired too early: %s", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timer not fired")
+	}
+
+	every.Stop()
+	if n := atomic.LoadInt32(&count); n < 5 {
+		t.Fatalf("periodic timer fired %d times", n)
+	}
+	if atomic.LoadInt32(&cancelled) != 0 {
+		t.Fatal("cancelled timer fired")
+	}
+}
+
+// 到期的函数由固定数量的执行goroutine执行
+func TestTimeWheelWorkers(t *testing.T) {
+	tw := NewTimeWheelWithWorkers(time.Millisecond, 2)
+	tw.Start()
+	defer tw.Stop()
+
+	var running, maxRunning, done int32
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		tw.AfterFunc(time.Millisecond, func() {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&done, 1)
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; atomic.LoadInt32(&done) < 10 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&done); n != 10 {
+		t.Fatalf("%d timers fired", n)
+	}
+	if n := atomic.LoadInt32(&maxRunning); n > 2 {
+		t.Fatalf("%d timers ran concurrently with 2 workers", n)
+	}
+}
+
+// 连接上触发或者取消的定时器不再保留在连接中
+func TestConnectionTimers(t *testing.T) {
+	s := NewServer("timers")
+	s.TimeWheel.Start()
+	defer s.TimeWheel.Stop()
+	raw, peer := net.Pipe()
+	defer raw.Close()
+	defer peer.Close()
+	conn := NewConnection(s, raw, 1, s.MsgHandler)
+	timerCount := func() int {
+		conn.timerLock.Lock()
+		defer conn.timerLock.Unlock()
+		return len(conn.timers)
+	}
+
+	every := conn.Every(time.Hour, func() {})
+	after := conn.AfterFunc(time.Hour, func() {})
+	fired := make(chan struct{})
+	conn.AfterFunc(time.Millisecond, func() { close(fired) })
+	if n := timerCount(); n != 3 {
+		t.Fatalf("%d timers tracked", n)
+	}
+	<-fired
+	if !every.Stop() || !after.Stop() {
+		t.Fatal("stop timer failed")
+	}
+	if n := timerCount(); n != 0 {
+		t.Fatalf("%d timers still tracked after fire and stop", n)
+	}
+	conn.cancel()
+}
+
+// 时间轮回调、踢下线等多个goroutine同时停止连接时只停止一次
+func TestConcurrentStop(t *testing.T) {
+	s := NewServer("stop")
+	var stops int32
+	s.SetOnConnStop(func(ziface.IConnection) { atomic.AddInt32(&stops, 1) })
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	conn := NewConnection(s, raw, 1, s.MsgHandler)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				conn.Stop()
+			} else {
+				conn.StopAndDiscardSession()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&stops); n != 1 {
+		t.Fatalf("OnConnStop called %d times", n)
+	}
+	// 已经停止的连接不会再次关闭
+	conn.abort()
+}
@@ -0,0 +1,185 @@
+package znet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	链路追踪
+	带MsgFlagTrace标志的消息在消息体前携带扩展头:
+		TraceID(16字节) + SpanID(8字节) + 追踪标志位 uint8(1字节)
+	设置Span导出器后，每个消息的处理过程都会生成一个Span，上游的SpanID作为父Span，
+	路由中通过SendMsgContext(request.Context(), ...)发送的消息会携带当前Span继续向下游传递。
+	只有对端能够解析扩展头时才携带追踪上下文，即协议握手协商了FeatureTrace，或者对端发送过携带追踪上下文的消息
+*/
+
+// 链路追踪扩展头的长度
+const traceExtLen = 25
+
+// 在buf后追加链路追踪扩展头
+func appendTrace(buf []byte, trace ziface.TraceContext) []byte {
+	buf = append(buf, trace.TraceID[:]...)
+	buf = append(buf, trace.SpanID[:]...)
+	return append(buf, trace.Flags)
+}
+
+// 从消息体中取出链路追踪扩展头
+func decodeTrace(msg ziface.IMessage) error {
+	data := msg.GetData()
+	if len(data) < traceExtLen {
+		return errors.New("trace ext header too short")
+	}
+	var trace ziface.TraceContext
+	copy(trace.TraceID[:], data[0:16])
+	copy(trace.SpanID[:], data[16:24])
+	trace.Flags = data[24]
+	msg.SetTrace(trace)
+	msg.SetData(data[traceExtLen:])
+	msg.SetMsgLen(uint32(len(data) - traceExtLen))
+	msg.SetFlags(msg.GetFlags() &^ MsgFlagTrace)
+	return nil
+}
+
+// 生成一个新的TraceID
+func NewTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+// 生成一个新的SpanID
+func NewSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+type traceContextKey struct{}
+
+// 将链路追踪上下文放入ctx中
+func ContextWithTrace(ctx context.Context, trace ziface.TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, trace)
+}
+
+// 从ctx中取出链路追踪上下文
+func TraceFromContext(ctx context.Context) (ziface.TraceContext, bool) {
+	trace, ok := ctx.Value(traceContextKey{}).(ziface.TraceContext)
+	return trace, ok && trace.IsValid()
+}
+
+// 设置Span导出器，为nil时关闭链路追踪，可以在Server运行时调用
+func (mh *MsgHandler) SetSpanExporter(exporter ziface.ISpanExporter) {
+	mh.spanExporter.Store(&exporter)
+}
+
+// 获取Span导出器，没有设置时返回nil
+func (mh *MsgHandler) getSpanExporter() ziface.ISpanExporter {
+	if exporter := mh.spanExporter.Load(); exporter != nil {
+		return *exporter
+	}
+	return nil
+}
+
+// 开始处理消息时创建Span，并将Span作为请求的链路追踪上下文
+func (mh *MsgHandler) startSpan(request ziface.IRequest) *ziface.Span {
+	parent := request.GetTrace()
+	span := &ziface.Span{
+		TraceID:      parent.TraceID,
+		SpanID:       NewSpanID(),
+		ParentSpanID: parent.SpanID,
+		Name:         fmt.Sprintf("zinx.msg.%d", request.GetMsgID()),
+		MsgID:        request.GetMsgID(),
+		ConnID:       request.GetConnection().GetConnID(),
+		Start:        time.Now(),
+	}
+	flags := parent.Flags
+	// 上游没有携带追踪上下文时，从这里开始一条新的链路
+	if !parent.IsValid() {
+		span.TraceID = NewTraceID()
+		flags = ziface.TraceFlagSampled
+	}
+	request.SetContext(ContextWithTrace(request.Context(), ziface.TraceContext{
+		TraceID: span.TraceID,
+		SpanID:  span.SpanID,
+		Flags:   flags,
+	}))
+	return span
+}
+
+// 消息处理结束时导出Span
+func (mh *MsgHandler) finishSpan(request ziface.IRequest, exporter ziface.ISpanExporter, span *ziface.Span) {
+	span.Duration = time.Since(span.Start)
+	if request.Context().Err() == context.DeadlineExceeded {
+		span.Error = "handle timeout"
+	}
+	if request.GetTrace().IsSampled() {
+		exporter.Export(span)
+	}
+}
+
+// 将Span以JSON格式逐行写入文件的导出器
+type FileSpanExporter struct {
+	file *os.File
+	enc  *json.Encoder
+	// 保护写入的锁
+	lock sync.Mutex
+}
+
+// Span导出到文件时的JSON格式
+type spanRecord struct {
+	TraceID      string    `json:"traceId"`
+	SpanID       string    `json:"spanId"`
+	ParentSpanID string    `json:"parentSpanId,omitempty"`
+	Name         string    `json:"name"`
+	MsgID        uint32    `json:"msgId"`
+	ConnID       uint32    `json:"connId"`
+	Start        time.Time `json:"start"`
+	DurationUs   int64     `json:"durationUs"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// 创建一个文件导出器，Span追加写入path
+func NewFileSpanExporter(path string) (*FileSpanExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSpanExporter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (e *FileSpanExporter) Export(span *ziface.Span) {
+	record := spanRecord{
+		TraceID:    hex.EncodeToString(span.TraceID[:]),
+		SpanID:     hex.EncodeToString(span.SpanID[:]),
+		Name:       span.Name,
+		MsgID:      span.MsgID,
+		ConnID:     span.ConnID,
+		Start:      span.Start,
+		DurationUs: span.Duration.Microseconds(),
+		Error:      span.Error,
+	}
+	if span.ParentSpanID != [8]byte{} {
+		record.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.enc.Encode(&record); err != nil {
+		fmt.Println("[zinx] export span err:", err)
+	}
+}
+
+// 关闭导出文件
+func (e *FileSpanExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.file.Close()
+}
@@ -0,0 +1,144 @@
+package ztest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+/*
+	脚本化的测试客户端
+	按顺序调用Send和Expect描述一次交互，后台goroutine持续读取服务端的消息，
+	大消息的分片在这里重组之后再交给Expect
+*/
+
+type Client struct {
+	conn net.Conn
+	dp   ziface.IDataPack
+	// 已经收到还没有被Expect取走的消息
+	msgs chan ziface.IMessage
+	// 读取结束的原因
+	readErr error
+	// 发送大消息时分配分片ID的计数
+	fragID uint32
+	// 保护写入的锁
+	writeLock sync.Mutex
+	// 是否自动确认服务端的可靠消息，默认开启
+	autoAck atomic.Bool
+	// 已经收到的可靠消息序号，用于丢弃重复的消息
+	received map[uint64]bool
+}
+
+// 使用一个已经建立的连接创建客户端，dp需要和服务端的封包设置一致
+func NewClient(conn net.Conn, dp ziface.IDataPack) *Client {
+	c := &Client{
+		conn:     conn,
+		dp:       dp,
+		msgs:     make(chan ziface.IMessage, 1024),
+		received: make(map[uint64]bool),
+	}
+	c.autoAck.Store(true)
+	go c.readLoop()
+	return c
+}
+
+// 持续读取服务端的消息
+func (c *Client) readLoop() {
+	defer close(c.msgs)
+	reassembler := znet.NewReassembler(0, time.Minute)
+	for {
+		msg, err := znet.ReadFullMsg(c.conn, c.dp, reassembler)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		// 可靠消息回复确认，重复收到的丢弃
+		if seq := msg.GetSeq(); seq != 0 {
+			if c.autoAck.Load() {
+				c.Send(utils.RELIABLE_ACK_MSG_ID, znet.EncodeAck(seq))
+			}
+			if c.received[seq] {
+				continue
+			}
+			c.received[seq] = true
+		}
+		c.msgs <- msg
+	}
+}
+
+// 设置是否自动确认服务端的可靠消息，关闭后需要通过Send发送RELIABLE_ACK_MSG_ID确认
+func (c *Client) SetAutoAck(enabled bool) {
+	c.autoAck.Store(enabled)
+}
+
+// 发送一个消息
+func (c *Client) Send(msgID uint32, data []byte) error {
+	return c.SendMessage(znet.NewMsgPackage(msgID, data))
+}
+
+// 发送一个消息，可以设置可靠投递的序号和链路追踪上下文
+func (c *Client) SendMessage(msg ziface.IMessage) error {
+	frames, err := c.dp.PackFragments(msg, atomic.AddUint32(&c.fragID, 1))
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	for _, frame := range frames {
+		if _, err := c.conn.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 等待下一个消息，消息ID不是msgID或者在timeout内没有收到消息时返回错误
+func (c *Client) Expect(msgID uint32, timeout time.Duration) (ziface.IMessage, error) {
+	msg, err := c.Next(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if msg.GetMsgId() != msgID {
+		return msg, fmt.Errorf("expect msgID = %d, got msgID = %d, data = %q", msgID, msg.GetMsgId(), msg.GetData())
+	}
+	return msg, nil
+}
+
+// 等待下一个消息
+func (c *Client) Next(timeout time.Duration) (ziface.IMessage, error) {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			return nil, fmt.Errorf("connection closed: %v", c.readErr)
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no msg received in %s", timeout)
+	}
+}
+
+// 等待连接被服务端关闭
+func (c *Client) ExpectClosed(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-c.msgs:
+			if !ok {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("connection not closed in %s", timeout)
+		}
+	}
+}
+
+// 关闭客户端连接
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,66 @@
+package ztest
+
+import (
+	"net"
+	"sync"
+)
+
+/*
+	内存监听器
+	Dial时创建一对net.Pipe，一端交给Accept，另一端返回给调用方，不占用任何端口
+*/
+
+type PipeListener struct {
+	// 等待Accept的连接
+	conns chan net.Conn
+	// 监听器关闭的通知
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 创建一个内存监听器
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// 建立一个到监听器的连接，返回客户端一端
+func (l *PipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// 内存管道的地址
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
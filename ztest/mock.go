@@ -0,0 +1,338 @@
+package ztest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+/*
+	路由单元测试使用的模拟连接和请求
+	MockConnection记录所有发送的消息和设置的属性，不需要真实的网络连接
+*/
+
+// 一条通过模拟连接发送的消息
+type SentMsg struct {
+	MsgID uint32
+	Data  []byte
+	// 通过SendMsgContext发送时携带的链路追踪上下文
+	Trace ziface.TraceContext
+	// 发送的优先级，SendMsg和SendMsgContext为PriorityNormal
+	Priority ziface.MsgPriority
+}
+
+type MockConnection struct {
+	ConnID uint32
+	// 已经发送的消息
+	sent []SentMsg
+	// 连接属性
+	property map[string]interface{}
+	// 连接是否已经停止
+	stopped bool
+	// 停止时是否丢弃了会话
+	discarded bool
+	// 认证信息，没有认证时为nil
+	authInfo *ziface.AuthInfo
+	// 最后活动时间
+	lastActivityTime time.Time
+	// 协议违规分数
+	violations int
+	// 协商的协议信息
+	protocol ziface.ProtocolInfo
+	// 保护以上字段的锁
+	lock sync.Mutex
+	// 连接的上下文，连接停止时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// 创建一个模拟连接
+func NewMockConnection(connID uint32) *MockConnection {
+	c := &MockConnection{
+		ConnID:           connID,
+		property:         make(map[string]interface{}),
+		lastActivityTime: time.Now(),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// 获取已经发送的所有消息
+func (c *MockConnection) SentMsgs() []SentMsg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]SentMsg(nil), c.sent...)
+}
+
+// 获取最后一条发送的消息
+func (c *MockConnection) LastSent() (SentMsg, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.sent) == 0 {
+		return SentMsg{}, false
+	}
+	return c.sent[len(c.sent)-1], true
+}
+
+// 清空已经发送的消息
+func (c *MockConnection) ResetSent() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sent = nil
+}
+
+// 连接是否已经停止
+func (c *MockConnection) IsStopped() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stopped
+}
+
+// 连接停止时是否丢弃了会话
+func (c *MockConnection) IsSessionDiscarded() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.discarded
+}
+
+// 设置协商的协议信息
+func (c *MockConnection) SetProtocolInfo(info ziface.ProtocolInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.protocol = info
+}
+
+func (c *MockConnection) Start() {}
+
+func (c *MockConnection) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopped = true
+	c.cancel()
+}
+
+func (c *MockConnection) StopAndDiscardSession() {
+	c.lock.Lock()
+	c.discarded = true
+	c.lock.Unlock()
+	c.Stop()
+}
+
+func (c *MockConnection) GetTCPConnection() *net.TCPConn {
+	return nil
+}
+
+func (c *MockConnection) GetConnID() uint32 {
+	return c.ConnID
+}
+
+func (c *MockConnection) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+func (c *MockConnection) Send(data []byte) error {
+	return nil
+}
+
+func (c *MockConnection) SendMsg(msgId uint32, data []byte) error {
+	return c.record(SentMsg{MsgID: msgId, Data: data, Priority: ziface.PriorityNormal})
+}
+
+func (c *MockConnection) SendMsgContext(ctx context.Context, msgId uint32, data []byte) error {
+	trace, _ := znet.TraceFromContext(ctx)
+	return c.record(SentMsg{MsgID: msgId, Data: data, Trace: trace, Priority: ziface.PriorityNormal})
+}
+
+func (c *MockConnection) SendMsgWithPriority(priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	return c.record(SentMsg{MsgID: msgId, Data: data, Priority: priority})
+}
+
+func (c *MockConnection) TrySendMsg(priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	return c.record(SentMsg{MsgID: msgId, Data: data, Priority: priority})
+}
+
+func (c *MockConnection) TrySendMsgContext(ctx context.Context, priority ziface.MsgPriority, msgId uint32, data []byte) error {
+	trace, _ := znet.TraceFromContext(ctx)
+	return c.record(SentMsg{MsgID: msgId, Data: data, Trace: trace, Priority: priority})
+}
+
+func (c *MockConnection) record(msg SentMsg) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopped {
+		return fmt.Errorf("connection %d stopped", c.ConnID)
+	}
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+func (c *MockConnection) SetProperty(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.property[key] = value
+}
+
+func (c *MockConnection) GetProperty(key string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if value, ok := c.property[key]; ok {
+		return value, nil
+	}
+	return nil, fmt.Errorf("no property found")
+}
+
+func (c *MockConnection) RemoveProperty(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.property, key)
+}
+
+func (c *MockConnection) GetProperties() map[string]interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	properties := make(map[string]interface{}, len(c.property))
+	for key, value := range c.property {
+		properties[key] = value
+	}
+	return properties
+}
+
+func (c *MockConnection) UpdateActivity() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastActivityTime = time.Now()
+}
+
+func (c *MockConnection) GetLastActivityTime() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastActivityTime
+}
+
+func (c *MockConnection) GetRTTStats() ziface.RTTStats {
+	return ziface.RTTStats{}
+}
+
+func (c *MockConnection) AfterFunc(d time.Duration, f func()) ziface.ITimer {
+	return time.AfterFunc(d, f)
+}
+
+func (c *MockConnection) Every(d time.Duration, f func()) ziface.ITimer {
+	t := &mockTicker{ticker: time.NewTicker(d), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-t.ticker.C:
+				f()
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (c *MockConnection) IsAuthenticated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.authInfo != nil
+}
+
+func (c *MockConnection) SetAuthenticated(info *ziface.AuthInfo) {
+	c.SetProperty("userID", info.UserID)
+	c.SetProperty(znet.RolesProperty, info.Roles)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.authInfo = info
+}
+
+func (c *MockConnection) GetProtocolInfo() ziface.ProtocolInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.protocol
+}
+
+func (c *MockConnection) AddProtocolViolation(points int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.violations += points
+	return c.violations
+}
+
+func (c *MockConnection) Context() context.Context {
+	return c.ctx
+}
+
+// 模拟连接的周期定时器
+type mockTicker struct {
+	ticker *time.Ticker
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (t *mockTicker) Stop() bool {
+	stopped := false
+	t.once.Do(func() {
+		t.ticker.Stop()
+		close(t.done)
+		stopped = true
+	})
+	return stopped
+}
+
+// 路由单元测试使用的请求
+type MockRequest struct {
+	Conn  ziface.IConnection
+	MsgID uint32
+	Data  []byte
+	Trace ziface.TraceContext
+	ctx   context.Context
+}
+
+// 创建一个模拟请求
+func NewMockRequest(conn ziface.IConnection, msgID uint32, data []byte) *MockRequest {
+	return &MockRequest{Conn: conn, MsgID: msgID, Data: data}
+}
+
+func (r *MockRequest) GetConnection() ziface.IConnection {
+	return r.Conn
+}
+
+func (r *MockRequest) GetData() []byte {
+	return r.Data
+}
+
+func (r *MockRequest) GetMsgID() uint32 {
+	return r.MsgID
+}
+
+func (r *MockRequest) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	if r.Conn != nil {
+		return r.Conn.Context()
+	}
+	return context.Background()
+}
+
+func (r *MockRequest) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+func (r *MockRequest) GetTrace() ziface.TraceContext {
+	if trace, ok := znet.TraceFromContext(r.Context()); ok {
+		return trace
+	}
+	return r.Trace
+}
+
+var (
+	_ ziface.IConnection = (*MockConnection)(nil)
+	_ ziface.IRequest    = (*MockRequest)(nil)
+)
@@ -0,0 +1,53 @@
+package ztest
+
+import (
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+/*
+	进程内的测试服务器
+	使用内存监听器启动一个完整的zinx Server，客户端通过Dial连接，
+	服务端开启的协议握手和会话加密在Dial时自动完成
+*/
+
+type Server struct {
+	*znet.Server
+	listener *PipeListener
+}
+
+// 创建并启动一个测试服务器，路由可以在启动之后注册
+func NewServer(opts ...znet.Option) *Server {
+	s := &Server{
+		Server:   znet.NewServer("ztest", opts...),
+		listener: NewPipeListener(),
+	}
+	s.StartListener(s.listener)
+	return s
+}
+
+// 建立一个到测试服务器的客户端连接
+func (s *Server) Dial() (*Client, error) {
+	conn, err := s.listener.Dial()
+	if err != nil {
+		return nil, err
+	}
+	stream, info, err := znet.ClientHandshake(conn, s.Config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return NewClient(stream, znet.NewDataPackWithProtocol(s.Config, info)), nil
+}
+
+// 获取服务器的连接数量
+func (s *Server) ConnCount() int {
+	return s.GetConnManager().Size()
+}
+
+// 停止测试服务器，关闭所有连接
+func (s *Server) Close() {
+	s.Stop()
+}
+
+var _ ziface.IServer = (*Server)(nil)
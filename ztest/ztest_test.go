@@ -0,0 +1,1074 @@
+package ztest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Xaytick/zinx/utils"
+	"github.com/Xaytick/zinx/ziface"
+	"github.com/Xaytick/zinx/znet"
+)
+
+/*
+	测试服务器和模拟连接的测试
+*/
+
+type echoRouter struct {
+	znet.BaseRouter
+}
+
+func (r *echoRouter) Handle(request ziface.IRequest) {
+	request.GetConnection().SendMsgContext(request.Context(), request.GetMsgID(), request.GetData())
+}
+
+func TestServer(t *testing.T) {
+	options := map[string][]znet.Option{
+		"plain": nil,
+		"full": {
+			znet.WithProtocolHandshake(),
+			znet.WithSessionEncryption(),
+			znet.WithFrameChecksum("close"),
+			znet.WithCompression("gzip", 64, 0),
+			znet.WithMaxPackageSize(256),
+		},
+	}
+	for name, opts := range options {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer(opts...)
+			defer s.Close()
+			s.AddRouter(10, &echoRouter{})
+			s.MsgHandler.(*znet.MsgHandler).SetUnsupportedReply(true)
+
+			client, err := s.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			// 小消息和需要分片的大消息都可以原样返回
+			for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("zinx"), 1000)} {
+				if err := client.Send(10, data); err != nil {
+					t.Fatal(err)
+				}
+				msg, err := client.Expect(10, time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(msg.GetData(), data) {
+					t.Fatalf("echo mismatch, len = %d", len(msg.GetData()))
+				}
+			}
+
+			// 未注册的消息收到标准错误回复
+			client.Send(99, nil)
+			if _, err := client.Expect(utils.ERROR_MSG_ID, time.Second); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// 客户端和服务端的封包设置不同时，双方按照协议握手协商的结果收发消息
+func TestProtocolNegotiation(t *testing.T) {
+	s := NewServer(
+		znet.WithProtocolHandshake(),
+		znet.WithFrameChecksum("close"),
+		znet.WithCompression("gzip", 64, 0),
+		znet.WithCodecs("protobuf", "json"),
+	)
+	defer s.Close()
+	s.AddRouter(10, &echoRouter{})
+	var negotiated atomic.Value
+	s.SetOnConnStart(func(conn ziface.IConnection) { negotiated.Store(conn.GetProtocolInfo()) })
+
+	// 客户端不开启校验和，只支持deflate压缩和json编码
+	conf := *s.Config
+	conf.FrameChecksum = false
+	conf.Compression = "deflate"
+	conf.Codecs = []string{"json"}
+	conn, err := s.listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, info, err := znet.ClientHandshake(conn, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum || info.Compression != "deflate" || info.Codec != "json" {
+		t.Fatalf("unexpected protocol info %+v", info)
+	}
+	client := NewClient(stream, znet.NewDataPackWithProtocol(&conf, info))
+	defer client.Close()
+
+	data := bytes.Repeat([]byte("zinx"), 100)
+	if err := client.Send(10, data); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.Expect(10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.GetData(), data) {
+		t.Fatalf("echo mismatch, len = %d", len(msg.GetData()))
+	}
+	if server, _ := negotiated.Load().(ziface.ProtocolInfo); server != info {
+		t.Fatalf("server negotiated %+v, client %+v", server, info)
+	}
+}
+
+// 分别通过SendMsgContext和SendMsg回复
+type traceReplyRouter struct {
+	znet.BaseRouter
+}
+
+func (r *traceReplyRouter) Handle(request ziface.IRequest) {
+	request.GetConnection().SendMsgContext(request.Context(), 11, request.GetData())
+	request.GetConnection().SendMsg(12, request.GetData())
+}
+
+// 收集导出的Span
+type spanCollector struct {
+	spans chan *ziface.Span
+}
+
+func (c *spanCollector) Export(span *ziface.Span) {
+	c.spans <- span
+}
+
+// 发送消息并返回SendMsgContext和SendMsg两个回复携带的追踪上下文，以及导出的Span
+func tracedRoundTrip(t *testing.T, client *Client, spans *spanCollector, trace ziface.TraceContext) (ctxTrace, plainTrace ziface.TraceContext, span *ziface.Span) {
+	t.Helper()
+	msg := znet.NewMsgPackage(10, []byte("hi"))
+	msg.SetTrace(trace)
+	if err := client.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.Expect(11, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxTrace = reply.GetTrace()
+	if reply, err = client.Expect(12, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	plainTrace = reply.GetTrace()
+	select {
+	case span = <-spans.spans:
+	case <-time.After(time.Second):
+		t.Fatal("span not exported")
+	}
+	return ctxTrace, plainTrace, span
+}
+
+// 只有对端能够解析链路追踪扩展头时才携带追踪上下文，SendMsg不携带追踪上下文
+func TestTracePropagation(t *testing.T) {
+	spans := &spanCollector{spans: make(chan *ziface.Span, 4)}
+	s := NewServer()
+	defer s.Close()
+	s.AddRouter(10, &traceReplyRouter{})
+	s.SetSpanExporter(spans)
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 客户端没有携带过追踪上下文，服务端开始的新链路不发送给客户端
+	ctxTrace, plainTrace, span := tracedRoundTrip(t, client, spans, ziface.TraceContext{})
+	if ctxTrace.IsValid() || plainTrace.IsValid() {
+		t.Fatalf("untraced client got trace %+v / %+v", ctxTrace, plainTrace)
+	}
+	if span.ParentSpanID != [8]byte{} {
+		t.Fatalf("new trace should not have a parent span, got %+v", span)
+	}
+
+	// 上游携带的追踪上下文通过request.Context()继续传递
+	trace := ziface.TraceContext{TraceID: znet.NewTraceID(), SpanID: znet.NewSpanID(), Flags: ziface.TraceFlagSampled}
+	ctxTrace, plainTrace, span = tracedRoundTrip(t, client, spans, trace)
+	if ctxTrace.TraceID != trace.TraceID || ctxTrace.SpanID != span.SpanID || span.ParentSpanID != trace.SpanID {
+		t.Fatalf("reply trace = %+v, span = %+v, upstream = %+v", ctxTrace, span, trace)
+	}
+	if plainTrace.IsValid() {
+		t.Fatalf("SendMsg should not carry a trace, got %+v", plainTrace)
+	}
+
+	// 协议握手协商了FeatureTrace时，服务端开始的新链路同样发送给客户端
+	hs := NewServer(znet.WithProtocolHandshake())
+	defer hs.Close()
+	hs.AddRouter(10, &traceReplyRouter{})
+	hs.SetSpanExporter(spans)
+	hsClient, err := hs.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hsClient.Close()
+	ctxTrace, _, span = tracedRoundTrip(t, hsClient, spans, ziface.TraceContext{})
+	if ctxTrace.TraceID != span.TraceID || ctxTrace.SpanID != span.SpanID {
+		t.Fatalf("reply trace = %+v, span = %+v", ctxTrace, span)
+	}
+}
+
+// 期望收到一个指定错误码的标准错误回复
+func expectErrorReply(t *testing.T, client *Client, code int) {
+	t.Helper()
+	msg, err := client.Expect(utils.ERROR_MSG_ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply znet.ErrorReply
+	if err := json.Unmarshal(msg.GetData(), &reply); err != nil || reply.Code != code {
+		t.Fatalf("error reply = %s, want code %d", msg.GetData(), code)
+	}
+}
+
+// 认证之前只有白名单中的消息被处理，登录成功之后才能调用其他消息，超过期限没有认证的连接被关闭
+func TestAuthentication(t *testing.T) {
+	secret := []byte("secret")
+	s := NewServer(znet.WithAuthTimeout(1))
+	defer s.Close()
+	s.SetAuthenticator(&znet.HMACTokenAuthenticator{Secret: secret}, 10, 11)
+	s.AddRouter(11, &echoRouter{})
+	s.AddRouter(12, &echoRouter{})
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 没有认证时不在白名单中的消息被拒绝
+	client.Send(12, []byte("hi"))
+	expectErrorReply(t, client, znet.ErrCodeUnauthenticated)
+	// 白名单中的消息正常处理
+	client.Send(11, []byte("hi"))
+	if _, err := client.Expect(11, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// 签名错误的token
+	client.Send(10, []byte(znet.NewHMACToken([]byte("other"), 7, nil, time.Minute)))
+	expectErrorReply(t, client, znet.ErrCodeAuthFailed)
+
+	client.Send(10, []byte(znet.NewHMACToken(secret, 7, nil, time.Minute)))
+	msg, err := client.Expect(utils.AUTH_OK_MSG_ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != `{"userId":7}` {
+		t.Fatalf("auth ok = %s", msg.GetData())
+	}
+	if conn := s.GetConnManager().GetConnByUserID(7); conn == nil || !conn.IsAuthenticated() {
+		t.Fatal("user 7 not bound after login")
+	}
+	client.Send(12, []byte("hi"))
+	if _, err := client.Expect(12, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 认证期限之后已经认证的连接不受影响，没有认证的连接被关闭
+	idle, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if err := idle.ExpectClosed(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client.Send(12, []byte("hi"))
+	if _, err := client.Expect(12, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMockConnection(t *testing.T) {
+	conn := NewMockConnection(1)
+	trace := ziface.TraceContext{TraceID: znet.NewTraceID(), SpanID: znet.NewSpanID()}
+	request := NewMockRequest(conn, 10, []byte("hi"))
+	request.SetContext(znet.ContextWithTrace(request.Context(), trace))
+
+	(&echoRouter{}).Handle(request)
+	sent, ok := conn.LastSent()
+	if !ok || sent.MsgID != 10 || string(sent.Data) != "hi" || sent.Trace != trace {
+		t.Fatalf("unexpected sent msg %+v", sent)
+	}
+
+	conn.SetAuthenticated(&ziface.AuthInfo{UserID: 7})
+	if value, err := conn.GetProperty("userID"); err != nil || value.(uint) != 7 {
+		t.Fatal("userID property not set")
+	}
+	conn.Stop()
+	if !conn.IsStopped() || conn.Context().Err() == nil {
+		t.Fatal("connection not stopped")
+	}
+}
+
+// 保存房间属性并回复，不经过认证直接绑定userID
+type joinRouter struct {
+	znet.BaseRouter
+	connMgr ziface.IConnManager
+}
+
+func (r *joinRouter) Handle(request ziface.IRequest) {
+	conn := request.GetConnection()
+	conn.SetProperty("userID", uint(7))
+	r.connMgr.SetConnByUserID(conn.GetConnID(), 7)
+	conn.SetProperty("room", string(request.GetData()))
+	conn.SendMsg(request.GetMsgID(), request.GetData())
+}
+
+// 回复房间属性
+type roomRouter struct {
+	znet.BaseRouter
+}
+
+func (r *roomRouter) Handle(request ziface.IRequest) {
+	room, _ := request.GetConnection().GetProperty("room")
+	request.GetConnection().SendMsg(request.GetMsgID(), []byte(room.(string)))
+}
+
+func TestSessionResume(t *testing.T) {
+	s := NewServer(znet.WithSessionResume(5, 8))
+	defer s.Close()
+	s.AddRouter(10, &echoRouter{})
+	s.AddRouter(11, &joinRouter{connMgr: s.GetConnManager()})
+	s.AddRouter(12, &roomRouter{})
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := string(msg.GetData())
+	client.Send(11, []byte("lobby"))
+	client.Expect(11, time.Second)
+	client.Send(10, []byte("missed"))
+	client.Expect(10, time.Second)
+	client.Close()
+	for i := 0; s.ConnCount() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 只确认收到了第一条消息，第二条需要重放
+	client, err = s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	client.Send(utils.RESUME_MSG_ID, []byte(`{"token":"`+token+`","lastSeq":1}`))
+	if msg, err = client.Expect(utils.RESUME_OK_MSG_ID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != `{"replayed":1,"lost":0}` {
+		t.Fatalf("unexpected resume reply %s", msg.GetData())
+	}
+	if msg, err = client.Expect(10, time.Second); err != nil || string(msg.GetData()) != "missed" {
+		t.Fatal("missed msg not replayed", err)
+	}
+	client.Send(12, nil)
+	if msg, err = client.Expect(12, time.Second); err != nil || string(msg.GetData()) != "lobby" {
+		t.Fatal("session property not restored", err)
+	}
+	if conn := s.GetConnManager().GetConnByUserID(7); conn == nil {
+		t.Fatal("userID binding not restored")
+	}
+
+	// 无效的token恢复失败
+	other, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	other.Send(utils.RESUME_MSG_ID, []byte(`{"token":"invalid","lastSeq":0}`))
+	if _, err := other.Expect(utils.ERROR_MSG_ID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 握手失败的连接没有启动，不调用OnConnStart和OnConnStop
+func TestHandshakeFailure(t *testing.T) {
+	s := NewServer(znet.WithSessionEncryption())
+	defer s.Close()
+	var started, stopped atomic.Int32
+	s.SetOnConnStart(func(ziface.IConnection) { started.Add(1) })
+	s.SetOnConnStop(func(ziface.IConnection) { stopped.Add(1) })
+
+	conn, err := s.listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	znet.WriteMsg(conn, znet.NewDataPack(), 10, []byte("not a session key"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn not closed after handshake failure")
+	}
+	for i := 0; s.ConnCount() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.ConnCount() != 0 || started.Load() != 0 || stopped.Load() != 0 {
+		t.Fatalf("conns = %d, started = %d, stopped = %d", s.ConnCount(), started.Load(), stopped.Load())
+	}
+}
+
+// 因为协议违规被关闭的连接丢弃会话，客户端不能再恢复
+func TestSessionDiscardedOnViolation(t *testing.T) {
+	s := NewServer(znet.WithSessionResume(5, 8), znet.WithMaxProtocolViolations(1))
+	defer s.Close()
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := string(msg.GetData())
+	client.Send(99, nil)
+	client.Send(99, nil)
+	if err := client.ExpectClosed(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	for i := 0; s.ConnCount() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Sessions.Size() != 0 {
+		t.Fatalf("%d sessions kept after violation", s.Sessions.Size())
+	}
+
+	client, err = s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	client.Send(utils.RESUME_MSG_ID, []byte(`{"token":"`+token+`","lastSeq":0}`))
+	if _, err := client.Expect(utils.ERROR_MSG_ID, time.Second); err != nil {
+		t.Fatal("resume of discarded session not rejected", err)
+	}
+}
+
+// 先推送多条低优先级的消息，再推送一条高优先级的消息
+type burstRouter struct {
+	znet.BaseRouter
+}
+
+func (r *burstRouter) Handle(request ziface.IRequest) {
+	for i := 0; i < 4; i++ {
+		request.GetConnection().SendMsgWithPriority(ziface.PriorityLow, 13, []byte{'l', byte('0' + i)})
+	}
+	request.GetConnection().SendMsgWithPriority(ziface.PriorityHigh, 13, []byte("h"))
+}
+
+// 不同优先级的消息在发送队列中乱序时，恢复会话重放的是客户端按收到顺序没有收到的消息
+func TestSessionResumeMixedPriority(t *testing.T) {
+	s := NewServer(znet.WithSessionResume(5, 16))
+	defer s.Close()
+	s.AddRouter(13, &burstRouter{})
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := string(msg.GetData())
+	client.Send(13, nil)
+	var received []string
+	for len(received) < 5 {
+		msg, err := client.Expect(13, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, string(msg.GetData()))
+	}
+	client.Close()
+	for i := 0; s.ConnCount() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 只确认收到了前两条消息，按收到的顺序重放后三条
+	client, err = s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+	client.Send(utils.RESUME_MSG_ID, []byte(`{"token":"`+token+`","lastSeq":2}`))
+	if msg, err = client.Expect(utils.RESUME_OK_MSG_ID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.GetData()) != `{"replayed":3,"lost":0}` {
+		t.Fatalf("unexpected resume reply %s", msg.GetData())
+	}
+	want := map[string]bool{}
+	for _, data := range received[2:] {
+		want[data] = true
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := client.Expect(13, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !want[string(msg.GetData())] {
+			t.Fatalf("replayed %s, received order %v", msg.GetData(), received)
+		}
+		delete(want, string(msg.GetData()))
+	}
+}
+
+// 收到请求后推送一条可靠消息
+type pushRouter struct {
+	znet.BaseRouter
+}
+
+func (r *pushRouter) Handle(request ziface.IRequest) {
+	request.GetConnection().SendMsg(20, []byte("push"))
+}
+
+func TestReliableDelivery(t *testing.T) {
+	newServer := func(opts ...znet.Option) (*Server, chan ziface.DeliveryStatus) {
+		s := NewServer(append(opts, znet.WithReliable(20))...)
+		s.AddRouter(10, &echoRouter{})
+		s.AddRouter(21, &pushRouter{})
+		statuses := make(chan ziface.DeliveryStatus, 8)
+		s.SetOnDelivery(func(conn ziface.IConnection, msgID uint32, seq uint64, status ziface.DeliveryStatus) {
+			statuses <- status
+		})
+		return s, statuses
+	}
+	expectStatus := func(statuses chan ziface.DeliveryStatus, want ziface.DeliveryStatus) {
+		t.Helper()
+		select {
+		case status := <-statuses:
+			if status != want {
+				t.Fatalf("expect delivery status %s, got %s", want, status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no delivery status %s", want)
+		}
+	}
+	// 收到一条没有确认的可靠消息后断开连接
+	dropAfterPush := func(s *Server, client *Client) {
+		client.SetAutoAck(false)
+		client.Send(21, nil)
+		if msg, err := client.Expect(20, time.Second); err != nil || msg.GetSeq() != 1 {
+			t.Fatal("reliable msg not received", err)
+		}
+		client.Close()
+		for i := 0; s.ConnCount() > 0 && i < 100; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("retransmit", func(t *testing.T) {
+		s, statuses := newServer(znet.WithSessionResume(5, 8))
+		defer s.Close()
+		client, err := s.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropAfterPush(s, client)
+
+		// 消息已经收到，只是没有确认，恢复后不会重放但会作为可靠消息重新发送
+		client, err = s.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Expect(utils.RESUME_TOKEN_MSG_ID, time.Second)
+		client.Send(utils.RESUME_MSG_ID, []byte(`{"token":"`+string(msg.GetData())+`","lastSeq":1}`))
+		if _, err := client.Expect(utils.RESUME_OK_MSG_ID, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := client.Expect(20, time.Second); err != nil || msg.GetSeq() != 1 {
+			t.Fatal("reliable msg not retransmitted", err)
+		}
+		expectStatus(statuses, ziface.DeliveryRetransmitted)
+		expectStatus(statuses, ziface.DeliveryAcked)
+
+		// 服务端确认客户端的可靠消息，重复的消息只处理一次
+		dup := znet.NewMsgPackage(10, []byte("dup"))
+		dup.SetSeq(1)
+		client.SendMessage(dup)
+		client.SendMessage(dup)
+		client.Send(10, []byte("end"))
+		echoes, acks := 0, 0
+		for {
+			msg, err := client.Next(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.GetMsgId() == utils.RELIABLE_ACK_MSG_ID {
+				acks++
+				continue
+			}
+			if string(msg.GetData()) == "end" {
+				break
+			}
+			echoes++
+		}
+		if echoes != 1 || acks != 2 {
+			t.Fatalf("expect 1 echo and 2 acks, got %d echoes and %d acks", echoes, acks)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s, statuses := newServer()
+		defer s.Close()
+		client, err := s.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropAfterPush(s, client)
+		expectStatus(statuses, ziface.DeliveryFailed)
+	})
+}
+
+// 没有开启可靠投递的服务端和超出接收窗口的序号不回复确认，计为协议违规
+func TestReliableReceiveLimits(t *testing.T) {
+	reliableMsg := func(seq uint64) ziface.IMessage {
+		msg := znet.NewMsgPackage(10, []byte("reliable"))
+		msg.SetSeq(seq)
+		return msg
+	}
+	cases := map[string]struct {
+		opts []znet.Option
+		seq  uint64
+	}{
+		"disabled":      {seq: 1},
+		"out of window": {opts: []znet.Option{znet.WithReliable(20)}, seq: 1 << 20},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer(append(tc.opts, znet.WithMaxProtocolViolations(1))...)
+			defer s.Close()
+			s.AddRouter(10, &echoRouter{})
+			client, err := s.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			// 可靠消息被丢弃，没有确认也没有回复
+			client.SendMessage(reliableMsg(tc.seq))
+			client.Send(10, []byte("end"))
+			if msg, err := client.Expect(10, time.Second); err != nil || string(msg.GetData()) != "end" {
+				t.Fatalf("reliable msg should be dropped without ack, got %v", err)
+			}
+			// 违规分数超过上限之后连接被关闭
+			client.SendMessage(reliableMsg(tc.seq))
+			if err := client.ExpectClosed(time.Second); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// 订阅请求中的主题
+type subscribeRouter struct {
+	znet.BaseRouter
+	ps ziface.IPubSub
+}
+
+func (r *subscribeRouter) Handle(request ziface.IRequest) {
+	conn := request.GetConnection()
+	if err := r.ps.Subscribe(conn, string(request.GetData())); err != nil {
+		return
+	}
+	conn.SendMsg(request.GetMsgID(), nil)
+}
+
+func TestPubSub(t *testing.T) {
+	ps := znet.NewPubSub()
+	exact, single, multi := NewMockConnection(1), NewMockConnection(2), NewMockConnection(3)
+	for conn, patterns := range map[*MockConnection][]string{
+		exact:  {"market.btc.usdt"},
+		single: {"market.*.usdt", "market.btc.usdt"},
+		multi:  {"market.#"},
+	} {
+		for _, pattern := range patterns {
+			if err := ps.Subscribe(conn, pattern); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, pattern := range []string{"", "market..btc", "market.#.usdt", "market.b*"} {
+		if err := ps.Subscribe(exact, pattern); err == nil {
+			t.Fatalf("invalid pattern %q accepted", pattern)
+		}
+	}
+
+	// 匹配多个订阅的连接只收到一次
+	if n := ps.Publish("market.btc.usdt", 30, []byte("100")); n != 3 || len(single.SentMsgs()) != 1 {
+		t.Fatalf("delivered to %d conns, single received %d", n, len(single.SentMsgs()))
+	}
+	if n := ps.PublishWithPriority("market.eth.usdt", ziface.PriorityLow, 30, nil); n != 2 {
+		t.Fatalf("delivered to %d conns", n)
+	}
+	if sent, _ := multi.LastSent(); sent.Priority != ziface.PriorityLow {
+		t.Fatal("priority not kept")
+	}
+	if n := ps.Publish("market", 30, nil); n != 1 {
+		t.Fatalf("# should match zero segments, delivered to %d conns", n)
+	}
+	if n := ps.Publish("market.*", 30, nil); n != 0 {
+		t.Fatal("wildcard topic published")
+	}
+
+	// 取消订阅之后不再收到
+	ps.UnsubscribeAll(single)
+	if subs := ps.GetSubscriptions(single); len(subs) != 0 {
+		t.Fatalf("subscriptions not removed: %v", subs)
+	}
+	multi.Stop()
+	ps.Publish("market.btc.usdt", 30, nil)
+	stats := ps.GetTopicStats()
+	if len(stats) != 3 || stats[1].Topic != "market.btc.usdt" || stats[1].Published != 2 ||
+		stats[1].Delivered != 4 || stats[1].Failed != 1 {
+		t.Fatalf("unexpected topic stats %+v", stats)
+	}
+
+	// 连接停止时自动取消订阅
+	s := NewServer()
+	defer s.Close()
+	s.AddRouter(40, &subscribeRouter{ps: s.GetPubSub()})
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(40, []byte("guild.*"))
+	if _, err := client.Expect(40, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.PubSub.Publish("guild.7", 41, []byte("hi")); n != 1 {
+		t.Fatalf("delivered to %d conns", n)
+	}
+	if msg, err := client.Expect(41, time.Second); err != nil || string(msg.GetData()) != "hi" {
+		t.Fatal("published msg not received", err)
+	}
+	client.Close()
+	for i := 0; s.ConnCount() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.PubSub.Publish("guild.7", 41, nil); n != 0 {
+		t.Fatal("subscription not removed on stop")
+	}
+}
+
+// 按照连接的角色校验消息权限，单个msgID优先于区间，范围小的区间优先于范围大的区间
+func TestPermission(t *testing.T) {
+	secret := []byte("secret")
+	s := NewServer()
+	defer s.Close()
+	// 角色随HMAC token签名
+	s.SetAuthenticator(&znet.HMACTokenAuthenticator{Secret: secret}, 10)
+	permissions := znet.NewPermissionTable()
+	permissions.Require(20, "admin")
+	if err := permissions.RequireRange(30, 39, "user", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := permissions.RequireRange(35, 35, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := permissions.RequireRange(50, 40, "admin"); err == nil {
+		t.Fatal("reversed range accepted")
+	}
+	s.SetAuthorizer(permissions)
+	audits := make(chan znet.AuditEntry, 4)
+	s.MsgHandler.(*znet.MsgHandler).SetAuditLog(func(entry znet.AuditEntry) { audits <- entry })
+	for _, msgID := range []uint32{20, 30, 35, 40} {
+		s.AddRouter(msgID, &echoRouter{})
+	}
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 篡改token中的角色之后签名校验失败
+	token := znet.NewHMACToken(secret, 1, []string{"user"}, time.Minute)
+	parts := bytes.Split([]byte(token), []byte("."))
+	parts[1] = []byte(base64.RawURLEncoding.EncodeToString([]byte(`["admin"]`)))
+	client.Send(10, bytes.Join(parts, []byte(".")))
+	expectErrorReply(t, client, znet.ErrCodeAuthFailed)
+
+	client.Send(10, []byte(token))
+	if _, err := client.Expect(utils.AUTH_OK_MSG_ID, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		msgID   uint32
+		allowed bool
+	}{{20, false}, {30, true}, {35, false}, {40, true}} {
+		client.Send(tc.msgID, nil)
+		if !tc.allowed {
+			expectErrorReply(t, client, znet.ErrCodeForbidden)
+			entry := <-audits
+			if entry.MsgID != tc.msgID || entry.UserID != 1 || len(entry.Roles) != 1 || entry.Roles[0] != "user" {
+				t.Fatalf("audit entry = %+v", entry)
+			}
+			continue
+		}
+		if _, err := client.Expect(tc.msgID, time.Second); err != nil {
+			t.Fatalf("msgID %d: %v", tc.msgID, err)
+		}
+	}
+}
+
+// 没有路由匹配的消息调用Hook函数、回复unsupported错误并计入协议违规分数，分数超过上限时关闭连接
+func TestUnknownMsg(t *testing.T) {
+	s := NewServer(znet.WithMaxProtocolViolations(2))
+	defer s.Close()
+	mh := s.MsgHandler.(*znet.MsgHandler)
+	if err := mh.AddRangeRouter(100, 199, &echoRouter{}); err != nil {
+		t.Fatal(err)
+	}
+	mh.SetUnsupportedReply(true)
+	unknown := make(chan uint32, 4)
+	mh.SetOnUnknownMsg(func(request ziface.IRequest) { unknown <- request.GetMsgID() })
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 区间路由匹配的消息正常处理，不计入违规
+	for i := 0; i < 3; i++ {
+		client.Send(150, nil)
+		if _, err := client.Expect(150, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		client.Send(99, nil)
+		expectErrorReply(t, client, znet.ErrCodeUnsupported)
+		if msgID := <-unknown; msgID != 99 {
+			t.Fatalf("unknown hook got msgID = %d", msgID)
+		}
+	}
+	// 分数没有超过上限时连接保持
+	client.Send(150, nil)
+	if _, err := client.Expect(150, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client.Send(99, nil)
+	if err := client.ExpectClosed(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 服务端主动发送心跳，客户端原样回复PONG之后服务端记录RTT
+func TestActiveHeartbeatRTT(t *testing.T) {
+	s := NewServer(znet.WithActiveHeartbeat(1))
+	defer s.Close()
+	s.SetHeartbeatConfig(100*time.Millisecond, 10*time.Second)
+	started := make(chan ziface.IConnection, 1)
+	s.SetOnConnStart(func(conn ziface.IConnection) { started <- conn })
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-started
+
+	for i := 0; i < 3; i++ {
+		ping, err := client.Expect(utils.PING_MSG_ID, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ping.GetData()) != 8 {
+			t.Fatalf("ping data len = %d", len(ping.GetData()))
+		}
+		if err := client.Send(utils.PONG_MSG_ID, ping.GetData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for conn.GetRTTStats().Samples < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rtt samples = %+v", conn.GetRTTStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := conn.GetRTTStats()
+	if stats.Last <= 0 || stats.Min > stats.Avg || stats.Avg > stats.Max || stats.Missed > 1 {
+		t.Fatalf("unexpected rtt stats %+v", stats)
+	}
+	if s.ConnCount() != 1 {
+		t.Fatal("answered heartbeats should keep the connection open")
+	}
+}
+
+// 客户端连续不回复PONG超过限制之后，即使没有达到心跳超时连接也会被关闭
+func TestActiveHeartbeatMissed(t *testing.T) {
+	s := NewServer(znet.WithActiveHeartbeat(2))
+	defer s.Close()
+	s.SetHeartbeatConfig(100*time.Millisecond, 10*time.Second)
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 丢失的心跳没有超过限制之前连接保持打开
+	for i := 0; i < 3; i++ {
+		if _, err := client.Expect(utils.PING_MSG_ID, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.ExpectClosed(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 等待请求的上下文结束，把结束的原因回复给客户端，done不为nil时发送到done
+// 上下文没有期限并且不会被取消时直接回复"no deadline"
+type waitCtxRouter struct {
+	znet.BaseRouter
+	done chan error
+}
+
+func (r *waitCtxRouter) Handle(request ziface.IRequest) {
+	ctx := request.Context()
+	if _, ok := ctx.Deadline(); !ok && r.done == nil {
+		request.GetConnection().SendMsg(request.GetMsgID(), []byte("no deadline"))
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+	}
+	if r.done != nil {
+		r.done <- ctx.Err()
+		return
+	}
+	request.GetConnection().SendMsg(request.GetMsgID(), []byte(fmt.Sprint(ctx.Err())))
+}
+
+// 设置了处理超时时间的消息在超时后取消请求的上下文，其他消息不受影响
+func TestHandlerTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddRouter(20, &waitCtxRouter{})
+	s.AddRouter(21, &waitCtxRouter{})
+	s.SetHandlerTimeout(20, 50*time.Millisecond)
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	client.Send(20, nil)
+	reply, err := client.Expect(20, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.GetData()) != context.DeadlineExceeded.Error() {
+		t.Fatalf("handler ctx err = %q", reply.GetData())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handler timeout took %s", elapsed)
+	}
+
+	client.Send(21, nil)
+	if reply, err = client.Expect(21, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.GetData()) != "no deadline" {
+		t.Fatalf("msg without timeout got %q", reply.GetData())
+	}
+}
+
+// 连接停止时取消正在处理的请求的上下文
+func TestHandlerContextCanceledOnStop(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	done := make(chan error, 1)
+	s.AddRouter(20, &waitCtxRouter{done: done})
+
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(20, nil)
+	// 等待服务端开始处理之后再关闭连接
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("handler ctx err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler ctx not canceled after conn stopped")
+	}
+}
+
+// 处理消息时可以并发替换认证器、权限校验和Span导出器
+func TestSwapHooksWhileServing(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddRouter(10, &echoRouter{})
+	client, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	// 每个消息最多导出一个Span，缓冲足够时导出不会阻塞
+	spans := &spanCollector{spans: make(chan *ziface.Span, 32)}
+	go func() {
+		allowAll := znet.NewPermissionTable()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				s.SetAuthorizer(allowAll)
+				s.SetSpanExporter(spans)
+			} else {
+				s.SetAuthorizer(nil)
+				s.SetSpanExporter(nil)
+			}
+			s.SetAuthenticator(nil, 0)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		client.Send(10, []byte("hi"))
+		if _, err := client.Expect(10, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}